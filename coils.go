@@ -0,0 +1,122 @@
+package main
+
+import (
+	"time"
+	"github.com/ggueret/mbpio/gpio"
+	"github.com/ggueret/mbpio/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// coilTimer holds the pending timer of a coil output with a pulse or delays,
+// bumping the generation invalidates a timer that already fired but still
+// waits for the lock.
+type coilTimer struct {
+	timer		*time.Timer
+	generation	int
+	pulsing		bool
+}
+
+func hasTimers(output config.Output) bool {
+	return output.Pulse > 0 || output.OnDelay > 0 || output.OffDelay > 0
+}
+
+// driveCoil sets the pin and the coil of an output, the register map must be
+// locked.
+func (s *Server) driveCoil(u *unit, addr int, output config.Output, value bool) {
+	state := gpio.Low
+	if value {
+		state = gpio.High
+	}
+	s.gpio.WritePin(output.Pin, state)
+	u.coils[addr] = byte(state)
+}
+
+func (u *unit) coilTimer(addr int) *coilTimer {
+	if u.coilTimers == nil {
+		u.coilTimers = make(map[int]*coilTimer)
+	}
+	t, ok := u.coilTimers[addr]
+	if !ok {
+		t = &coilTimer{}
+		u.coilTimers[addr] = t
+	}
+	return t
+}
+
+func (t *coilTimer) cancel() {
+	t.generation++
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+func (s *Server) scheduleCoil(t *coilTimer, after time.Duration, fn func()) {
+	t.cancel()
+	generation := t.generation
+	t.timer = time.AfterFunc(after, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if t.generation != generation {
+			return
+		}
+		t.timer = nil
+		fn()
+	})
+}
+
+// startCoil raises the coil, for its pulse duration when it has one.
+func (s *Server) startCoil(u *unit, addr int, output config.Output, t *coilTimer) {
+	s.driveCoil(u, addr, output, true)
+	if output.Pulse == 0 {
+		return
+	}
+	t.pulsing = true
+	s.scheduleCoil(t, output.Pulse, func() {
+		t.pulsing = false
+		s.driveCoil(u, addr, output, false)
+		log.WithFields(log.Fields{"unit": u.id, "addr": addr, "pin": output.Pin}).Debug("Coil pulse ended")
+	})
+}
+
+// writeCoil applies a write to a coil output. Writing 1 raises it after the
+// on delay and for the pulse duration, a new write restarts the timers.
+// Writing 0 lowers it after the off delay, or at once to cut a pulse. The
+// register map must be locked.
+func (s *Server) writeCoil(u *unit, addr int, output config.Output, value bool) {
+	if !hasTimers(output) {
+		s.driveCoil(u, addr, output, value)
+		return
+	}
+
+	t := u.coilTimer(addr)
+	switch {
+	case value && output.OnDelay > 0:
+		s.scheduleCoil(t, output.OnDelay, func() {
+			s.startCoil(u, addr, output, t)
+		})
+	case value:
+		t.cancel()
+		s.startCoil(u, addr, output, t)
+	case output.OffDelay > 0 && !t.pulsing && u.coils[addr] != 0:
+		s.scheduleCoil(t, output.OffDelay, func() {
+			s.driveCoil(u, addr, output, false)
+		})
+	default:
+		t.cancel()
+		t.pulsing = false
+		s.driveCoil(u, addr, output, false)
+	}
+}
+
+// cancelCoilTimers drops the pending timers, a running pulse is cut. The
+// register map must be locked.
+func (s *Server) cancelCoilTimers(u *unit) {
+	for addr, t := range u.coilTimers {
+		t.cancel()
+		if t.pulsing {
+			t.pulsing = false
+			s.driveCoil(u, addr, u.outputs[addr], false)
+		}
+	}
+}
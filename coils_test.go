@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"testing"
+	"path/filepath"
+	"github.com/ggueret/mbpio/gpio"
+)
+
+// coilServer loads the coil output 1 on pin 23 of the sim driver, with the
+// timers given as yaml.
+func coilServer(t *testing.T, timers string) (*Server, *unit) {
+	t.Helper()
+	s, err := loadServer(t, fmt.Sprintf("gpio: {driver: sim}\noutputs: {1: {pin: 23, %s}}\n", timers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.initOutputs(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.mu.Lock()
+		s.cancelCoilTimers(s.units[0])
+		s.mu.Unlock()
+	})
+	return s, s.units[0]
+}
+
+// setCoil writes the coil 1.
+func setCoil(s *Server, u *unit, value bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeCoil(u, 1, u.outputs[1], value)
+}
+
+// coil returns the coil 1, checking that pin 23 follows it.
+func coil(t *testing.T, s *Server, u *unit) byte {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state := s.gpio.ReadPin(23); byte(state) != u.coils[1] {
+		t.Errorf("pin 23 is %s with coil 1 at %d", gpio.StateStrings[state], u.coils[1])
+	}
+	return u.coils[1]
+}
+
+// waitCoil waits for the coil 1 to reach want and returns the time elapsed
+// since start.
+func waitCoil(t *testing.T, s *Server, u *unit, want byte, start time.Time) time.Duration {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for coil(t, s, u) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("coil 1 never went to %d", want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return time.Since(start)
+}
+
+func TestCoilTimers(t *testing.T) {
+	tests := []struct {
+		name		string
+		timers		string
+		writes		[]bool
+		before		byte
+		after		byte
+	}{
+		{"pulse", "pulse: 50ms", []bool{true}, 1, 0},
+		{"on delay", "on_delay: 50ms", []bool{true}, 0, 1},
+		{"off delay", "off_delay: 50ms", []bool{true, false}, 1, 0},
+		{"delayed pulse", "on_delay: 50ms, pulse: 1h", []bool{true}, 0, 1},
+	}
+	for _, test := range tests {
+		s, u := coilServer(t, test.timers)
+		start := time.Now()
+		for _, value := range test.writes {
+			setCoil(s, u, value)
+		}
+		if got := coil(t, s, u); got != test.before {
+			t.Errorf("%s: coil %d after the writes, want %d", test.name, got, test.before)
+		}
+		if elapsed := waitCoil(t, s, u, test.after, start); elapsed < 50 * time.Millisecond {
+			t.Errorf("%s: coil went to %d after %s, want 50ms", test.name, test.after, elapsed)
+		}
+	}
+}
+
+func TestCoilTimersOverlap(t *testing.T) {
+	// a second write restarts the on delay
+	s, u := coilServer(t, "on_delay: 100ms")
+	start := time.Now()
+	setCoil(s, u, true)
+	time.Sleep(60 * time.Millisecond)
+	setCoil(s, u, true)
+	if elapsed := waitCoil(t, s, u, 1, start); elapsed < 160 * time.Millisecond {
+		t.Errorf("on delay restarted: coil raised after %s, want 160ms", elapsed)
+	}
+
+	// and the pulse
+	s, u = coilServer(t, "pulse: 100ms")
+	start = time.Now()
+	setCoil(s, u, true)
+	time.Sleep(60 * time.Millisecond)
+	setCoil(s, u, true)
+	if elapsed := waitCoil(t, s, u, 0, start); elapsed < 160 * time.Millisecond {
+		t.Errorf("pulse restarted: coil lowered after %s, want 160ms", elapsed)
+	}
+
+	// clearing the coil cancels its on delay
+	s, u = coilServer(t, "on_delay: 50ms")
+	setCoil(s, u, true)
+	setCoil(s, u, false)
+	time.Sleep(100 * time.Millisecond)
+	if got := coil(t, s, u); got != 0 {
+		t.Error("coil raised after the write clearing it")
+	}
+
+	// and cuts its pulse, without waiting for the off delay
+	s, u = coilServer(t, "pulse: 1h, off_delay: 1h")
+	setCoil(s, u, true)
+	setCoil(s, u, false)
+	if got := coil(t, s, u); got != 0 {
+		t.Error("pulse not cut by the write clearing the coil")
+	}
+
+	// raising the coil cancels its off delay
+	s, u = coilServer(t, "off_delay: 50ms")
+	setCoil(s, u, true)
+	setCoil(s, u, false)
+	setCoil(s, u, true)
+	time.Sleep(100 * time.Millisecond)
+	if got := coil(t, s, u); got != 1 {
+		t.Error("coil lowered by a cancelled off delay")
+	}
+}
+
+func TestCoilTimersStop(t *testing.T) {
+	address, control := freeAddress(t), filepath.Join(t.TempDir(), "sim.sock")
+	config := "listen_on: %s\ngpio: {driver: sim, control: %s}\noutputs:\n  1: {pin: 23, pulse: 1h}\n  2: {pin: 24, on_delay: 50ms}\n"
+	s, err := loadServer(t, fmt.Sprintf(config, address, control))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := runServer(t, s, address)
+	client := dialModbus(t, address)
+	client.request(0, "050001ff00")
+	client.request(0, "050002ff00")
+
+	// the pulse is cut and the on delay dropped
+	stop()
+	time.Sleep(100 * time.Millisecond)
+	u := s.units[0]
+	if s.gpio.ReadPin(23) != gpio.Low || u.coils[1] != 0 {
+		t.Errorf("coil 1 is %d after Stop, want the pulse cut", u.coils[1])
+	}
+	if s.gpio.ReadPin(24) != gpio.Low || u.coils[2] != 0 {
+		t.Errorf("coil 2 is %d after Stop, want the on delay dropped", u.coils[2])
+	}
+}
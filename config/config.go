@@ -4,38 +4,160 @@ import (
 	"os"
 	"fmt"
 	"time"
+	"strings"
 	"gopkg.in/yaml.v2"
 	"github.com/ggueret/mbpio/gpio"
 )
 
+// Seconds is a duration read either as "30s" or as a bare number of seconds,
+// as poll_every was before taking a unit.
+type Seconds time.Duration
+
+func (s *Seconds) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var seconds int
+	if err := unmarshal(&seconds); err == nil {
+		*s = Seconds(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	var duration time.Duration
+	if err := unmarshal(&duration); err != nil {
+		return err
+	}
+	*s = Seconds(duration)
+	return nil
+}
+
 type InputPoller struct {
 	Type			string
 	Value			*string
+	Interval		time.Duration	`yaml:",omitempty"`
+	Options			map[string]interface{}	`yaml:",omitempty"`
+}
+
+type PollerConfig struct {
+	Interval		time.Duration
+	Jitter			time.Duration
 }
 
 type Input struct {
 	Pin				gpio.Pin
+	Pull			string	`yaml:",omitempty"`
+	ActiveLow		bool	`yaml:"active_low,omitempty"`
+	Debounce		time.Duration	`yaml:",omitempty"`
 	Poller			*InputPoller
 }
 
 type OutputPwm struct {
 	Freq			*int	`yaml:",omitempty"`
 	Cycle			*uint32	`yaml:",omitempty"`
+	Mode			string	`yaml:",omitempty"`
+
+	MinPulse		time.Duration	`yaml:"min_pulse,omitempty"`
+	MaxPulse		time.Duration	`yaml:"max_pulse,omitempty"`
+	Angle			uint16	`yaml:",omitempty"`
+	Unit			string	`yaml:",omitempty"`
+
+	Rate			float64	`yaml:",omitempty"`
+	Current			*int	`yaml:",omitempty"`
 }
 
 type Output struct {
 	Pin				gpio.Pin
 	Pwm				*OutputPwm	`yaml:",omitempty"`
+	SafeState		*uint32	`yaml:"safe_state,omitempty"`
+	Pulse			time.Duration	`yaml:",omitempty"`
+	OnDelay			time.Duration	`yaml:"on_delay,omitempty"`
+	OffDelay		time.Duration	`yaml:"off_delay,omitempty"`
+	Retain			string	`yaml:",omitempty"`
+}
+
+// Unit is a logical slave device with its own register map.
+type Unit struct {
+	Inputs			map[int]Input	`yaml:",flow"`
+	Outputs			map[int]Output	`yaml:",flow"`
+}
+
+// RS485Config drives the transceiver of a half-duplex bus, its driver enable
+// line being toggled by the kernel (RTS) or on a gpio pin.
+type RS485Config struct {
+	Mode			string
+	DEPin			*gpio.Pin	`yaml:"de_pin"`
+	DelayBeforeSend	time.Duration	`yaml:"delay_before_send"`
+	DelayAfterSend	time.Duration	`yaml:"delay_after_send"`
+	RxDuringTx		bool	`yaml:"rx_during_tx"`
+}
+
+// RTUConfig is the serial line, mode picks the rtu or ascii framing and eol
+// ends the ascii frames.
+type RTUConfig struct {
+	Mode			string
+	EOL				string	`yaml:"eol"`
+	Address			string
+	BaudRate		int	`yaml:"baud_rate"`
+	DataBits		int	`yaml:"data_bits"`
+	StopBits		int	`yaml:"stop_bits"`
+	Parity			string
+	Timeout			time.Duration
+	RS485			RS485Config	`yaml:"rs485"`
+}
+
+// Permission grants a role the access, read or rw, to the addresses of a
+// table: coils, discrete_inputs, holding_registers or input_registers, all of
+// them when empty. Addresses is a range like 0-99, every address when empty.
+type Permission struct {
+	Table			string
+	Addresses		string
+	Access			string
+}
+
+// TLSConfig is the Modbus/TCP Security listener, the clients authenticate
+// with a certificate issued by ca_file and are given the permissions of the
+// role it holds.
+type TLSConfig struct {
+	ListenOn		string	`yaml:"listen_on"`
+	CertFile		string	`yaml:"cert_file"`
+	KeyFile			string	`yaml:"key_file"`
+	CAFile			string	`yaml:"ca_file"`
+	Roles			map[string][]Permission
+}
+
+type GPIOConfig struct {
+	Driver			string
+	Chip			string
+	Script			string
+	Control			string
+
+	Pwm				string
+	PwmRoot			string	`yaml:"pwm_root"`
+	PwmChannels		map[gpio.Pin]gpio.PwmChannel	`yaml:"pwm_channels"`
 }
 
 type Config struct {
+	GPIO			GPIOConfig	`yaml:"gpio"`
+
 	Inputs			map[int]Input	`yaml:",flow"`
 	Outputs			map[int]Output	`yaml:",flow"`
+	UnitID			int	`yaml:"unit_id"`
+	Units			map[int]Unit	`yaml:",flow"`
 
 	ListenOn		string	`yaml:"listen_on"`
+	RTUOverTCPListenOn	string	`yaml:"rtu_over_tcp_listen_on"`
+	UDPListenOn		string	`yaml:"udp_listen_on"`
+	TLS				*TLSConfig	`yaml:"tls"`
+
+	PollEvery		Seconds	`yaml:"poll_every"`
+	PollJitter		time.Duration	`yaml:"poll_jitter"`
+	Pollers			map[string]PollerConfig
+
+	CommTimeout		time.Duration	`yaml:"comm_timeout"`
+	CommStatus		*int	`yaml:"comm_status"`
+
+	StateFile		string	`yaml:"state_file"`
+	StateInterval	time.Duration	`yaml:"state_interval"`
 
-	PollEvery		int
+	RTU				*RTUConfig	`yaml:"rtu"`
 
+	// deprecated by the rtu section
 	EnableRTU		bool
 	RTUAddress		string
 	RTUBaudRate		int
@@ -43,7 +165,6 @@ type Config struct {
 	RTUStopBits		int
 	RTUParity		string
 	RTUTimeout		time.Duration
-	// todo: RS485 config
 }
 
 func Load(path string) (config *Config, err error) {
@@ -56,7 +177,13 @@ func Load(path string) (config *Config, err error) {
 
 	// load default settings
 	config = &Config{
+		GPIO: GPIOConfig{
+			Driver: gpio.DefaultDriver,
+			Chip: "/dev/gpiochip0",
+			PwmRoot: "/sys/class/pwm",
+		},
 		ListenOn: "127.0.0.1:502",
+		StateInterval: 10 * time.Second,
 		EnableRTU: false,
 		RTUAddress: "/dev/ttyS0",
 		RTUBaudRate: 19200,
@@ -72,5 +199,57 @@ func Load(path string) (config *Config, err error) {
 		return nil, fmt.Errorf("file decoding errored: %s", err)
 	}
 
+	// pwm_channels replaces the channels of the Raspberry Pi
+	if config.GPIO.PwmChannels == nil {
+		config.GPIO.PwmChannels = make(map[gpio.Pin]gpio.PwmChannel)
+		for pin, channel := range gpio.DefaultPwmChannels {
+			config.GPIO.PwmChannels[pin] = channel
+		}
+	}
+
+	if config.RTU == nil && config.EnableRTU {
+		config.RTU = &RTUConfig{
+			Address: config.RTUAddress,
+			BaudRate: config.RTUBaudRate,
+			DataBits: config.RTUDataBits,
+			StopBits: config.RTUStopBits,
+			Parity: config.RTUParity,
+			Timeout: config.RTUTimeout,
+		}
+	}
+	if rtu := config.RTU; rtu != nil {
+		if rtu.Mode == "" {
+			rtu.Mode = "rtu"
+		}
+		if rtu.EOL == "" {
+			rtu.EOL = "\r\n"
+		}
+		if rtu.Address == "" {
+			rtu.Address = "/dev/ttyS0"
+		}
+		if rtu.BaudRate == 0 {
+			rtu.BaudRate = 19200
+		}
+		if rtu.DataBits == 0 && strings.EqualFold(rtu.Mode, "ascii") {
+			rtu.DataBits = 7
+		} else if rtu.DataBits == 0 {
+			rtu.DataBits = 8
+		}
+		if rtu.StopBits == 0 {
+			rtu.StopBits = 1
+		}
+		if rtu.Parity == "" {
+			rtu.Parity = "E"
+		}
+	}
+
+	if config.StateInterval <= 0 {
+		return nil, fmt.Errorf("state_interval must be positive, got %s", config.StateInterval)
+	}
+
+	if config.TLS != nil && config.TLS.ListenOn == "" {
+		config.TLS.ListenOn = "0.0.0.0:802"
+	}
+
 	return config, nil
 }
\ No newline at end of file
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"time"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/ggueret/mbpio/gpio"
+)
+
+func TestLoadStateInterval(t *testing.T) {
+	tests := []struct {
+		config		string
+		interval	time.Duration
+		valid		bool
+	}{
+		{"state_file: state.yml\n", 10 * time.Second, true},
+		{"state_interval: 1m\n", time.Minute, true},
+		{"state_interval: 0s\n", 0, false},
+		{"state_interval: -5s\n", 0, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "mbpio.yml")
+		if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := Load(path)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: loaded", test.config)
+			}
+			continue
+		}
+		if err != nil || config.StateInterval != test.interval {
+			t.Errorf("%q: %v, want a %s interval", test.config, err, test.interval)
+		}
+	}
+}
+
+func TestLoadPollEvery(t *testing.T) {
+	tests := []struct {
+		config		string
+		every		time.Duration
+	}{
+		{"poll_every: 500ms\n", 500 * time.Millisecond},
+		{"poll_every: 5\n", 5 * time.Second},
+		{"listen_on: 127.0.0.1:502\n", 0},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "mbpio.yml")
+		if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := Load(path)
+		if err != nil || time.Duration(config.PollEvery) != test.every {
+			t.Errorf("%q: %v, want every %s", test.config, err, test.every)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "mbpio.yml")
+	if err := ioutil.WriteFile(path, []byte("poll_every: often\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("loaded an invalid poll_every")
+	}
+}
+
+func TestLoadPwmChannels(t *testing.T) {
+	tests := []struct {
+		config		string
+		channels	map[gpio.Pin]gpio.PwmChannel
+	}{
+		{"gpio: {pwm: sysfs}\n", gpio.DefaultPwmChannels},
+		{"gpio: {pwm: sysfs, pwm_channels: {18: {chip: 1, channel: 0}}}\n", map[gpio.Pin]gpio.PwmChannel{18: {Chip: 1, Channel: 0}}},
+		{"gpio: {pwm: sysfs, pwm_channels: {}}\n", map[gpio.Pin]gpio.PwmChannel{}},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "mbpio.yml")
+		if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := Load(path)
+		if err != nil {
+			t.Errorf("%q: %s", test.config, err)
+			continue
+		}
+		if got := config.GPIO.PwmChannels; fmt.Sprint(got) != fmt.Sprint(test.channels) {
+			t.Errorf("%q: channels %v, want %v", test.config, got, test.channels)
+		}
+	}
+}
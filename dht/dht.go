@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"strings"
+	"github.com/ggueret/mbpio/gpio"
+)
+
+type Model int
+
+const (
+	DHT11 Model = iota + 1
+	DHT22
+)
+
+var ModelStrings = map[Model]string {
+	DHT11: "DHT11",
+	DHT22: "DHT22",
+}
+
+var (
+	ErrTimeout = errors.New("dht: timeout waiting for the sensor")
+	ErrChecksum = errors.New("dht: checksum mismatch")
+)
+
+// a bit is a 1 when its high pulse lasts longer than this, the datasheets
+// give 26-28us for a 0 and 70us for a 1.
+var BitThreshold = 50 * time.Microsecond
+
+// the whole response of the sensor lasts about 5ms.
+var ReadTimeout = 10 * time.Millisecond
+
+type Reading struct {
+	Temperature		float64
+	Humidity		float64
+}
+
+func ParseModel(name string) (Model, error) {
+	switch strings.ToUpper(name) {
+	case "DHT11":
+		return DHT11, nil
+	case "DHT22", "AM2302":
+		return DHT22, nil
+	}
+	return 0, fmt.Errorf("dht: unknown model %q", name)
+}
+
+// Read sends the start signal on pin and decodes the answer of the sensor.
+func Read(driver gpio.Driver, pin gpio.Pin, model Model) (Reading, error) {
+	start := 1100 * time.Microsecond
+	if model == DHT11 {
+		start = 18 * time.Millisecond
+	}
+
+	driver.PullMode(pin, gpio.PullUp)
+	driver.PinMode(pin, gpio.Output)
+	driver.WritePin(pin, gpio.Low)
+	time.Sleep(start)
+	driver.WritePin(pin, gpio.High)
+	driver.PinMode(pin, gpio.Input)
+
+	// the first pulse is the 80us response of the sensor, then the 40 bits
+	pulses, err := Capture(driver, pin, 41, ReadTimeout)
+	if err != nil {
+		return Reading{}, err
+	}
+	return Decode(model, pulses[1:])
+}
+
+// Capture busy-reads pin and returns the length of its next n high pulses.
+func Capture(driver gpio.Driver, pin gpio.Pin, n int, timeout time.Duration) ([]time.Duration, error) {
+	pulses := make([]time.Duration, 0, n)
+	deadline := time.Now().Add(timeout)
+
+	var rise time.Time
+	last := driver.ReadPin(pin)
+	for len(pulses) < n {
+		now := time.Now()
+		if now.After(deadline) {
+			return nil, ErrTimeout
+		}
+		state := driver.ReadPin(pin)
+		if state == last {
+			continue
+		}
+		last = state
+		if state == gpio.High {
+			rise = now
+		} else if !rise.IsZero() {
+			pulses = append(pulses, now.Sub(rise))
+		}
+	}
+	return pulses, nil
+}
+
+// Decode converts the high pulses of the 40 data bits into a reading.
+func Decode(model Model, pulses []time.Duration) (Reading, error) {
+	if len(pulses) != 40 {
+		return Reading{}, fmt.Errorf("dht: expected 40 bits, got %d", len(pulses))
+	}
+
+	var data [5]byte
+	for i, pulse := range pulses {
+		data[i/8] <<= 1
+		if pulse > BitThreshold {
+			data[i/8] |= 1
+		}
+	}
+	return DecodeBytes(model, data)
+}
+
+func DecodeBytes(model Model, data [5]byte) (reading Reading, err error) {
+	if data[0] + data[1] + data[2] + data[3] != data[4] {
+		return reading, ErrChecksum
+	}
+
+	switch model {
+	case DHT11:
+		reading.Humidity = float64(data[0]) + float64(data[1]) / 10
+		reading.Temperature = float64(data[2]) + float64(data[3] & 0x7f) / 10
+		if data[3] & 0x80 != 0 {
+			reading.Temperature = -reading.Temperature
+		}
+	case DHT22:
+		reading.Humidity = float64(uint16(data[0]) << 8 | uint16(data[1])) / 10
+		reading.Temperature = float64(uint16(data[2] & 0x7f) << 8 | uint16(data[3])) / 10
+		if data[2] & 0x80 != 0 {
+			reading.Temperature = -reading.Temperature
+		}
+	default:
+		return reading, fmt.Errorf("dht: unknown model %d", model)
+	}
+
+	if reading.Humidity > 100 || reading.Temperature < -40 || reading.Temperature > 80 {
+		return reading, fmt.Errorf("dht: reading out of range (%.1f°C, %.1f%%)", reading.Temperature, reading.Humidity)
+	}
+	return reading, nil
+}
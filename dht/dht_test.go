@@ -0,0 +1,174 @@
+package dht
+
+import (
+	"net"
+	"math"
+	"time"
+	"bufio"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/ggueret/mbpio/gpio"
+)
+
+// loadTrain returns the high pulses of a pulse train in the format of the
+// sim driver, which starts low.
+func loadTrain(t *testing.T, path string) []time.Duration {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pulses []time.Duration
+	level := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, field := range strings.Fields(line) {
+			duration, err := time.ParseDuration(field)
+			if err != nil {
+				t.Fatalf("%s: %s", path, err)
+			}
+			if level == 1 {
+				pulses = append(pulses, duration)
+			}
+			level ^= 1
+		}
+	}
+	return pulses
+}
+
+func checkReading(t *testing.T, name string, got Reading, want Reading) {
+	t.Helper()
+	if math.Abs(got.Temperature - want.Temperature) > 1e-9 || math.Abs(got.Humidity - want.Humidity) > 1e-9 {
+		t.Errorf("%s: %+v, want %+v", name, got, want)
+	}
+}
+
+func TestDecodeTrain(t *testing.T) {
+	pulses := loadTrain(t, "testdata/dht22.train")
+	if len(pulses) != 41 {
+		t.Fatalf("%d pulses in the train, want the response and 40 bits", len(pulses))
+	}
+	// the first pulse is the response of the sensor, as Read drops it
+	bits := pulses[1:]
+
+	reading, err := Decode(DHT22, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReading(t, "recorded train", reading, Reading{Temperature: -10.1, Humidity: 65.2})
+
+	// a 0 of the humidity read as a 1
+	corrupted := append([]time.Duration(nil), bits...)
+	corrupted[0] = 70 * time.Microsecond
+	if _, err := Decode(DHT22, corrupted); err != ErrChecksum {
+		t.Errorf("corrupted train: %v, want %v", err, ErrChecksum)
+	}
+
+	for _, n := range []int{0, 8, 39} {
+		if _, err := Decode(DHT22, bits[:n]); err == nil {
+			t.Errorf("train truncated to %d bits decoded", n)
+		}
+	}
+	if _, err := Decode(DHT22, append(bits, bits[0])); err == nil {
+		t.Error("train of 41 bits decoded")
+	}
+}
+
+// TestReadReplay replays the train on a pin of the sim driver, which Read
+// captures like the answer of a sensor.
+func TestReadReplay(t *testing.T) {
+	control := filepath.Join(t.TempDir(), "sim.sock")
+	driver, err := gpio.New("sim", gpio.Options{Control: control})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+
+	train, err := filepath.Abs("testdata/dht22.train")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("4 replay " + train + "\n"))
+	if reply, err := bufio.NewReader(conn).ReadString('\n'); err != nil || reply != "ok\n" {
+		t.Fatalf("replay: %q, %v", reply, err)
+	}
+
+	// Capture busy-reads the pin, an edge is missed when the test is
+	// descheduled in the middle of a pulse
+	for i := 0; ; i++ {
+		reading, err := Read(driver, 4, DHT22)
+		if err == nil {
+			checkReading(t, "replayed train", reading, Reading{Temperature: -10.1, Humidity: 65.2})
+			break
+		}
+		if i == 4 {
+			t.Fatalf("replayed train: %s", err)
+		}
+	}
+}
+
+func TestDecodeBytes(t *testing.T) {
+	frame := func(b0, b1, b2, b3 byte) [5]byte {
+		return [5]byte{b0, b1, b2, b3, b0 + b1 + b2 + b3}
+	}
+	tests := []struct {
+		name	string
+		model	Model
+		data	[5]byte
+		want	Reading
+		err		bool
+	}{
+		{"dht22", DHT22, frame(0x01, 0x90, 0x00, 0xfa), Reading{Temperature: 25.0, Humidity: 40.0}, false},
+		{"dht22 tenths", DHT22, frame(0x02, 0x8c, 0x01, 0x5f), Reading{Temperature: 35.1, Humidity: 65.2}, false},
+		{"dht22 negative", DHT22, frame(0x02, 0x8c, 0x80, 0x65), Reading{Temperature: -10.1, Humidity: 65.2}, false},
+		{"dht22 minus zero point one", DHT22, frame(0x03, 0xe8, 0x80, 0x01), Reading{Temperature: -0.1, Humidity: 100}, false},
+		{"dht11", DHT11, frame(0x2d, 0x00, 0x17, 0x03), Reading{Temperature: 23.3, Humidity: 45.0}, false},
+		{"dht11 negative", DHT11, frame(0x2d, 0x00, 0x01, 0x83), Reading{Temperature: -1.3, Humidity: 45.0}, false},
+		// the same bytes read with the scaling of the other model
+		{"dht22 as dht11", DHT11, frame(0x01, 0x90, 0x00, 0xfa), Reading{Temperature: -12.2, Humidity: 15.4}, false},
+		{"dht11 as dht22", DHT22, frame(0x2d, 0x00, 0x17, 0x03), Reading{}, true},
+		{"checksum", DHT22, [5]byte{0x01, 0x90, 0x00, 0xfa, 0x8a}, Reading{}, true},
+		{"checksum overflow", DHT22, [5]byte{0x02, 0x8c, 0x80, 0x65, 0x73}, Reading{Temperature: -10.1, Humidity: 65.2}, false},
+		{"humidity over 100", DHT22, frame(0x03, 0xe9, 0x00, 0xfa), Reading{}, true},
+		{"temperature under -40", DHT22, frame(0x01, 0x90, 0x81, 0x91), Reading{}, true},
+		{"temperature over 80", DHT22, frame(0x01, 0x90, 0x03, 0x21), Reading{}, true},
+		{"unknown model", Model(0), frame(0x01, 0x90, 0x00, 0xfa), Reading{}, true},
+	}
+	for _, test := range tests {
+		reading, err := DecodeBytes(test.model, test.data)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: %+v, want an error", test.name, reading)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		checkReading(t, test.name, reading, test.want)
+	}
+}
+
+func TestParseModel(t *testing.T) {
+	for name, want := range map[string]Model{"dht11": DHT11, "DHT22": DHT22, "am2302": DHT22} {
+		if model, err := ParseModel(name); model != want || err != nil {
+			t.Errorf("%s: %v %v, want %v", name, model, err, want)
+		}
+	}
+	if _, err := ParseModel("DHT33"); err == nil {
+		t.Error("DHT33 parsed")
+	}
+}
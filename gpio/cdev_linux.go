@@ -0,0 +1,426 @@
+package gpio
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+	"syscall"
+	"sync/atomic"
+	"encoding/binary"
+	log "github.com/sirupsen/logrus"
+)
+
+// Linux GPIO character device uAPI v2, see include/uapi/linux/gpio.h
+
+const (
+	lineFlagActiveLow		= 1 << 1
+	lineFlagInput			= 1 << 2
+	lineFlagOutput			= 1 << 3
+	lineFlagEdgeRising		= 1 << 4
+	lineFlagEdgeFalling		= 1 << 5
+	lineFlagBiasPullUp		= 1 << 8
+	lineFlagBiasPullDown	= 1 << 9
+	lineFlagBiasDisabled	= 1 << 10
+	lineFlagEventClockRealtime	= 1 << 11
+
+	lineFlagsEdge = lineFlagEdgeRising | lineFlagEdgeFalling
+	lineFlagsBias = lineFlagBiasPullUp | lineFlagBiasPullDown | lineFlagBiasDisabled
+
+	lineAttrOutputValues = 2
+
+	lineEventRisingEdge = 1
+	lineEventSize = 48
+)
+
+type lineAttribute struct {
+	ID			uint32
+	Padding		uint32
+	Value		uint64
+}
+
+type lineConfigAttribute struct {
+	Attr		lineAttribute
+	Mask		uint64
+}
+
+type lineConfig struct {
+	Flags		uint64
+	NumAttrs	uint32
+	Padding		[5]uint32
+	Attrs		[10]lineConfigAttribute
+}
+
+type lineRequest struct {
+	Offsets			[64]uint32
+	Consumer		[32]byte
+	Config			lineConfig
+	NumLines		uint32
+	EventBufferSize	uint32
+	Padding			[5]uint32
+	Fd				int32
+}
+
+type lineValues struct {
+	Bits		uint64
+	Mask		uint64
+}
+
+func iowr(nr, size uintptr) uintptr {
+	return 3<<30 | size<<16 | 0xB4<<8 | nr
+}
+
+var (
+	getLineIoctl = iowr(0x07, unsafe.Sizeof(lineRequest{}))
+	setConfigIoctl = iowr(0x0D, unsafe.Sizeof(lineConfig{}))
+	getValuesIoctl = iowr(0x0E, unsafe.Sizeof(lineValues{}))
+	setValuesIoctl = iowr(0x0F, unsafe.Sizeof(lineValues{}))
+)
+
+func ioctl(file *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// cdevChip is a gpiochip device, RequestLine hands out its lines.
+type cdevChip interface {
+	RequestLine(req *lineRequest) (cdevHandle, error)
+	Close() error
+}
+
+// cdevHandle is a requested line, its reads return the edge events.
+type cdevHandle interface {
+	io.ReadCloser
+	SetConfig(cfg *lineConfig) error
+	GetValues(values *lineValues) error
+	SetValues(values *lineValues) error
+}
+
+// openDevChip opens a gpiochip device.
+func openDevChip(path string) (cdevChip, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &devChip{file: file}, nil
+}
+
+// devChip and devLine issue the ioctls of the uAPI.
+type devChip struct {
+	file		*os.File
+}
+
+type devLine struct {
+	*os.File
+}
+
+func (c *devChip) RequestLine(req *lineRequest) (cdevHandle, error) {
+	if err := ioctl(c.file, getLineIoctl, unsafe.Pointer(req)); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(int(req.Fd), true); err != nil {
+		syscall.Close(int(req.Fd))
+		return nil, err
+	}
+	name := fmt.Sprintf("%s:%d", c.file.Name(), req.Offsets[0])
+	return devLine{os.NewFile(uintptr(req.Fd), name)}, nil
+}
+
+func (c *devChip) Close() error {
+	return c.file.Close()
+}
+
+func (l devLine) SetConfig(cfg *lineConfig) error {
+	return ioctl(l.File, setConfigIoctl, unsafe.Pointer(cfg))
+}
+
+func (l devLine) GetValues(values *lineValues) error {
+	return ioctl(l.File, getValuesIoctl, unsafe.Pointer(values))
+}
+
+func (l devLine) SetValues(values *lineValues) error {
+	return ioctl(l.File, setValuesIoctl, unsafe.Pointer(values))
+}
+
+// cdevLine is a single line request, each pin gets its own so they can be
+// reconfigured independently.
+type cdevLine struct {
+	handle		cdevHandle
+	flags		uint64
+	value		State
+	edges		uint32
+	watching	bool
+}
+
+// config returns the kernel config of the line, the edge events are stamped
+// with the realtime clock so they compare to the events of other lines.
+func (l *cdevLine) config() lineConfig {
+	cfg := lineConfig{Flags: l.flags}
+	if l.flags & lineFlagsEdge != 0 {
+		cfg.Flags |= lineFlagEventClockRealtime
+	}
+	if l.flags & lineFlagOutput != 0 {
+		cfg.NumAttrs = 1
+		cfg.Attrs[0] = lineConfigAttribute{
+			Attr: lineAttribute{ID: lineAttrOutputValues, Value: uint64(l.value)},
+			Mask: 1,
+		}
+	}
+	return cfg
+}
+
+// cdevDriver talks to a /dev/gpiochipN device, pins are the line offsets of
+// that chip.
+type cdevDriver struct {
+	path		string
+	open		func(path string) (cdevChip, error)
+	mu			sync.Mutex
+	chip		cdevChip
+	lines		map[Pin]*cdevLine
+	watchers	watchers
+}
+
+func init() {
+	Register("cdev", func(opts Options) (Driver, error) {
+		return &cdevDriver{path: opts.Chip, open: openDevChip, lines: make(map[Pin]*cdevLine)}, nil
+	})
+}
+
+func (d *cdevDriver) Open() (err error) {
+	d.chip, err = d.open(d.path)
+	return err
+}
+
+func (d *cdevDriver) Close() error {
+	d.watchers.removeAll()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for pin, line := range d.lines {
+		line.handle.Close()
+		delete(d.lines, pin)
+	}
+	if d.chip == nil {
+		return nil
+	}
+	return d.chip.Close()
+}
+
+func (d *cdevDriver) request(pin Pin, line *cdevLine) error {
+	req := lineRequest{Config: line.config(), NumLines: 1}
+	req.Offsets[0] = uint32(pin)
+	copy(req.Consumer[:], "mbpio")
+
+	handle, err := d.chip.RequestLine(&req)
+	if err != nil {
+		return err
+	}
+	line.handle = handle
+	return nil
+}
+
+// configure applies update to the line of pin, requesting it first when the
+// pin has not been used yet.
+func (d *cdevDriver) configure(pin Pin, update func(line *cdevLine)) *cdevLine {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	line, ok := d.lines[pin]
+	if !ok {
+		line = &cdevLine{flags: lineFlagInput}
+		update(line)
+		if err := d.request(pin, line); err != nil {
+			log.WithFields(log.Fields{"pin": pin, "chip": d.path}).Warnf("cdev: line request failed: %s", err)
+			return nil
+		}
+		d.lines[pin] = line
+	} else {
+		update(line)
+		cfg := line.config()
+		if err := line.handle.SetConfig(&cfg); err != nil {
+			log.WithFields(log.Fields{"pin": pin, "chip": d.path}).Warnf("cdev: line config failed: %s", err)
+		}
+	}
+
+	if line.flags & lineFlagsEdge != 0 && !line.watching {
+		line.watching = true
+		go d.watch(pin, line)
+	}
+	return line
+}
+
+// watch reads the kernel edge events of the line until it is closed.
+func (d *cdevDriver) watch(pin Pin, line *cdevLine) {
+	buf := make([]byte, lineEventSize * 16)
+	for {
+		n, err := line.handle.Read(buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i + lineEventSize <= n; i += lineEventSize {
+			atomic.AddUint32(&line.edges, 1)
+
+			at := time.Unix(0, int64(binary.LittleEndian.Uint64(buf[i:])))
+			edge := FallEdge
+			if binary.LittleEndian.Uint32(buf[i+8:]) == lineEventRisingEdge {
+				edge = RiseEdge
+			}
+			d.watchers.notify(pin, edge, at)
+		}
+	}
+}
+
+func (d *cdevDriver) line(pin Pin) *cdevLine {
+	d.mu.Lock()
+	line, ok := d.lines[pin]
+	d.mu.Unlock()
+	if ok {
+		return line
+	}
+	return d.configure(pin, func(*cdevLine) {})
+}
+
+func (d *cdevDriver) PinMode(pin Pin, mode Mode) {
+	switch mode {
+	case Input:
+		d.configure(pin, func(line *cdevLine) {
+			line.flags = line.flags &^ lineFlagOutput | lineFlagInput
+		})
+	case Output:
+		d.configure(pin, func(line *cdevLine) {
+			line.flags = line.flags &^ (lineFlagInput | lineFlagsEdge) | lineFlagOutput
+		})
+	default:
+		log.WithFields(log.Fields{"pin": pin, "mode": ModeStrings[mode]}).Warn("cdev: mode not supported by the gpio character device")
+	}
+}
+
+func (d *cdevDriver) WritePin(pin Pin, state State) {
+	line := d.line(pin)
+	if line == nil {
+		return
+	}
+	d.mu.Lock()
+	line.value = state
+	output := line.flags & lineFlagOutput != 0
+	d.mu.Unlock()
+	if !output {
+		return
+	}
+
+	values := lineValues{Bits: uint64(state), Mask: 1}
+	if err := line.handle.SetValues(&values); err != nil {
+		log.WithFields(log.Fields{"pin": pin, "chip": d.path}).Warnf("cdev: write failed: %s", err)
+	}
+}
+
+func (d *cdevDriver) ReadPin(pin Pin) State {
+	line := d.line(pin)
+	if line == nil {
+		return Low
+	}
+	values := lineValues{Mask: 1}
+	if err := line.handle.GetValues(&values); err != nil {
+		log.WithFields(log.Fields{"pin": pin, "chip": d.path}).Warnf("cdev: read failed: %s", err)
+		return Low
+	}
+	return State(values.Bits & 1)
+}
+
+func (d *cdevDriver) TogglePin(pin Pin) {
+	d.WritePin(pin, d.ReadPin(pin) ^ High)
+}
+
+func (d *cdevDriver) PullMode(pin Pin, pull Pull) {
+	d.configure(pin, func(line *cdevLine) {
+		line.flags &^= lineFlagsBias
+		switch pull {
+		case PullUp:
+			line.flags |= lineFlagBiasPullUp
+		case PullDown:
+			line.flags |= lineFlagBiasPullDown
+		default:
+			line.flags |= lineFlagBiasDisabled
+		}
+	})
+}
+
+func (d *cdevDriver) ActiveLow(pin Pin, activeLow bool) {
+	d.configure(pin, func(line *cdevLine) {
+		if activeLow {
+			line.flags |= lineFlagActiveLow
+		} else {
+			line.flags &^= lineFlagActiveLow
+		}
+	})
+}
+
+func (d *cdevDriver) detectEdge(pin Pin, edge Edge) *cdevLine {
+	return d.configure(pin, func(line *cdevLine) {
+		line.flags &^= lineFlagsEdge
+		if edge & RiseEdge != 0 {
+			line.flags |= lineFlagEdgeRising
+		}
+		if edge & FallEdge != 0 {
+			line.flags |= lineFlagEdgeFalling
+		}
+		if edge != NoEdge {
+			line.flags = line.flags &^ lineFlagOutput | lineFlagInput
+		}
+	})
+}
+
+func (d *cdevDriver) DetectEdge(pin Pin, edge Edge) {
+	if line := d.detectEdge(pin, edge); line != nil {
+		atomic.StoreUint32(&line.edges, 0)
+	}
+}
+
+func (d *cdevDriver) EdgeDetected(pin Pin) bool {
+	d.mu.Lock()
+	line, ok := d.lines[pin]
+	d.mu.Unlock()
+	return ok && atomic.SwapUint32(&line.edges, 0) > 0
+}
+
+func (d *cdevDriver) SetFreq(pin Pin, freq int) {
+	log.WithFields(log.Fields{"pin": pin, "freq": freq}).Warn("cdev: pwm not supported by the gpio character device")
+}
+
+func (d *cdevDriver) SetDutyCycle(pin Pin, dutyLen, cycleLen uint32) {
+	log.WithFields(log.Fields{"pin": pin, "duty": dutyLen, "cycle": cycleLen}).Warn("cdev: pwm not supported by the gpio character device")
+}
+
+func (d *cdevDriver) HardwarePwm(pin Pin) bool {
+	return false
+}
+
+func (d *cdevDriver) Watch(pin Pin, edge Edge) (<-chan Event, error) {
+	watcher, err := d.watchers.add(pin, edge)
+	if err != nil {
+		return nil, err
+	}
+	if d.detectEdge(pin, edge) == nil {
+		d.watchers.remove(pin)
+		return nil, fmt.Errorf("cdev: cannot request line %d of %s", pin, d.path)
+	}
+	return watcher.events, nil
+}
+
+func (d *cdevDriver) Unwatch(pin Pin) {
+	d.watchers.remove(pin)
+}
@@ -0,0 +1,306 @@
+package gpio
+
+import (
+	"io"
+	"sync"
+	"time"
+	"testing"
+	"encoding/binary"
+)
+
+// fakeChip hands out lines whose config and values are recorded, the tests
+// write the kernel edge events to their pipe.
+type fakeChip struct {
+	mu			sync.Mutex
+	lines		map[uint32]*fakeLine
+	requests	int
+	closed		bool
+}
+
+type fakeLine struct {
+	mu			sync.Mutex
+	consumer	string
+	flags		uint64
+	bits		uint64
+	events		*io.PipeWriter
+	reader		*io.PipeReader
+	closed		bool
+}
+
+func (c *fakeChip) RequestLine(req *lineRequest) (cdevHandle, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req.NumLines != 1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	reader, writer := io.Pipe()
+	line := &fakeLine{reader: reader, events: writer}
+	consumer := req.Consumer[:]
+	for i, b := range consumer {
+		if b == 0 {
+			consumer = consumer[:i]
+			break
+		}
+	}
+	line.consumer = string(consumer)
+	line.SetConfig(&req.Config)
+	c.lines[req.Offsets[0]] = line
+	c.requests++
+	return line, nil
+}
+
+func (c *fakeChip) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeChip) line(t *testing.T, offset uint32) *fakeLine {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	line, ok := c.lines[offset]
+	if !ok {
+		t.Fatalf("line %d not requested", offset)
+	}
+	return line
+}
+
+func (l *fakeLine) Read(p []byte) (int, error) {
+	return l.reader.Read(p)
+}
+
+func (l *fakeLine) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	return l.reader.Close()
+}
+
+func (l *fakeLine) SetConfig(cfg *lineConfig) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flags = cfg.Flags
+	for _, attr := range cfg.Attrs[:cfg.NumAttrs] {
+		if attr.Attr.ID == lineAttrOutputValues {
+			l.bits = l.bits &^ attr.Mask | attr.Attr.Value & attr.Mask
+		}
+	}
+	return nil
+}
+
+func (l *fakeLine) GetValues(values *lineValues) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	values.Bits = l.bits & values.Mask
+	return nil
+}
+
+func (l *fakeLine) SetValues(values *lineValues) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bits = l.bits &^ values.Mask | values.Bits & values.Mask
+	return nil
+}
+
+func (l *fakeLine) state() (uint64, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.flags, l.bits
+}
+
+// edgeTime is the kernel timestamp of the first event written by edge, the
+// next ones come a microsecond apart.
+var edgeTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// edge writes a gpio_v2_line_event for each id, 1 is a rising edge and 2 a
+// falling one.
+func (l *fakeLine) edge(t *testing.T, offset uint32, ids ...uint32) {
+	t.Helper()
+	buf := make([]byte, lineEventSize * len(ids))
+	for i, id := range ids {
+		event := buf[i*lineEventSize:]
+		binary.LittleEndian.PutUint64(event[0:], uint64(edgeTime.Add(time.Duration(i) * time.Microsecond).UnixNano()))
+		binary.LittleEndian.PutUint32(event[8:], id)
+		binary.LittleEndian.PutUint32(event[12:], offset)
+		binary.LittleEndian.PutUint32(event[16:], uint32(i + 1))
+		binary.LittleEndian.PutUint32(event[20:], uint32(i + 1))
+	}
+	if _, err := l.events.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openFakeChip(t *testing.T) (*cdevDriver, *fakeChip) {
+	t.Helper()
+	chip := &fakeChip{lines: make(map[uint32]*fakeLine)}
+	driver, err := New("cdev", Options{Chip: "/dev/gpiochip0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.(*cdevDriver).open = func(path string) (cdevChip, error) {
+		if path != "/dev/gpiochip0" {
+			t.Errorf("opened %s, want /dev/gpiochip0", path)
+		}
+		return chip, nil
+	}
+	if err := driver.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	return driver.(*cdevDriver), chip
+}
+
+func TestCdevLineFlags(t *testing.T) {
+	d, chip := openFakeChip(t)
+
+	tests := []struct {
+		name	string
+		apply	func(pin Pin)
+		flags	uint64
+	}{
+		{"input", func(pin Pin) { d.PinMode(pin, Input) }, lineFlagInput},
+		{"output", func(pin Pin) { d.PinMode(pin, Output) }, lineFlagOutput},
+		{"pull up", func(pin Pin) { d.PullMode(pin, PullUp) }, lineFlagInput | lineFlagBiasPullUp},
+		{"pull down", func(pin Pin) { d.PullMode(pin, PullDown) }, lineFlagInput | lineFlagBiasPullDown},
+		{"pull off", func(pin Pin) { d.PullMode(pin, PullOff) }, lineFlagInput | lineFlagBiasDisabled},
+		{"active low", func(pin Pin) { d.ActiveLow(pin, true) }, lineFlagInput | lineFlagActiveLow},
+		{"rise edge", func(pin Pin) { d.DetectEdge(pin, RiseEdge) }, lineFlagInput | lineFlagEdgeRising | lineFlagEventClockRealtime},
+		{"fall edge", func(pin Pin) { d.DetectEdge(pin, FallEdge) }, lineFlagInput | lineFlagEdgeFalling | lineFlagEventClockRealtime},
+		{"any edge", func(pin Pin) { d.DetectEdge(pin, AnyEdge) }, lineFlagInput | lineFlagsEdge | lineFlagEventClockRealtime},
+		{"pulled up output", func(pin Pin) {
+			d.PullMode(pin, PullUp)
+			d.PinMode(pin, Output)
+		}, lineFlagOutput | lineFlagBiasPullUp},
+		{"output switched to edges", func(pin Pin) {
+			d.PinMode(pin, Output)
+			d.DetectEdge(pin, RiseEdge)
+		}, lineFlagInput | lineFlagEdgeRising | lineFlagEventClockRealtime},
+		{"edges dropped by output", func(pin Pin) {
+			d.DetectEdge(pin, AnyEdge)
+			d.PinMode(pin, Output)
+		}, lineFlagOutput},
+		{"pull changed", func(pin Pin) {
+			d.PullMode(pin, PullUp)
+			d.ActiveLow(pin, true)
+			d.PullMode(pin, PullDown)
+			d.ActiveLow(pin, false)
+		}, lineFlagInput | lineFlagBiasPullDown},
+	}
+	for i, test := range tests {
+		pin := Pin(i)
+		test.apply(pin)
+		line := chip.line(t, uint32(pin))
+		if flags, _ := line.state(); flags != test.flags {
+			t.Errorf("%s: flags %#x, want %#x", test.name, flags, test.flags)
+		}
+		if line.consumer != "mbpio" {
+			t.Errorf("%s: consumer %q", test.name, line.consumer)
+		}
+	}
+	// one request per pin, the later changes only reconfigure the line
+	if chip.requests != len(tests) {
+		t.Errorf("%d line requests, want %d", chip.requests, len(tests))
+	}
+}
+
+func TestCdevReadWrite(t *testing.T) {
+	d, chip := openFakeChip(t)
+
+	// the value written before the pin is an output is its initial value
+	d.WritePin(4, High)
+	line := chip.line(t, 4)
+	if _, bits := line.state(); bits != 0 {
+		t.Errorf("input driven to %d", bits)
+	}
+	d.PinMode(4, Output)
+	if _, bits := line.state(); bits != 1 {
+		t.Errorf("output requested at %d, want 1", bits)
+	}
+
+	d.WritePin(4, Low)
+	if _, bits := line.state(); bits != 0 || d.ReadPin(4) != Low {
+		t.Errorf("output at %d after writing low", bits)
+	}
+	d.TogglePin(4)
+	if _, bits := line.state(); bits != 1 || d.ReadPin(4) != High {
+		t.Errorf("output at %d after a toggle", bits)
+	}
+
+	d.PinMode(7, Input)
+	chip.line(t, 7).SetValues(&lineValues{Bits: 1, Mask: 1})
+	if state := d.ReadPin(7); state != High {
+		t.Errorf("input read %s, want High", StateStrings[state])
+	}
+
+	d.Close()
+	if !chip.closed || !line.closed {
+		t.Errorf("chip closed %t, line closed %t", chip.closed, line.closed)
+	}
+}
+
+func TestCdevEdgeEvents(t *testing.T) {
+	d, chip := openFakeChip(t)
+
+	events, err := d.Watch(17, AnyEdge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Watch(17, RiseEdge); err == nil {
+		t.Error("pin watched twice")
+	}
+	line := chip.line(t, 17)
+	if flags, _ := line.state(); flags != lineFlagInput | lineFlagsEdge | lineFlagEventClockRealtime {
+		t.Errorf("flags %#x, want both edges stamped with the realtime clock", flags)
+	}
+
+	// a single read returns several events, with their kernel timestamps
+	line.edge(t, 17, 1, 2, 1)
+	for i, want := range []Edge{RiseEdge, FallEdge, RiseEdge} {
+		select {
+		case event := <-events:
+			at := edgeTime.Add(time.Duration(i) * time.Microsecond)
+			if event.Pin != 17 || event.Edge != want || !event.Time.Equal(at) {
+				t.Errorf("event %+v, want %s on pin 17 at %s", event, EdgeStrings[want], at)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", EdgeStrings[want])
+		}
+	}
+	if !d.EdgeDetected(17) || d.EdgeDetected(17) {
+		t.Error("edges not counted once")
+	}
+
+	// the watcher only wants rising edges, the falling one is still counted
+	d.Unwatch(17)
+	if _, ok := <-events; ok {
+		t.Error("events left open by Unwatch")
+	}
+	events, err = d.Watch(17, RiseEdge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags, _ := line.state(); flags != lineFlagInput | lineFlagEdgeRising | lineFlagEventClockRealtime {
+		t.Errorf("flags %#x, want the rising edge", flags)
+	}
+	line.edge(t, 17, 2)
+	line.edge(t, 17, 1)
+	select {
+	case event := <-events:
+		if event.Edge != RiseEdge {
+			t.Errorf("event %+v, want RiseEdge", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no rise event")
+	}
+	if !d.EdgeDetected(17) {
+		t.Error("edges not detected")
+	}
+
+	d.DetectEdge(17, AnyEdge)
+	if d.EdgeDetected(17) {
+		t.Error("edge count not reset by DetectEdge")
+	}
+	if chip.requests != 1 {
+		t.Errorf("%d line requests, want 1", chip.requests)
+	}
+}
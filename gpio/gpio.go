@@ -0,0 +1,147 @@
+package gpio
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Pin int
+type Mode uint8
+type State uint8
+type Pull uint8
+type Edge uint8
+
+const (
+	Input Mode = iota
+	Output
+	Clock
+	Pwm
+	Spi
+)
+
+const (
+	Low State = iota
+	High
+)
+
+const (
+	PullOff Pull = iota
+	PullDown
+	PullUp
+)
+
+const (
+	NoEdge Edge = iota
+	RiseEdge
+	FallEdge
+	AnyEdge
+)
+
+var ModeStrings = map[Mode]string {
+	Input: "Input",
+	Output: "Output",
+	Clock: "Clock",
+	Pwm: "Pwm",
+	Spi: "Spi",
+}
+
+var PullStrings = map[Pull]string {
+	PullOff: "Off",
+	PullDown: "Down",
+	PullUp: "Up",
+}
+
+func ParsePull(name string) (Pull, error) {
+	for pull, s := range PullStrings {
+		if strings.EqualFold(s, name) {
+			return pull, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown pull %q, choices: up, down, off", name)
+}
+
+var StateStrings = map[State]string {
+	Low: "Low",
+	High: "High",
+}
+
+var EdgeStrings = map[Edge]string {
+	NoEdge: "NoEdge",
+	RiseEdge: "RiseEdge",
+	FallEdge: "FallEdge",
+	AnyEdge: "AnyEdge",
+}
+
+// Driver is implemented by every GPIO backend, the server and the pollers
+// only talk to the pins through it.
+type Driver interface {
+	Open() error
+	Close() error
+
+	PinMode(pin Pin, mode Mode)
+	WritePin(pin Pin, state State)
+	ReadPin(pin Pin) State
+	TogglePin(pin Pin)
+	PullMode(pin Pin, pull Pull)
+	ActiveLow(pin Pin, activeLow bool)
+	DetectEdge(pin Pin, edge Edge)
+	EdgeDetected(pin Pin) bool
+	SetFreq(pin Pin, freq int)
+	SetDutyCycle(pin Pin, dutyLen, cycleLen uint32)
+
+	// Watch delivers every edge of pin on the returned channel, until
+	// Unwatch or Close is called.
+	Watch(pin Pin, edge Edge) (<-chan Event, error)
+	Unwatch(pin Pin)
+}
+
+// PwmCapable is implemented by the drivers telling which pins have a hardware
+// PWM channel, the others are driven by the software PWM.
+type PwmCapable interface {
+	HardwarePwm(pin Pin) bool
+}
+
+// bcmHardwarePwm tells whether a BCM283x pin can be routed to one of the two
+// PWM channels.
+func bcmHardwarePwm(pin Pin) bool {
+	switch pin {
+	case 12, 13, 18, 19, 40, 41, 45:
+		return true
+	}
+	return false
+}
+
+type Options struct {
+	Chip			string
+	Script			string
+	Control			string
+}
+
+type Factory func(opts Options) (Driver, error)
+
+var drivers = make(map[string]Factory)
+
+func Register(name string, factory Factory) {
+	if _, ok := drivers[name]; ok {
+		panic(fmt.Sprintf("gpio: driver %s registered twice", name))
+	}
+	drivers[name] = factory
+}
+
+func Drivers() []string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func New(name string, opts Options) (Driver, error) {
+	factory, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown gpio driver %q, choices: %s", name, strings.Join(Drivers(), ", "))
+	}
+	return factory(opts)
+}
@@ -1,161 +1,111 @@
 package gpio
 
-import "github.com/stianeikeland/go-rpio"
-
-type Mode rpio.Mode
-type Pin rpio.Pin
-//type State rpio.State
-type Pull rpio.Pull
-type Edge rpio.Edge
-
-func State(i uint16) rpio.State {
-	return rpio.State(i)
-}
-
-const (
-	Input = rpio.Input
-	Output = rpio.Output
-	Clock = rpio.Clock
-	Pwm = rpio.Pwm
-	Spi = rpio.Spi
-
-	PullOff = rpio.PullOff
-	PullDown = rpio.PullDown
-	PullUp = rpio.PullUp
-
-	Low = rpio.Low
-	High = rpio.High
-
+import (
+	"sync"
+	"time"
+	"github.com/stianeikeland/go-rpio"
 )
 
-func (pin Pin) Input() {
-	PinMode(pin, Input)
-}
-
-func (pin Pin) Output() {
-	PinMode(pin, Output)
-}
-
-func (pin Pin) Clock() {
-	PinMode(pin, Clock)
-}
-
-func (pin Pin) Pwm() {
-	PinMode(pin, Pwm)
-}
-
-func (pin Pin) High() {
-	WritePin(pin, High)
-}
-
-func (pin Pin) Low() {
-	WritePin(pin, Low)
-}
-
-func (pin Pin) Toggle() {
-	TogglePin(pin)
-}
-
-func (pin Pin) Freq(freq int) {
-	SetFreq(pin, freq)
-}
-
-func (pin Pin) DutyCycle(dutyLen, cycleLen uint32) {
-	SetDutyCycle(pin, dutyLen, cycleLen)
-}
+const DefaultDriver = "rpio"
 
-func (pin Pin) Mode(mode rpio.Mode) {
-	PinMode(pin, mode)
+// rpioDriver drives the BCM283x registers through /dev/gpiomem, it only
+// works on the Raspberry Pi models up to the 4 and the CM4.
+type rpioDriver struct {
+	mu			sync.Mutex
+	activeLow	map[Pin]bool
+	watchers	watchers
 }
 
-func (pin Pin) Write(state rpio.State) {
-	WritePin(pin, state)
+func init() {
+	Register("rpio", func(opts Options) (Driver, error) {
+		return &rpioDriver{activeLow: make(map[Pin]bool)}, nil
+	})
 }
 
-func (pin Pin) Read() rpio.State {
-	return ReadPin(pin)
+func (d *rpioDriver) isActiveLow(pin Pin) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.activeLow[pin]
 }
 
-func (pin Pin) Pull(pull rpio.Pull) {
-	PullMode(pin, pull)
-}
-
-func (pin Pin) PullUp() {
-	PullMode(pin, PullUp)
-}
-
-func (pin Pin) PullDown() {
-	PullMode(pin, PullDown)
+func (d *rpioDriver) Open() error {
+	return rpio.Open()
 }
 
-func (pin Pin) PullOff() {
-	PullMode(pin, PullOff)
+func (d *rpioDriver) Close() error {
+	d.watchers.removeAll()
+	return rpio.Close()
 }
 
-func (pin Pin) Detect(edge rpio.Edge) {
-	DetectEdge(pin, edge)
+func (d *rpioDriver) PinMode(pin Pin, mode Mode) {
+	rpio.PinMode(rpio.Pin(pin), rpio.Mode(mode))
 }
 
-func (pin Pin) EdgeDetected() bool {
-	return EdgeDetected(pin)
+func (d *rpioDriver) WritePin(pin Pin, state State) {
+	if d.isActiveLow(pin) {
+		state ^= High
+	}
+	rpio.WritePin(rpio.Pin(pin), rpio.State(state))
 }
 
-func PinMode(pin Pin, mode rpio.Mode) {
-	rpio.PinMode(rpio.Pin(pin), mode)
+func (d *rpioDriver) ReadPin(pin Pin) State {
+	state := State(rpio.ReadPin(rpio.Pin(pin)))
+	if d.isActiveLow(pin) {
+		state ^= High
+	}
+	return state
 }
 
-func WritePin(pin Pin, state rpio.State) {
-	rpio.WritePin(rpio.Pin(pin), state)
+func (d *rpioDriver) TogglePin(pin Pin) {
+	rpio.TogglePin(rpio.Pin(pin))
 }
 
-func ReadPin(pin Pin) rpio.State {
-	return rpio.State(rpio.ReadPin(rpio.Pin(pin)))
+func (d *rpioDriver) PullMode(pin Pin, pull Pull) {
+	rpio.PullMode(rpio.Pin(pin), rpio.Pull(pull))
 }
 
-func TogglePin(pin Pin) {
-	rpio.TogglePin(rpio.Pin(pin))
+func (d *rpioDriver) ActiveLow(pin Pin, activeLow bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.activeLow[pin] = activeLow
 }
 
-func DetectEdge(pin Pin, edge rpio.Edge) {
-	rpio.DetectEdge(rpio.Pin(pin), edge)
+func (d *rpioDriver) DetectEdge(pin Pin, edge Edge) {
+	// the registers see the physical level, swap the edges of inverted pins
+	if d.isActiveLow(pin) && (edge == RiseEdge || edge == FallEdge) {
+		edge ^= AnyEdge
+	}
+	rpio.DetectEdge(rpio.Pin(pin), rpio.Edge(edge))
 }
 
-func EdgeDetected(pin Pin) bool {
+func (d *rpioDriver) EdgeDetected(pin Pin) bool {
 	return rpio.EdgeDetected(rpio.Pin(pin))
 }
 
-func PullMode(pin Pin, pull rpio.Pull) {
-	rpio.PullMode(rpio.Pin(pin), pull)
-}
-
-func SetFreq(pin Pin, freq int) {
+func (d *rpioDriver) SetFreq(pin Pin, freq int) {
 	rpio.SetFreq(rpio.Pin(pin), freq)
 }
 
-func SetDutyCycle(pin Pin, dutyLen, cycleLen uint32) {
+func (d *rpioDriver) SetDutyCycle(pin Pin, dutyLen, cycleLen uint32) {
 	rpio.SetDutyCycle(rpio.Pin(pin), dutyLen, cycleLen)
 }
 
-func StopPwm() {
-	rpio.StopPwm()
-}
-
-func StartPwm() {
-	rpio.StartPwm()
-}
-
-func EnableIRQs(irqs uint64) {
-	rpio.EnableIRQs(irqs)
+// HardwarePwm tells the pins rpio can route to the PWM peripheral.
+func (d *rpioDriver) HardwarePwm(pin Pin) bool {
+	return bcmHardwarePwm(pin)
 }
 
-func DisableIRQs(irqs uint64) {
-	rpio.DisableIRQs(irqs)
+// Watch samples the pin every millisecond, the edge detection registers are
+// left alone since they can freeze the Pi without the gpio-no-irq overlay.
+func (d *rpioDriver) Watch(pin Pin, edge Edge) (<-chan Event, error) {
+	watcher, err := d.watchers.add(pin, edge)
+	if err != nil {
+		return nil, err
+	}
+	go d.watchers.sampleEdges(pin, watcher.stop, time.Millisecond, d.ReadPin)
+	return watcher.events, nil
 }
 
-func Open() (err error) {
-	return rpio.Open()
-}
-
-func Close() error {
-	return rpio.Close()
+func (d *rpioDriver) Unwatch(pin Pin) {
+	d.watchers.remove(pin)
 }
@@ -0,0 +1,601 @@
+package gpio
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"bufio"
+	"strconv"
+	"io/ioutil"
+	"strings"
+	log "github.com/sirupsen/logrus"
+)
+
+// simPin holds the whole state of a simulated pin. drive is the level forced
+// from the outside (script or control socket), a floating input follows its
+// pull resistor.
+type simPin struct {
+	mode		Mode
+	pull		Pull
+	activeLow	bool
+	output		State
+	drive		*State
+	edge		Edge
+	detected	bool
+	freq		int
+	duty		uint32
+	cycle		uint32
+	square		chan struct{}
+	train		[]time.Duration
+	trainStart	time.Time
+}
+
+// level returns the logical level of the pin, as ReadPin sees it.
+func (p *simPin) level() State {
+	var level State
+	switch {
+	case p.mode == Output:
+		return p.output
+	case p.mode == Pwm:
+		if p.duty > 0 {
+			return High
+		}
+		return Low
+	case p.replaying(&level):
+	case p.drive != nil:
+		level = *p.drive
+	case p.pull == PullUp:
+		level = High
+	}
+	if p.activeLow {
+		level ^= High
+	}
+	return level
+}
+
+// replaying sets level while a pulse train is playing, the train starts low
+// and alternates on every duration.
+func (p *simPin) replaying(level *State) bool {
+	if p.train == nil || p.trainStart.IsZero() {
+		return false
+	}
+	elapsed := time.Since(p.trainStart)
+	for i, duration := range p.train {
+		if elapsed < duration {
+			*level = State(i % 2)
+			return true
+		}
+		elapsed -= duration
+	}
+	return false
+}
+
+func (p *simPin) String() string {
+	return fmt.Sprintf("mode=%s pull=%s active_low=%t level=%s freq=%d duty=%d/%d edge=%s",
+		ModeStrings[p.mode], PullStrings[p.pull], p.activeLow, StateStrings[p.level()], p.freq, p.duty, p.cycle, EdgeStrings[p.edge])
+}
+
+// simAction is a change applied to the pin from the outside, parsed from a
+// script line or a control socket command.
+type simAction struct {
+	pin			Pin
+	verb		string
+	period		time.Duration
+	train		[]time.Duration
+}
+
+type simEvent struct {
+	at			time.Duration
+	action		simAction
+}
+
+// simDriver keeps every pin in memory so mbpio can run without any hardware.
+type simDriver struct {
+	script		string
+	control		string
+	mu			sync.Mutex
+	pins		map[Pin]*simPin
+	listener	net.Listener
+	conns		map[net.Conn]bool
+	watchers	watchers
+	quit		chan struct{}
+	closing		sync.Once
+	wg			sync.WaitGroup
+}
+
+func init() {
+	Register("sim", func(opts Options) (Driver, error) {
+		return &simDriver{
+			script: opts.Script,
+			control: opts.Control,
+			pins: make(map[Pin]*simPin),
+			conns: make(map[net.Conn]bool),
+			quit: make(chan struct{}),
+		}, nil
+	})
+}
+
+func parseSimAction(fields []string) (action simAction, err error) {
+	if len(fields) < 2 {
+		return action, fmt.Errorf("expected <pin> <high|low|toggle|release|square PERIOD|replay FILE>")
+	}
+	pin, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return action, fmt.Errorf("invalid pin %q", fields[0])
+	}
+	action.pin = Pin(pin)
+	action.verb = strings.ToLower(fields[1])
+
+	switch action.verb {
+	case "high", "low", "toggle", "release":
+		if len(fields) != 2 {
+			return action, fmt.Errorf("%s takes no argument", action.verb)
+		}
+	case "square":
+		if len(fields) != 3 {
+			return action, fmt.Errorf("square takes a period")
+		}
+		action.period, err = time.ParseDuration(fields[2])
+		if err != nil || action.period <= 0 {
+			return action, fmt.Errorf("invalid square period %q", fields[2])
+		}
+	case "replay":
+		if len(fields) != 3 {
+			return action, fmt.Errorf("replay takes a pulse train file")
+		}
+		action.train, err = parseSimTrain(fields[2])
+		if err != nil {
+			return action, err
+		}
+	default:
+		return action, fmt.Errorf("unknown action %q", fields[1])
+	}
+	return action, nil
+}
+
+// parseSimTrain reads a file of durations, like "80us 80us 50us 27us ...".
+// The train is played every time the pin is switched to input, which lets a
+// recorded sensor answer (a DHT22 one for instance) be replayed.
+func parseSimTrain(path string) ([]time.Duration, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var train []time.Duration
+	for _, line := range strings.Split(string(content), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, field := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			duration, err := time.ParseDuration(field)
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("%s: invalid duration %q", path, field)
+			}
+			train = append(train, duration)
+		}
+	}
+	if len(train) == 0 {
+		return nil, fmt.Errorf("%s: empty pulse train", path)
+	}
+	return train, nil
+}
+
+// parseSimScript reads lines like "2s 23 high" or "0s 22 square 500ms",
+// times are relative to the driver opening.
+func parseSimScript(r io.Reader) ([]simEvent, error) {
+	var events []simEvent
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		at, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid time %q", lineno, fields[0])
+		}
+		action, err := parseSimAction(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		events = append(events, simEvent{at, action})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].at < events[j].at
+	})
+	return events, nil
+}
+
+func (d *simDriver) Open() error {
+	if d.script != "" {
+		file, err := os.Open(d.script)
+		if err != nil {
+			return err
+		}
+		events, err := parseSimScript(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("sim script %s: %s", d.script, err)
+		}
+		d.mu.Lock()
+		started := d.spawn(func() { d.runScript(events) })
+		d.mu.Unlock()
+		if !started {
+			return fmt.Errorf("sim: driver closed")
+		}
+	}
+
+	if d.control != "" {
+		network, address := "unix", d.control
+		if i := strings.Index(d.control, ":"); i >= 0 && (d.control[:i] == "unix" || d.control[:i] == "tcp") {
+			network, address = d.control[:i], d.control[i+1:]
+		}
+		if network == "unix" {
+			os.Remove(address)
+		}
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		d.listener = listener
+		started := d.spawn(d.serveControl)
+		d.mu.Unlock()
+		if !started {
+			listener.Close()
+			return fmt.Errorf("sim: driver closed")
+		}
+		log.Infof("sim: control socket listening on %s:%s", network, address)
+	}
+
+	log.Debug("Open")
+	return nil
+}
+
+// Close stops the script and the control socket along with its connections,
+// calling it again is a no-op. The driver refuses the sim actions once closed.
+func (d *simDriver) Close() error {
+	d.closing.Do(func() {
+		// quit is closed under the lock for spawn to never add to the wait
+		// group once Close waits on it
+		d.mu.Lock()
+		close(d.quit)
+		if d.listener != nil {
+			d.listener.Close()
+		}
+		for conn := range d.conns {
+			conn.Close()
+		}
+		d.mu.Unlock()
+		d.watchers.removeAll()
+		d.wg.Wait()
+		log.Debug("Close")
+	})
+	return nil
+}
+
+// closed reports whether Close was called, the lock must be held.
+func (d *simDriver) closed() bool {
+	select {
+	case <-d.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// spawn runs fn in a goroutine Close waits for, it is refused once the driver
+// is closed. The lock must be held.
+func (d *simDriver) spawn(fn func()) bool {
+	if d.closed() {
+		return false
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+func (d *simDriver) runScript(events []simEvent) {
+	start := time.Now()
+	for _, event := range events {
+		select {
+		case <-time.After(time.Until(start.Add(event.at))):
+			d.apply(event.action)
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *simDriver) serveControl() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			select {
+			case <-d.quit:
+			default:
+				log.Warnf("sim: control socket accept failed: %s", err)
+			}
+			return
+		}
+		if !d.track(conn) {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// track registers a control connection for Close to tear down and serves it,
+// it is refused once the driver is closed.
+func (d *simDriver) track(conn net.Conn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.spawn(func() { d.handleControl(conn) }) {
+		return false
+	}
+	d.conns[conn] = true
+	return true
+}
+
+// handleControl accepts the script actions without the time, plus
+// "get <pin>" and "dump" to inspect the pins.
+func (d *simDriver) handleControl(conn net.Conn) {
+	defer func() {
+		d.mu.Lock()
+		delete(d.conns, conn)
+		d.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(fields[0]) {
+		case "dump":
+			d.mu.Lock()
+			pins := make([]int, 0, len(d.pins))
+			for pin := range d.pins {
+				pins = append(pins, int(pin))
+			}
+			sort.Ints(pins)
+			for _, pin := range pins {
+				fmt.Fprintf(conn, "pin %d %s\n", pin, d.pins[Pin(pin)])
+			}
+			d.mu.Unlock()
+			fmt.Fprintln(conn, "ok")
+		case "get":
+			pin := -1
+			if len(fields) == 2 {
+				pin, _ = strconv.Atoi(fields[1])
+			}
+			if pin < 0 {
+				fmt.Fprintln(conn, "error: expected get <pin>")
+				continue
+			}
+			d.mu.Lock()
+			p, ok := d.pins[Pin(pin)]
+			if !ok {
+				p = &simPin{}
+			}
+			fmt.Fprintf(conn, "pin %d %s\n", pin, p)
+			d.mu.Unlock()
+		default:
+			action, err := parseSimAction(fields)
+			if err != nil {
+				fmt.Fprintf(conn, "error: %s\n", err)
+				continue
+			}
+			d.apply(action)
+			fmt.Fprintln(conn, "ok")
+		}
+	}
+}
+
+func (d *simDriver) apply(action simAction) {
+	log.WithFields(log.Fields{"pin": action.pin, "action": action.verb}).Debug("sim: drive")
+
+	d.update(action.pin, func(p *simPin) {
+		if d.closed() {
+			return
+		}
+		if p.square != nil {
+			close(p.square)
+			p.square = nil
+		}
+		p.train = nil
+		p.trainStart = time.Time{}
+
+		switch action.verb {
+		case "high", "low":
+			state := Low
+			if action.verb == "high" {
+				state = High
+			}
+			p.drive = &state
+		case "toggle":
+			state := High
+			if p.drive != nil {
+				state = *p.drive ^ High
+			}
+			p.drive = &state
+		case "release":
+			p.drive = nil
+		case "square":
+			stop := make(chan struct{})
+			p.square = stop
+			d.spawn(func() { d.runSquare(action.pin, action.period, stop) })
+		case "replay":
+			p.train = action.train
+		}
+	})
+}
+
+func (d *simDriver) runSquare(pin Pin, period time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(period / 2)
+	defer ticker.Stop()
+
+	state := Low
+	for {
+		select {
+		case <-ticker.C:
+			state ^= High
+			level := state
+			d.update(pin, func(p *simPin) {
+				p.drive = &level
+			})
+		case <-stop:
+			return
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// pin must be called with the lock held.
+func (d *simDriver) pin(pin Pin) *simPin {
+	p, ok := d.pins[pin]
+	if !ok {
+		p = &simPin{}
+		d.pins[pin] = p
+	}
+	return p
+}
+
+// update runs fn on the pin and latches an edge when the level changed.
+func (d *simDriver) update(pin Pin, fn func(p *simPin)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p := d.pin(pin)
+	before := p.level()
+	fn(p)
+	after := p.level()
+
+	if before != after {
+		edge := FallEdge
+		if after == High {
+			edge = RiseEdge
+		}
+		if p.edge & edge != 0 {
+			p.detected = true
+		}
+		d.watchers.notify(pin, edge, time.Now())
+	}
+}
+
+func (d *simDriver) PinMode(pin Pin, mode Mode) {
+	log.WithFields(log.Fields{"pin": pin, "mode": ModeStrings[mode]}).Debug("PinMode")
+	d.update(pin, func(p *simPin) {
+		p.mode = mode
+		if mode == Input && p.train != nil {
+			p.trainStart = time.Now()
+		}
+	})
+}
+
+func (d *simDriver) WritePin(pin Pin, state State) {
+	log.WithFields(log.Fields{"pin": pin, "state": StateStrings[state]}).Debug("WritePin")
+	d.update(pin, func(p *simPin) {
+		p.output = state
+	})
+}
+
+func (d *simDriver) ReadPin(pin Pin) State {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pin(pin).level()
+}
+
+func (d *simDriver) TogglePin(pin Pin) {
+	log.WithFields(log.Fields{"pin": pin}).Debug("TogglePin")
+	d.update(pin, func(p *simPin) {
+		p.output ^= High
+	})
+}
+
+func (d *simDriver) PullMode(pin Pin, pull Pull) {
+	log.WithFields(log.Fields{"pin": pin, "pull": PullStrings[pull]}).Debug("PullMode")
+	d.update(pin, func(p *simPin) {
+		p.pull = pull
+	})
+}
+
+func (d *simDriver) ActiveLow(pin Pin, activeLow bool) {
+	log.WithFields(log.Fields{"pin": pin, "active_low": activeLow}).Debug("ActiveLow")
+	d.update(pin, func(p *simPin) {
+		p.activeLow = activeLow
+	})
+}
+
+func (d *simDriver) DetectEdge(pin Pin, edge Edge) {
+	log.WithFields(log.Fields{"pin": pin, "edge": EdgeStrings[edge]}).Debug("DetectEdge")
+	d.update(pin, func(p *simPin) {
+		p.edge = edge
+		p.detected = false
+	})
+}
+
+func (d *simDriver) EdgeDetected(pin Pin) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := d.pin(pin)
+	detected := p.detected
+	p.detected = false
+	return detected
+}
+
+func (d *simDriver) SetFreq(pin Pin, freq int) {
+	log.WithFields(log.Fields{"pin": pin, "freq": freq}).Debug("SetFreq")
+	d.update(pin, func(p *simPin) {
+		p.freq = freq
+	})
+}
+
+func (d *simDriver) SetDutyCycle(pin Pin, dutyLen, cycleLen uint32) {
+	log.WithFields(log.Fields{"pin": pin, "duty": dutyLen, "cycle": cycleLen}).Debug("SetDutyCycle")
+	d.update(pin, func(p *simPin) {
+		p.duty = dutyLen
+		p.cycle = cycleLen
+	})
+}
+
+// HardwarePwm mirrors the pins of a Raspberry Pi.
+func (d *simDriver) HardwarePwm(pin Pin) bool {
+	return bcmHardwarePwm(pin)
+}
+
+func (d *simDriver) Watch(pin Pin, edge Edge) (<-chan Event, error) {
+	log.WithFields(log.Fields{"pin": pin, "edge": EdgeStrings[edge]}).Debug("Watch")
+	watcher, err := d.watchers.add(pin, edge)
+	if err != nil {
+		return nil, err
+	}
+	return watcher.events, nil
+}
+
+func (d *simDriver) Unwatch(pin Pin) {
+	log.WithFields(log.Fields{"pin": pin}).Debug("Unwatch")
+	d.watchers.remove(pin)
+}
@@ -0,0 +1,109 @@
+package gpio
+
+import (
+	"net"
+	"time"
+	"bufio"
+	"testing"
+	"path/filepath"
+)
+
+func openSim(t *testing.T) (Driver, string) {
+	t.Helper()
+	control := filepath.Join(t.TempDir(), "sim.sock")
+	driver, err := New("sim", Options{Control: control})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return driver, control
+}
+
+func TestSimControl(t *testing.T) {
+	driver, control := openSim(t)
+	defer driver.Close()
+
+	conn, err := net.Dial("unix", control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	command := func(line string) string {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply[:len(reply)-1]
+	}
+
+	driver.PullMode(4, PullUp)
+	if reply := command("get 4"); reply != "pin 4 mode=Input pull=Up active_low=false level=High freq=0 duty=0/0 edge=NoEdge" {
+		t.Errorf("get: %q", reply)
+	}
+	if reply := command("4 low"); reply != "ok" || driver.ReadPin(4) != Low {
+		t.Errorf("drive: %q, pin %s", reply, StateStrings[driver.ReadPin(4)])
+	}
+	if reply := command("4 sideways"); reply[:6] != "error:" {
+		t.Errorf("unknown action: %q", reply)
+	}
+}
+
+func TestSimClose(t *testing.T) {
+	driver, control := openSim(t)
+
+	// a connection left open doesn't hold Close
+	conn, err := net.Dial("unix", control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("get 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		driver.Close()
+		driver.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by a control connection")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("connection still served: %q", line)
+	}
+	if _, err := net.Dial("unix", control); err == nil {
+		t.Error("control socket still listening")
+	}
+
+	// the actions are refused once closed, nothing outlives Close
+	d := driver.(*simDriver)
+	d.apply(simAction{pin: 7, verb: "square", period: time.Millisecond})
+	d.apply(simAction{pin: 8, verb: "high"})
+	if d.pins[7] != nil && d.pins[7].square != nil {
+		t.Error("square wave started after Close")
+	}
+	if driver.ReadPin(8) != Low {
+		t.Error("pin driven after Close")
+	}
+	if err := driver.Open(); err == nil {
+		t.Error("reopened a closed driver")
+	}
+}
@@ -0,0 +1,199 @@
+package gpio
+
+import (
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+// softChannel is a pin driven by the software PWM, its period follows the
+// rpio semantics: cycle ticks of a freq Hz clock.
+type softChannel struct {
+	freq		int
+	duty		uint32
+	cycle		uint32
+	start		time.Time
+	level		State
+	written		bool
+}
+
+func (c *softChannel) timing() (period, width time.Duration) {
+	if c.freq <= 0 || c.cycle == 0 {
+		return 0, 0
+	}
+	period = time.Duration(int64(c.cycle) * int64(time.Second) / int64(c.freq))
+	duty := c.duty
+	if duty > c.cycle {
+		duty = c.cycle
+	}
+	return period, period * time.Duration(duty) / time.Duration(c.cycle)
+}
+
+// advance returns the level of the channel at now and when it changes next,
+// a zero time when it is steady. A late scheduler restarts the cycle rather
+// than catching up.
+func (c *softChannel) advance(now time.Time) (State, time.Time) {
+	period, width := c.timing()
+	switch {
+	case width <= 0:
+		return Low, time.Time{}
+	case width >= period:
+		return High, time.Time{}
+	}
+
+	if end := c.start.Add(period); !now.Before(end) {
+		c.start = end
+		if !now.Before(c.start.Add(period)) {
+			c.start = now
+		}
+	}
+	if now.Before(c.start.Add(width)) {
+		return High, c.start.Add(width)
+	}
+	return Low, c.start.Add(period)
+}
+
+// softPwm drives the PWM of the pins without hardware channel from a single
+// scheduler goroutine, everything else goes to the wrapped driver. It is
+// meant for low frequencies, like dimming relays or time-proportioning.
+type softPwm struct {
+	Driver
+	mu			sync.Mutex
+	channels	map[Pin]*softChannel
+	wake		chan struct{}
+	stop		chan struct{}
+	done		chan struct{}
+}
+
+// NewSoftPwm wraps driver with the software PWM fallback.
+func NewSoftPwm(driver Driver) Driver {
+	return &softPwm{
+		Driver: driver,
+		channels: make(map[Pin]*softChannel),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (s *softPwm) hardware(pin Pin) bool {
+	capable, ok := s.Driver.(PwmCapable)
+	return ok && capable.HardwarePwm(pin)
+}
+
+func (s *softPwm) Open() error {
+	if err := s.Driver.Open(); err != nil {
+		return err
+	}
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	go s.run()
+	return nil
+}
+
+// Close stops the scheduler and leaves the software PWM pins low.
+func (s *softPwm) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+	s.mu.Lock()
+	for pin := range s.channels {
+		s.Driver.WritePin(pin, Low)
+	}
+	s.mu.Unlock()
+	return s.Driver.Close()
+}
+
+func (s *softPwm) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *softPwm) run() {
+	defer close(s.done)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		wait := time.Second
+		for pin, channel := range s.channels {
+			level, next := channel.advance(now)
+			if level != channel.level || !channel.written {
+				s.Driver.WritePin(pin, level)
+				channel.level, channel.written = level, true
+			}
+			if !next.IsZero() && next.Sub(now) < wait {
+				wait = next.Sub(now)
+			}
+		}
+		s.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *softPwm) PinMode(pin Pin, mode Mode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if mode == Pwm && !s.hardware(pin) {
+		if _, ok := s.channels[pin]; !ok {
+			log.WithFields(log.Fields{"pin": pin}).Info("gpio: no hardware pwm on this pin, using the software pwm")
+			s.Driver.PinMode(pin, Output)
+			s.channels[pin] = &softChannel{start: time.Now()}
+			s.notify()
+		}
+		return
+	}
+	delete(s.channels, pin)
+	s.Driver.PinMode(pin, mode)
+}
+
+func (s *softPwm) SetFreq(pin Pin, freq int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if channel, ok := s.channels[pin]; ok {
+		channel.freq = freq
+		s.notify()
+		return
+	}
+	s.Driver.SetFreq(pin, freq)
+}
+
+func (s *softPwm) SetDutyCycle(pin Pin, dutyLen, cycleLen uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if channel, ok := s.channels[pin]; ok {
+		channel.duty, channel.cycle = dutyLen, cycleLen
+		s.notify()
+		return
+	}
+	s.Driver.SetDutyCycle(pin, dutyLen, cycleLen)
+}
+
+// HardwarePwm delegates to the wrapped driver, the software channels have no
+// hardware behind them.
+func (s *softPwm) HardwarePwm(pin Pin) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.channels[pin]; ok {
+		return false
+	}
+	return s.hardware(pin)
+}
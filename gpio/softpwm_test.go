@@ -0,0 +1,133 @@
+package gpio
+
+import (
+	"time"
+	"testing"
+)
+
+func TestSoftChannelTiming(t *testing.T) {
+	tests := []struct {
+		freq		int
+		duty		uint32
+		cycle		uint32
+		period		time.Duration
+		width		time.Duration
+	}{
+		{1000, 25, 100, 100 * time.Millisecond, 25 * time.Millisecond},
+		{10, 1, 4, 400 * time.Millisecond, 100 * time.Millisecond},
+		{10, 5, 4, 400 * time.Millisecond, 400 * time.Millisecond},
+		{0, 1, 4, 0, 0},
+		{10, 1, 0, 0, 0},
+	}
+	for _, test := range tests {
+		c := &softChannel{freq: test.freq, duty: test.duty, cycle: test.cycle}
+		if period, width := c.timing(); period != test.period || width != test.width {
+			t.Errorf("%d/%d at %dHz: %s high over %s, want %s over %s", test.duty, test.cycle, test.freq, width, period, test.width, test.period)
+		}
+	}
+}
+
+func TestSoftChannelAdvance(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	// 300ms high every second
+	c := &softChannel{freq: 10, duty: 3, cycle: 10, start: start}
+	steps := []struct {
+		now			time.Time
+		level		State
+		next		time.Time
+	}{
+		{at(0), High, at(300)},
+		{at(299), High, at(300)},
+		{at(300), Low, at(1000)},
+		{at(1000), High, at(1300)},
+		{at(1500), Low, at(2000)},
+		// late by more than a period, the cycle restarts
+		{at(3200), High, at(3500)},
+		{at(3600), Low, at(4200)},
+	}
+	for _, step := range steps {
+		level, next := c.advance(step.now)
+		if level != step.level || !next.Equal(step.next) {
+			t.Errorf("at %s: %s until %s, want %s until %s", step.now.Sub(start), StateStrings[level], next.Sub(start), StateStrings[step.level], step.next.Sub(start))
+		}
+	}
+
+	// the steady levels have no next change
+	for duty, want := range map[uint32]State{0: Low, 10: High, 12: High} {
+		c := &softChannel{freq: 10, duty: duty, cycle: 10, start: start}
+		if level, next := c.advance(at(500)); level != want || !next.IsZero() {
+			t.Errorf("duty %d: %s until %s, want steady %s", duty, StateStrings[level], next, StateStrings[want])
+		}
+	}
+}
+
+func TestSoftPwm(t *testing.T) {
+	base, err := New("sim", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewSoftPwm(base)
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 50ms high every 100ms on pin 17, which has no hardware channel
+	events, err := d.Watch(17, AnyEdge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.PinMode(17, Pwm)
+	d.SetFreq(17, 100)
+	d.SetDutyCycle(17, 5, 10)
+
+	var rise time.Time
+	highs := 0
+	timeout := time.After(2 * time.Second)
+	for highs < 3 {
+		select {
+		case event := <-events:
+			if event.Edge == RiseEdge {
+				rise = event.Time
+				continue
+			}
+			if rise.IsZero() {
+				continue
+			}
+			if width := event.Time.Sub(rise); width < 40 * time.Millisecond || width > 90 * time.Millisecond {
+				t.Errorf("high for %s, want 50ms", width)
+			}
+			highs++
+		case <-timeout:
+			t.Fatalf("%d pulses in 2s", highs)
+		}
+	}
+
+	pwm := d.(PwmCapable)
+	if pwm.HardwarePwm(17) {
+		t.Error("hardware pwm reported on the software channel")
+	}
+	d.PinMode(18, Pwm)
+	if !pwm.HardwarePwm(18) {
+		t.Error("hardware pwm of the wrapped driver not reported")
+	}
+	if got := base.(*simDriver).pin(18).mode; got != Pwm {
+		t.Errorf("pin 18 in %s mode, want the hardware pwm", ModeStrings[got])
+	}
+
+	// leaving the pwm mode stops the channel
+	d.PinMode(17, Output)
+	d.WritePin(17, High)
+	time.Sleep(150 * time.Millisecond)
+	if d.ReadPin(17) != High {
+		t.Error("software pwm still driving pin 17")
+	}
+	d.PinMode(17, Pwm)
+	d.SetDutyCycle(17, 1, 10)
+	d.Close()
+	if d.ReadPin(17) != Low {
+		t.Error("software pwm pin left high on close")
+	}
+}
@@ -0,0 +1,200 @@
+package gpio
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"strconv"
+	"io/ioutil"
+	"path/filepath"
+	log "github.com/sirupsen/logrus"
+)
+
+// PwmChannel is a channel of a /sys/class/pwm/pwmchipN controller.
+type PwmChannel struct {
+	Chip			int
+	Channel			int
+}
+
+// DefaultPwmChannels maps the PWM pins of a Raspberry Pi with the pwm-2chan
+// overlay.
+var DefaultPwmChannels = map[Pin]PwmChannel {
+	12: {0, 0},
+	18: {0, 0},
+	13: {0, 1},
+	19: {0, 1},
+}
+
+type sysfsPwmLine struct {
+	dir			string
+	exported	bool
+	freq		int
+	duty		uint32
+	cycle		uint32
+	period		uint64
+	width		uint64
+}
+
+// sysfsPwm drives the PWM of the mapped pins through the kernel pwm class
+// instead of the PWM registers, everything else goes to the wrapped driver.
+// The period is cycle ticks of a freq Hz clock, as with rpio.
+type sysfsPwm struct {
+	Driver
+	root		string
+	channels	map[Pin]PwmChannel
+	mu			sync.Mutex
+	lines		map[Pin]*sysfsPwmLine
+}
+
+// NewSysfsPwm wraps driver with the sysfs PWM backend rooted at root, usually
+// /sys/class/pwm.
+func NewSysfsPwm(driver Driver, root string, channels map[Pin]PwmChannel) Driver {
+	return &sysfsPwm{
+		Driver: driver,
+		root: root,
+		channels: channels,
+		lines: make(map[Pin]*sysfsPwmLine),
+	}
+}
+
+func (s *sysfsPwm) write(line *sysfsPwmLine, name string, value uint64) error {
+	return ioutil.WriteFile(filepath.Join(line.dir, name), []byte(strconv.FormatUint(value, 10)), 0644)
+}
+
+// export makes the channel directory appear, udev may need a moment to hand
+// its files over.
+func (s *sysfsPwm) export(pin Pin, line *sysfsPwmLine) error {
+	channel := s.channels[pin]
+	chip := filepath.Join(s.root, fmt.Sprintf("pwmchip%d", channel.Chip))
+	line.dir = filepath.Join(chip, fmt.Sprintf("pwm%d", channel.Channel))
+
+	if _, err := os.Stat(line.dir); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(filepath.Join(chip, "export"), []byte(strconv.Itoa(channel.Channel)), 0644); err != nil {
+			return err
+		}
+		line.exported = true
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		file, err := os.OpenFile(filepath.Join(line.dir, "enable"), os.O_WRONLY, 0)
+		if err == nil {
+			file.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// apply writes the period and the duty cycle of the line, ordered so the
+// duty never exceeds the period.
+func (s *sysfsPwm) apply(pin Pin, line *sysfsPwmLine) {
+	if line.freq <= 0 || line.cycle == 0 {
+		return
+	}
+	period := uint64(line.cycle) * uint64(time.Second) / uint64(line.freq)
+	duty := line.duty
+	if duty > line.cycle {
+		duty = line.cycle
+	}
+	width := period * uint64(duty) / uint64(line.cycle)
+
+	var err error
+	if period >= line.width {
+		err = s.write(line, "period", period)
+		if err == nil {
+			err = s.write(line, "duty_cycle", width)
+		}
+	} else {
+		err = s.write(line, "duty_cycle", width)
+		if err == nil {
+			err = s.write(line, "period", period)
+		}
+	}
+	if err == nil {
+		line.period, line.width = period, width
+		err = s.write(line, "enable", 1)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"pin": pin, "dir": line.dir}).Warnf("sysfs pwm: %s", err)
+	}
+}
+
+func (s *sysfsPwm) HardwarePwm(pin Pin) bool {
+	if _, ok := s.channels[pin]; ok {
+		return true
+	}
+	capable, ok := s.Driver.(PwmCapable)
+	return ok && capable.HardwarePwm(pin)
+}
+
+// Close disables the channels and unexports the ones it exported.
+func (s *sysfsPwm) Close() error {
+	s.mu.Lock()
+	for pin, line := range s.lines {
+		s.write(line, "enable", 0)
+		if line.exported {
+			channel := s.channels[pin]
+			ioutil.WriteFile(filepath.Join(filepath.Dir(line.dir), "unexport"), []byte(strconv.Itoa(channel.Channel)), 0644)
+		}
+		delete(s.lines, pin)
+	}
+	s.mu.Unlock()
+	return s.Driver.Close()
+}
+
+func (s *sysfsPwm) PinMode(pin Pin, mode Mode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.channels[pin]; !ok || mode != Pwm {
+		if line, ok := s.lines[pin]; ok {
+			s.write(line, "enable", 0)
+			delete(s.lines, pin)
+		}
+		s.Driver.PinMode(pin, mode)
+		return
+	}
+	if _, ok := s.lines[pin]; ok {
+		return
+	}
+
+	line := &sysfsPwmLine{}
+	if err := s.export(pin, line); err != nil {
+		log.WithFields(log.Fields{"pin": pin, "dir": line.dir}).Warnf("sysfs pwm: cannot export the channel: %s", err)
+		return
+	}
+	log.WithFields(log.Fields{"pin": pin, "dir": line.dir}).Debug("sysfs pwm: channel exported")
+	s.lines[pin] = line
+}
+
+func (s *sysfsPwm) SetFreq(pin Pin, freq int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if line, ok := s.lines[pin]; ok {
+		line.freq = freq
+		s.apply(pin, line)
+		return
+	}
+	if _, ok := s.channels[pin]; !ok {
+		s.Driver.SetFreq(pin, freq)
+	}
+}
+
+func (s *sysfsPwm) SetDutyCycle(pin Pin, dutyLen, cycleLen uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if line, ok := s.lines[pin]; ok {
+		line.duty, line.cycle = dutyLen, cycleLen
+		s.apply(pin, line)
+		return
+	}
+	if _, ok := s.channels[pin]; !ok {
+		s.Driver.SetDutyCycle(pin, dutyLen, cycleLen)
+	}
+}
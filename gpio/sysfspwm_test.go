@@ -0,0 +1,229 @@
+package gpio
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// sysfsTree is a /sys/class/pwm tree in a temporary directory, a goroutine
+// plays the kernel: the channels written to export appear and the ones
+// written to unexport go away.
+type sysfsTree struct {
+	root		string
+}
+
+func newSysfsTree(t *testing.T) *sysfsTree {
+	t.Helper()
+	tree := &sysfsTree{root: t.TempDir()}
+	chip := filepath.Join(tree.root, "pwmchip0")
+	if err := os.Mkdir(chip, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"export", "unexport"} {
+		if err := ioutil.WriteFile(filepath.Join(chip, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				tree.sync(t)
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+	return tree
+}
+
+// sync consumes the channels written to export and unexport.
+func (tree *sysfsTree) sync(t *testing.T) {
+	chip := filepath.Join(tree.root, "pwmchip0")
+	for _, name := range []string{"export", "unexport"} {
+		path := filepath.Join(chip, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		ioutil.WriteFile(path, nil, 0644)
+		if name == "export" {
+			tree.export(t, string(data))
+		} else {
+			os.RemoveAll(filepath.Join(chip, "pwm" + string(data)))
+		}
+	}
+}
+
+// export creates the files of a channel, the enable file last as the driver
+// waits for it.
+func (tree *sysfsTree) export(t *testing.T, channel string) {
+	dir := filepath.Join(tree.root, "pwmchip0", "pwm" + channel)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Error(err)
+		return
+	}
+	for _, name := range []string{"period", "duty_cycle", "enable"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("0"), 0644); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// channel returns the settings of a channel.
+func (tree *sysfsTree) channel(n int) string {
+	dir := filepath.Join(tree.root, "pwmchip0", fmt.Sprintf("pwm%d", n))
+	if _, err := os.Stat(dir); err != nil {
+		return "unexported"
+	}
+	var values []string
+	for _, name := range []string{"period", "duty_cycle", "enable"} {
+		content, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		values = append(values, fmt.Sprintf("%s=%s", name, content))
+	}
+	return strings.Join(values, " ")
+}
+
+// waitUnexported waits for the kernel to drop a channel.
+func (tree *sysfsTree) waitUnexported(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for tree.channel(n) != "unexported" {
+		if time.Now().After(deadline) {
+			t.Fatalf("channel %d left exported", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pinsDriver records the calls passed to the wrapped driver.
+type pinsDriver struct {
+	Driver
+	calls		[]string
+	closed		bool
+}
+
+func (d *pinsDriver) PinMode(pin Pin, mode Mode) {
+	d.calls = append(d.calls, fmt.Sprintf("PinMode %d %s", pin, ModeStrings[mode]))
+}
+
+func (d *pinsDriver) SetFreq(pin Pin, freq int) {
+	d.calls = append(d.calls, fmt.Sprintf("SetFreq %d %d", pin, freq))
+}
+
+func (d *pinsDriver) SetDutyCycle(pin Pin, dutyLen, cycleLen uint32) {
+	d.calls = append(d.calls, fmt.Sprintf("SetDutyCycle %d %d/%d", pin, dutyLen, cycleLen))
+}
+
+func (d *pinsDriver) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestSysfsPwm(t *testing.T) {
+	tree := newSysfsTree(t)
+	base := &pinsDriver{}
+	d := NewSysfsPwm(base, tree.root, map[Pin]PwmChannel{18: {0, 0}, 19: {0, 1}})
+
+	d.PinMode(18, Pwm)
+	if got := tree.channel(0); got != "period=0 duty_cycle=0 enable=0" {
+		t.Errorf("exported channel %q", got)
+	}
+	// 100 ticks of 1kHz, a 100ms period
+	d.SetFreq(18, 1000)
+	d.SetDutyCycle(18, 25, 100)
+	if got, want := tree.channel(0), "period=100000000 duty_cycle=25000000 enable=1"; got != want {
+		t.Errorf("channel %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		name	string
+		apply	func()
+		want	string
+	}{
+		{"duty raised", func() { d.SetDutyCycle(18, 75, 100) },
+			"period=100000000 duty_cycle=75000000 enable=1"},
+		{"period shrunk", func() { d.SetFreq(18, 10000) },
+			"period=10000000 duty_cycle=7500000 enable=1"},
+		{"period grown", func() { d.SetFreq(18, 100) },
+			"period=1000000000 duty_cycle=750000000 enable=1"},
+		{"duty over the cycle", func() { d.SetDutyCycle(18, 150, 100) },
+			"period=1000000000 duty_cycle=1000000000 enable=1"},
+		{"period shrunk under a full duty", func() { d.SetDutyCycle(18, 10, 10) },
+			"period=100000000 duty_cycle=100000000 enable=1"},
+		{"no cycle", func() { d.SetDutyCycle(18, 0, 0) },
+			"period=100000000 duty_cycle=100000000 enable=1"},
+	}
+	for _, test := range tests {
+		test.apply()
+		if got := tree.channel(0); got != test.want {
+			t.Errorf("%s: channel %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// the other pins and modes go to the wrapped driver
+	d.PinMode(17, Pwm)
+	d.SetFreq(17, 1000)
+	d.SetDutyCycle(19, 1, 2)
+	want := []string{"PinMode 17 Pwm", "SetFreq 17 1000"}
+	if fmt.Sprint(base.calls) != fmt.Sprint(want) || tree.channel(1) != "unexported" {
+		t.Errorf("calls %q with channel 1 %q, want %q", base.calls, tree.channel(1), want)
+	}
+
+	// the channel exported by the driver is unexported on close
+	d.Close()
+	if !base.closed {
+		t.Error("wrapped driver left open")
+	}
+	tree.waitUnexported(t, 0)
+}
+
+func TestSysfsPwmExported(t *testing.T) {
+	tree := newSysfsTree(t)
+	// exported before the driver started, it is left exported
+	tree.export(t, "1")
+
+	base := &pinsDriver{}
+	d := NewSysfsPwm(base, tree.root, DefaultPwmChannels)
+	d.PinMode(13, Pwm)
+	d.SetDutyCycle(13, 1, 4)
+	d.SetFreq(13, 4000)
+	if got, want := tree.channel(1), "period=1000000 duty_cycle=250000 enable=1"; got != want {
+		t.Errorf("channel %q, want %q", got, want)
+	}
+	d.PinMode(13, Output)
+	if got, want := tree.channel(1), "period=1000000 duty_cycle=250000 enable=0"; got != want {
+		t.Errorf("channel %q after leaving the pwm mode, want %q", got, want)
+	}
+	if fmt.Sprint(base.calls) != "[PinMode 13 Output]" {
+		t.Errorf("calls %q", base.calls)
+	}
+
+	d.Close()
+	time.Sleep(10 * time.Millisecond)
+	if got := tree.channel(1); got == "unexported" {
+		t.Error("channel exported by someone else unexported on close")
+	}
+
+	// a channel that never shows up
+	d = NewSysfsPwm(&pinsDriver{}, filepath.Join(tree.root, "missing"), DefaultPwmChannels)
+	d.PinMode(12, Pwm)
+	if d.(*sysfsPwm).lines[12] != nil {
+		t.Error("missing channel registered")
+	}
+	if !d.(PwmCapable).HardwarePwm(12) || d.(PwmCapable).HardwarePwm(17) {
+		t.Error("hardware pwm not reported on the mapped pins only")
+	}
+}
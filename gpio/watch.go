@@ -0,0 +1,133 @@
+package gpio
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+const eventBuffer = 256
+
+// Event is a single edge seen on a watched pin, Edge is either RiseEdge or
+// FallEdge.
+type Event struct {
+	Pin			Pin
+	Edge		Edge
+	Time		time.Time
+}
+
+func (e Event) State() State {
+	if e.Edge == RiseEdge {
+		return High
+	}
+	return Low
+}
+
+type watcher struct {
+	edge		Edge
+	events		chan Event
+	stop		chan struct{}
+}
+
+// watchers keeps the event channels handed out by Watch, a pin can only be
+// watched once at a time.
+type watchers struct {
+	mu			sync.Mutex
+	pins		map[Pin]*watcher
+}
+
+func (w *watchers) add(pin Pin, edge Edge) (*watcher, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pins == nil {
+		w.pins = make(map[Pin]*watcher)
+	}
+	if _, ok := w.pins[pin]; ok {
+		return nil, fmt.Errorf("pin %d is already watched", pin)
+	}
+	watcher := &watcher{edge: edge, events: make(chan Event, eventBuffer), stop: make(chan struct{})}
+	w.pins[pin] = watcher
+	return watcher, nil
+}
+
+func (w *watchers) notify(pin Pin, edge Edge, at time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watcher, ok := w.pins[pin]
+	if !ok || watcher.edge & edge == 0 {
+		return
+	}
+	select {
+	case watcher.events <- Event{pin, edge, at}:
+	default:
+		log.WithFields(log.Fields{"pin": pin, "edge": EdgeStrings[edge]}).Warn("gpio: event dropped, the watcher is too slow")
+	}
+}
+
+func (w *watchers) remove(pin Pin) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if watcher, ok := w.pins[pin]; ok {
+		close(watcher.stop)
+		close(watcher.events)
+		delete(w.pins, pin)
+	}
+}
+
+func (w *watchers) removeAll() {
+	w.mu.Lock()
+	pins := make([]Pin, 0, len(w.pins))
+	for pin := range w.pins {
+		pins = append(pins, pin)
+	}
+	w.mu.Unlock()
+
+	for _, pin := range pins {
+		w.remove(pin)
+	}
+}
+
+// sampleEdges emulates edge events for backends without interrupts by
+// reading the pin on every tick until the watcher is removed.
+func (w *watchers) sampleEdges(pin Pin, stop <-chan struct{}, every time.Duration, read func(Pin) State) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	last := read(pin)
+	for {
+		select {
+		case now := <-ticker.C:
+			state := read(pin)
+			if state == last {
+				continue
+			}
+			last = state
+			if state == High {
+				w.notify(pin, RiseEdge, now)
+			} else {
+				w.notify(pin, FallEdge, now)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Debouncer filters the events of a bouncing contact, an edge is dropped
+// when it comes less than Interval after the last accepted one.
+type Debouncer struct {
+	Interval	time.Duration
+	last		time.Time
+}
+
+func (d *Debouncer) Accept(event Event) bool {
+	if d.Interval > 0 && !d.last.IsZero() && event.Time.Sub(d.last) < d.Interval {
+		return false
+	}
+	d.last = event.Time
+	return true
+}
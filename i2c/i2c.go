@@ -0,0 +1,23 @@
+package i2c
+
+// Bus is an I2C bus, Tx writes w then reads len(r) bytes from the device at
+// addr in a single transaction (repeated start). Either buffer may be empty.
+type Bus interface {
+	Tx(addr uint16, w, r []byte) error
+	Close() error
+}
+
+// Device is a device at a fixed address on a bus, with the register helpers
+// most sensors need.
+type Device struct {
+	Bus			Bus
+	Addr		uint16
+}
+
+func (d *Device) ReadReg(reg byte, buf []byte) error {
+	return d.Bus.Tx(d.Addr, []byte{reg}, buf)
+}
+
+func (d *Device) WriteReg(reg byte, data ...byte) error {
+	return d.Bus.Tx(d.Addr, append([]byte{reg}, data...), nil)
+}
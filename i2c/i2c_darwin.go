@@ -0,0 +1,7 @@
+package i2c
+
+import "errors"
+
+func Open(bus int) (Bus, error) {
+	return nil, errors.New("i2c: not supported on this platform")
+}
@@ -0,0 +1,78 @@
+package i2c
+
+import (
+	"os"
+	"fmt"
+	"unsafe"
+	"runtime"
+	"syscall"
+)
+
+// see include/uapi/linux/i2c-dev.h and i2c.h
+const (
+	i2cRdwr = 0x0707
+	i2cMsgRead = 0x0001
+)
+
+type i2cMsg struct {
+	addr		uint16
+	flags		uint16
+	len			uint16
+	buf			uintptr
+}
+
+type i2cRdwrData struct {
+	msgs		uintptr
+	nmsgs		uint32
+}
+
+// devBus talks to a /dev/i2c-N device with the I2C_RDWR ioctl.
+type devBus struct {
+	file		*os.File
+}
+
+func Open(bus int) (Bus, error) {
+	file, err := os.OpenFile(fmt.Sprintf("/dev/i2c-%d", bus), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &devBus{file: file}, nil
+}
+
+func (b *devBus) Tx(addr uint16, w, r []byte) error {
+	msgs := make([]i2cMsg, 0, 2)
+	if len(w) > 0 {
+		msgs = append(msgs, i2cMsg{addr: addr, len: uint16(len(w)), buf: uintptr(unsafe.Pointer(&w[0]))})
+	}
+	if len(r) > 0 {
+		msgs = append(msgs, i2cMsg{addr: addr, flags: i2cMsgRead, len: uint16(len(r)), buf: uintptr(unsafe.Pointer(&r[0]))})
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	data := i2cRdwrData{msgs: uintptr(unsafe.Pointer(&msgs[0])), nmsgs: uint32(len(msgs))}
+
+	conn, err := b.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, i2cRdwr, uintptr(unsafe.Pointer(&data)))
+	})
+	// the buffers are only referenced through uintptr by the messages
+	runtime.KeepAlive(w)
+	runtime.KeepAlive(r)
+	runtime.KeepAlive(msgs)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return fmt.Errorf("i2c: transaction with 0x%02x failed: %s", addr, errno)
+	}
+	return nil
+}
+
+func (b *devBus) Close() error {
+	return b.file.Close()
+}
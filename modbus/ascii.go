@@ -0,0 +1,116 @@
+package modbus
+
+import (
+	"io"
+	"time"
+	"bytes"
+	"context"
+	"strings"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// asciiMaxFrame is the largest ASCII frame between the colon and the end
+	// of line: address, 253 bytes of PDU and LRC, hex encoded.
+	asciiMaxFrame = 2 * 255
+
+	// asciiCharTimeout drops a frame left incomplete.
+	asciiCharTimeout = time.Second
+)
+
+// lrc is the two's complement of the sum of the bytes, the bytes of a valid
+// frame with its LRC sum up to 0.
+func lrc(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+// asciiFrame encodes a response between a colon and eol, upper case as the
+// specification requires.
+func asciiFrame(unit uint8, pdu []byte, eol string) []byte {
+	frame := append([]byte{unit}, pdu...)
+	frame = append(frame, lrc(frame))
+	return []byte(":" + strings.ToUpper(hex.EncodeToString(frame)) + eol)
+}
+
+// ServeASCII answers the ASCII frames of a serial port until ctx is done,
+// which closes the port. A frame starts with a colon and ends with eol, its
+// bytes are hex encoded and checked by their LRC. The frames addressed to an
+// unknown unit are dropped and the broadcasts are not answered.
+func (s *Server) ServeASCII(ctx context.Context, port io.ReadWriteCloser, eol string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks, errs := readSerial(ctx, port)
+	timer := time.NewTimer(asciiCharTimeout)
+	timer.Stop()
+	defer timer.Stop()
+
+	var buf []byte
+	started := false
+	for {
+		select {
+		case chunk := <-chunks:
+			for _, c := range chunk {
+				switch {
+				case c == ':':
+					// a colon always starts a new frame
+					buf, started = buf[:0], true
+				case !started:
+				case len(buf) > asciiMaxFrame + len(eol):
+					s.count(func(c *SerialCounters) { c.Overruns++ })
+					log.Debugf("modbus: ascii frame overrun, dropping %d bytes", len(buf))
+					buf, started = buf[:0], false
+				default:
+					buf = append(buf, c)
+					if !bytes.HasSuffix(buf, []byte(eol)) {
+						continue
+					}
+					if err := s.serveASCIIFrame(port, buf[:len(buf) - len(eol)], eol); err != nil {
+						return err
+					}
+					buf, started = buf[:0], false
+				}
+			}
+			timer.Reset(asciiCharTimeout)
+		case <-timer.C:
+			if started {
+				log.Debugf("modbus: dropping an incomplete ascii frame %q", buf)
+				buf, started = buf[:0], false
+			}
+		case err := <-errs:
+			if ctx.Err() != nil || err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Server) serveASCIIFrame(port io.Writer, encoded []byte, eol string) error {
+	frame := make([]byte, hex.DecodedLen(len(encoded)))
+	_, err := hex.Decode(frame, encoded)
+	if err != nil || len(frame) < 3 || lrc(frame) != 0 {
+		s.count(func(c *SerialCounters) { c.BusErrors++ })
+		log.Debugf("modbus: dropping an invalid ascii frame %q", encoded)
+		return nil
+	}
+
+	req := &Request{
+		Unit: frame[0],
+		Function: frame[1],
+		Data: frame[2:len(frame)-1],
+		Broadcast: frame[0] == 0,
+	}
+	response := s.serveSerial(req)
+	if response == nil {
+		return nil
+	}
+	_, err = port.Write(asciiFrame(req.Unit, response, eol))
+	return err
+}
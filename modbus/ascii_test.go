@@ -0,0 +1,107 @@
+package modbus
+
+import (
+	"net"
+	"time"
+	"bytes"
+	"context"
+	"testing"
+)
+
+// serveASCII runs ServeASCII on one end of a pipe and returns the other.
+func serveASCII(t *testing.T, s *Server, eol string) net.Conn {
+	client, port := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeASCII(ctx, port, eol)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("ServeASCII: %s", err)
+		}
+		client.Close()
+	})
+	return client
+}
+
+// asciiExchange writes the parts of a request and reads the response, want
+// being empty when none is expected.
+func asciiExchange(t *testing.T, conn net.Conn, want []byte, parts ...[]byte) {
+	t.Helper()
+	for _, part := range parts {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout := time.Second
+	if len(want) == 0 {
+		timeout = 100 * time.Millisecond
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	got := make([]byte, 0, len(want))
+	buf := make([]byte, 256)
+	for len(got) < len(want) || len(want) == 0 {
+		n, err := conn.Read(buf)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("response %q, want %q", got, want)
+	}
+}
+
+func TestServeASCII(t *testing.T) {
+	s := NewServer(&testHandler{})
+	conn := serveASCII(t, s, "\r\n")
+	request := asciiFrame(1, decodeHex(t, "0300000001"), "\r\n")
+	response := asciiFrame(1, decodeHex(t, "03021234"), "\r\n")
+	if string(request) != ":010300000001FB\r\n" {
+		t.Errorf("request frame %q", request)
+	}
+
+	asciiExchange(t, conn, response, request)
+	asciiExchange(t, conn, response, request[:4], request[4:11], request[11:])
+
+	// the lrc is checked
+	bad := append([]byte(nil), request...)
+	bad[len(bad) - 3] = 'C'
+	asciiExchange(t, conn, nil, bad)
+	asciiExchange(t, conn, nil, []byte(":01030000001\r\n"))
+
+	// a colon restarts the frame
+	asciiExchange(t, conn, response, []byte(":0103"), request)
+	asciiExchange(t, conn, response, []byte("0001FB\r\n"), request)
+
+	// an overrun drops the frame up to the next colon
+	asciiExchange(t, conn, nil, append([]byte(":"), bytes.Repeat([]byte("0"), asciiMaxFrame + 10)...), []byte("FB\r\n"))
+	asciiExchange(t, conn, response, request)
+
+	want := SerialCounters{BusMessages: 5, BusErrors: 2, SlaveMessages: 5, Overruns: 1}
+	if got := s.SerialCounters(); got != want {
+		t.Errorf("counters %+v, want %+v", got, want)
+	}
+}
+
+func TestServeASCIIEndOfLine(t *testing.T) {
+	s := NewServer(&testHandler{})
+	conn := serveASCII(t, s, "\n")
+
+	// the responses end with the configured eol
+	asciiExchange(t, conn, []byte(":0103021234B4\n"), []byte(":010300000001FB\n"))
+	// the carriage return of another eol is read as a part of the frame
+	asciiExchange(t, conn, nil, []byte(":010300000001FB\r\n"))
+
+	want := SerialCounters{BusMessages: 1, BusErrors: 1, SlaveMessages: 1}
+	if got := s.SerialCounters(); got != want {
+		t.Errorf("counters %+v, want %+v", got, want)
+	}
+}
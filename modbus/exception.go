@@ -0,0 +1,46 @@
+package modbus
+
+import (
+	"fmt"
+	"errors"
+)
+
+// Exception is a Modbus exception code, handlers return it as an error to
+// answer with an exception response.
+type Exception uint8
+
+const (
+	IllegalFunction						Exception = 0x01
+	IllegalDataAddress					Exception = 0x02
+	IllegalDataValue					Exception = 0x03
+	SlaveDeviceFailure					Exception = 0x04
+	Acknowledge							Exception = 0x05
+	SlaveDeviceBusy						Exception = 0x06
+	MemoryParityError					Exception = 0x08
+	GatewayPathUnavailable				Exception = 0x0a
+	GatewayTargetDeviceFailedToRespond	Exception = 0x0b
+)
+
+var exceptionStrings = map[Exception]string {
+	IllegalFunction: "illegal function",
+	IllegalDataAddress: "illegal data address",
+	IllegalDataValue: "illegal data value",
+	SlaveDeviceFailure: "slave device failure",
+	Acknowledge: "acknowledge",
+	SlaveDeviceBusy: "slave device busy",
+	MemoryParityError: "memory parity error",
+	GatewayPathUnavailable: "gateway path unavailable",
+	GatewayTargetDeviceFailedToRespond: "gateway target device failed to respond",
+}
+
+func (e Exception) Error() string {
+	if str, ok := exceptionStrings[e]; ok {
+		return "modbus: " + str
+	}
+	return fmt.Sprintf("modbus: exception 0x%02x", uint8(e))
+}
+
+// ErrUnknownUnit is returned by a handler for a request addressed to a unit
+// it does not serve. The TCP transport answers it with a gateway exception,
+// the serial ones stay silent as another slave of the bus may answer.
+var ErrUnknownUnit = errors.New("modbus: unknown unit")
@@ -2,20 +2,77 @@ package modbus
 
 import (
 	"encoding/binary"
-	"github.com/tbrandon/mbserver"
 )
 
-func RegisterAddressAndNumber(frame mbserver.Framer) (register int, numRegs int, endRegister int) {
-	data := frame.GetData()
-	register = int(binary.BigEndian.Uint16(data[0:2]))
-	numRegs = int(binary.BigEndian.Uint16(data[2:4]))
+func RegisterAddressAndNumber(req *Request) (register int, numRegs int, endRegister int) {
+	register = int(binary.BigEndian.Uint16(req.Data[0:2]))
+	numRegs = int(binary.BigEndian.Uint16(req.Data[2:4]))
 	endRegister = register + numRegs
 	return register, numRegs, endRegister
 }
 
-func RegisterAddressAndValue(frame mbserver.Framer) (int, uint16) {
-	data := frame.GetData()
-	register := int(binary.BigEndian.Uint16(data[0:2]))
-	value := binary.BigEndian.Uint16(data[2:4])
+func RegisterAddressAndValue(req *Request) (int, uint16) {
+	register := int(binary.BigEndian.Uint16(req.Data[0:2]))
+	value := binary.BigEndian.Uint16(req.Data[2:4])
 	return register, value
 }
+
+func BytesToUint16(bytes []byte) []uint16 {
+	values := make([]uint16, len(bytes)/2)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(bytes[i*2:(i+1)*2])
+	}
+	return values
+}
+
+// checkRequest validates the length and quantity of the standard functions,
+// the handlers can then index the data of a request.
+func checkRequest(req *Request) error {
+	data := req.Data
+	switch req.Function {
+	case 0x01, 0x02, 0x03, 0x04:
+		if len(data) != 4 {
+			return IllegalDataValue
+		}
+		max := 2000
+		if req.Function >= 0x03 {
+			max = 125
+		}
+		if quantity := int(binary.BigEndian.Uint16(data[2:4])); quantity < 1 || quantity > max {
+			return IllegalDataValue
+		}
+	case 0x05, 0x06:
+		if len(data) != 4 {
+			return IllegalDataValue
+		}
+	case 0x0f, 0x10:
+		if len(data) < 5 || len(data) != 5 + int(data[4]) {
+			return IllegalDataValue
+		}
+		quantity := int(binary.BigEndian.Uint16(data[2:4]))
+		size := 2 * quantity
+		if req.Function == 0x0f {
+			size = (quantity + 7) / 8
+		}
+		if quantity < 1 || quantity > 1968 || (req.Function == 0x10 && quantity > 123) || int(data[4]) != size {
+			return IllegalDataValue
+		}
+	}
+	return nil
+}
+
+// crc16 is the CRC of the serial frames, sent low byte first.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc & 1 != 0 {
+				crc = crc >> 1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
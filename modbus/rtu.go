@@ -0,0 +1,181 @@
+package modbus
+
+import (
+	"io"
+	"time"
+	"context"
+	"encoding/binary"
+	"github.com/goburrow/serial"
+	log "github.com/sirupsen/logrus"
+)
+
+// rtuMaxFrame is the largest RTU frame: address, 253 bytes of PDU and CRC.
+const rtuMaxFrame = 256
+
+// rtuSilence returns the 3.5 characters of silence ending an RTU frame, a
+// character being 11 bits. Above 19200 bauds it is fixed to 1.75ms.
+func rtuSilence(baudRate int) time.Duration {
+	if baudRate <= 0 || baudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return time.Duration(3.5 * 11 * float64(time.Second) / float64(baudRate))
+}
+
+// rtuRequestLength returns the length of the request frame starting buf from
+// its function code, 0 when it is not known yet or depends on the silence.
+func rtuRequestLength(buf []byte) int {
+	if len(buf) < 2 {
+		return 0
+	}
+	switch buf[1] {
+	case 0x07, 0x0b, 0x0c, 0x11:
+		return 4
+	case 0x18:
+		return 6
+	case 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x08:
+		return 8
+	case 0x16:
+		return 10
+	case 0x0f, 0x10:
+		if len(buf) > 6 {
+			return 9 + int(buf[6])
+		}
+	case 0x14, 0x15:
+		if len(buf) > 2 {
+			return 5 + int(buf[2])
+		}
+	case 0x17:
+		if len(buf) > 10 {
+			return 13 + int(buf[10])
+		}
+	}
+	return 0
+}
+
+func rtuValid(frame []byte) bool {
+	n := len(frame)
+	return n >= 4 && crc16(frame[:n-2]) == binary.LittleEndian.Uint16(frame[n-2:])
+}
+
+func rtuFrame(unit uint8, pdu []byte) []byte {
+	frame := make([]byte, 0, len(pdu) + 3)
+	frame = append(append(frame, unit), pdu...)
+	crc := crc16(frame)
+	return append(frame, byte(crc), byte(crc >> 8))
+}
+
+// ServeRTU answers the RTU frames of a serial port until ctx is done, which
+// closes the port. A frame ends after 3.5 characters of silence at baudRate,
+// or as soon as the length given by its function code is received with a
+// valid CRC, so merged requests are split. The frames addressed to an
+// unknown unit are dropped and the broadcasts are not answered.
+func (s *Server) ServeRTU(ctx context.Context, port io.ReadWriteCloser, baudRate int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks, errs := readSerial(ctx, port)
+	silence := rtuSilence(baudRate)
+	timer := time.NewTimer(silence)
+	timer.Stop()
+	defer timer.Stop()
+
+	var buf []byte
+	overrun := false
+	for {
+		select {
+		case chunk := <-chunks:
+			if overrun {
+				timer.Reset(silence)
+				continue
+			}
+			buf = append(buf, chunk...)
+			for {
+				n := rtuRequestLength(buf)
+				if n == 0 || len(buf) < n || !rtuValid(buf[:n]) {
+					break
+				}
+				if err := s.serveRTUFrame(port, buf[:n]); err != nil {
+					return err
+				}
+				buf = buf[n:]
+			}
+			if len(buf) > rtuMaxFrame {
+				s.count(func(c *SerialCounters) { c.Overruns++ })
+				log.Debugf("modbus: serial frame overrun, dropping %d bytes", len(buf))
+				buf, overrun = nil, true
+			}
+			timer.Reset(silence)
+		case <-timer.C:
+			overrun = false
+			if len(buf) == 0 {
+				continue
+			}
+			frame := buf
+			buf = nil
+			if !rtuValid(frame) {
+				s.count(func(c *SerialCounters) { c.BusErrors++ })
+				log.Debugf("modbus: dropping an invalid serial frame % x", frame)
+				continue
+			}
+			if err := s.serveRTUFrame(port, frame); err != nil {
+				return err
+			}
+		case err := <-errs:
+			if ctx.Err() != nil || err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// readSerial reads the port from a goroutine, so the chunks can be timed
+// while a read is blocked. The port is closed once ctx is done, which ends
+// the reads.
+func readSerial(ctx context.Context, port io.ReadCloser) (<-chan []byte, <-chan error) {
+	chunks := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		port.Close()
+	}()
+	go func() {
+		for {
+			buffer := make([]byte, rtuMaxFrame)
+			n, err := port.Read(buffer)
+			if err == serial.ErrTimeout {
+				continue
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			if n == 0 {
+				continue
+			}
+			select {
+			case chunks <- buffer[:n]:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return chunks, errs
+}
+
+func (s *Server) serveRTUFrame(port io.Writer, frame []byte) error {
+	req := &Request{
+		Unit: frame[0],
+		Function: frame[1],
+		Data: frame[2:len(frame)-2],
+		Broadcast: frame[0] == 0,
+	}
+	response := s.serveSerial(req)
+	if response == nil {
+		return nil
+	}
+	_, err := port.Write(rtuFrame(req.Unit, response))
+	return err
+}
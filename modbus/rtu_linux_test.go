@@ -0,0 +1,208 @@
+package modbus
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"unsafe"
+	"syscall"
+	"context"
+	"testing"
+	"encoding/hex"
+)
+
+// testBaudRate makes the 3.5 characters of silence 32ms, long enough to be
+// told apart from the scheduling delays.
+const testBaudRate = 1200
+
+func ioctlPty(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPty returns the master and the raw slave of a new pty pair, non
+// blocking so their reads honour the deadlines and are ended by Close.
+func openPty(t *testing.T) (*os.File, *os.File) {
+	flags := syscall.O_RDWR | syscall.O_NOCTTY | syscall.O_NONBLOCK | syscall.O_CLOEXEC
+	master, err := syscall.Open("/dev/ptmx", flags, 0)
+	if err != nil {
+		t.Skipf("no pty: %s", err)
+	}
+	var unlock, n int32
+	if err := ioctlPty(uintptr(master), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioctlPty(uintptr(master), syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		t.Fatal(err)
+	}
+	slavePath := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err := syscall.Open(slavePath, flags, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var termios syscall.Termios
+	if err := ioctlPty(uintptr(slave), syscall.TCGETS, unsafe.Pointer(&termios)); err != nil {
+		t.Fatal(err)
+	}
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag = termios.Cflag &^ (syscall.CSIZE | syscall.PARENB) | syscall.CS8
+	termios.Cc[syscall.VMIN], termios.Cc[syscall.VTIME] = 1, 0
+	if err := ioctlPty(uintptr(slave), syscall.TCSETS, unsafe.Pointer(&termios)); err != nil {
+		t.Fatal(err)
+	}
+	return os.NewFile(uintptr(master), "/dev/ptmx"), os.NewFile(uintptr(slave), slavePath)
+}
+
+// serveRTU runs ServeRTU on the slave of a pty and returns its master.
+func serveRTU(t *testing.T, s *Server) *os.File {
+	master, slave := openPty(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.ServeRTU(ctx, slave, testBaudRate)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("ServeRTU: %s", err)
+		}
+		master.Close()
+	})
+	return master
+}
+
+func writeParts(t *testing.T, port *os.File, gap time.Duration, parts ...[]byte) {
+	t.Helper()
+	for i, part := range parts {
+		if i > 0 {
+			time.Sleep(gap)
+		}
+		if _, err := port.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectResponse reads the bytes of want from port, or checks that nothing
+// comes when want is empty.
+func expectResponse(t *testing.T, port *os.File, want []byte) {
+	t.Helper()
+	if err := port.SetReadDeadline(time.Now().Add(300 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 0, len(want))
+	buf := make([]byte, rtuMaxFrame)
+	for len(got) < len(want) || len(want) == 0 {
+		n, err := port.Read(buf)
+		if os.IsTimeout(err) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if hex.EncodeToString(got) != hex.EncodeToString(want) {
+		t.Errorf("response % x, want % x", got, want)
+	}
+}
+
+func TestServeRTUSplitFrame(t *testing.T) {
+	port := serveRTU(t, NewServer(&testHandler{}))
+	frame := withCRC(t, "010300000001")
+	// the length of the function completes the frame before the silence
+	writeParts(t, port, 5 * time.Millisecond, frame[:1], frame[1:5], frame[5:])
+	expectResponse(t, port, withCRC(t, "0103021234"))
+}
+
+func TestServeRTUSilence(t *testing.T) {
+	handler := &testHandler{}
+	port := serveRTU(t, NewServer(handler))
+	// the length of the function 0x2b is only given by the silence
+	first, second := withCRC(t, "012b0e0100"), withCRC(t, "012b0e0101")
+	writeParts(t, port, 5 * time.Millisecond, first[:3], first[3:])
+	expectResponse(t, port, withCRC(t, "012b021234"))
+	writeParts(t, port, 100 * time.Millisecond, second, withCRC(t, "012b0e0102"))
+	expectResponse(t, port, append(withCRC(t, "012b021234"), withCRC(t, "012b021234")...))
+
+	served := handler.served()
+	if len(served) != 3 {
+		t.Fatalf("%d requests served, want 3", len(served))
+	}
+	for i, req := range served {
+		if got := hex.EncodeToString(req.Data); got != fmt.Sprintf("0e01%02x", i) {
+			t.Errorf("request %d data %s", i, got)
+		}
+	}
+}
+
+func TestServeRTUMergedFrames(t *testing.T) {
+	port := serveRTU(t, NewServer(&testHandler{}))
+	writeParts(t, port, 0, append(withCRC(t, "010300000001"), withCRC(t, "010400000001")...))
+	expectResponse(t, port, append(withCRC(t, "0103021234"), withCRC(t, "0104021234")...))
+}
+
+func TestServeRTUDropped(t *testing.T) {
+	handler := &testHandler{}
+	s := NewServer(handler)
+	port := serveRTU(t, s)
+
+	frame := withCRC(t, "010300000001")
+	frame[len(frame) - 1] ^= 0xff
+	writeParts(t, port, 0, frame)
+	expectResponse(t, port, nil)
+
+	// another slave of the bus
+	writeParts(t, port, 0, withCRC(t, "020300000001"))
+	expectResponse(t, port, nil)
+
+	// the broadcasts are applied without response
+	writeParts(t, port, 0, withCRC(t, "000600010005"))
+	expectResponse(t, port, nil)
+
+	served := handler.served()
+	if len(served) != 2 || served[0].Unit != 2 || !served[1].Broadcast {
+		t.Errorf("served %+v, want the requests of unit 2 and the broadcast", served)
+	}
+
+	writeParts(t, port, 0, withCRC(t, "010300000001"))
+	expectResponse(t, port, withCRC(t, "0103021234"))
+	writeParts(t, port, 0, withCRC(t, "014200"))
+	expectResponse(t, port, withCRC(t, "01c202"))
+
+	want := SerialCounters{BusMessages: 4, BusErrors: 1, Exceptions: 1, SlaveMessages: 3, NoResponses: 1}
+	if got := s.SerialCounters(); got != want {
+		t.Errorf("counters %+v, want %+v", got, want)
+	}
+}
+
+func TestServeRTUDiagnostics(t *testing.T) {
+	port := serveRTU(t, NewServer(&testHandler{}))
+	frame := withCRC(t, "010300000001")
+	frame[len(frame) - 1] ^= 0xff
+	writeParts(t, port, 0, frame)
+	expectResponse(t, port, nil)
+	writeParts(t, port, 0, withCRC(t, "0000000000000000"))
+	expectResponse(t, port, nil)
+
+	tests := []struct {
+		subFunction	string
+		value		string
+	}{
+		{"000b", "0002"}, // the broadcast and this request
+		{"000c", "0001"},
+		{"000e", "0003"},
+		{"000f", "0001"},
+		{"0012", "0000"},
+	}
+	for _, test := range tests {
+		// the test handler leaves the diagnostics to the server
+		writeParts(t, port, 0, withCRC(t, "0108" + test.subFunction + "0000"))
+		expectResponse(t, port, withCRC(t, "0108" + test.subFunction + test.value))
+	}
+}
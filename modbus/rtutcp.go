@@ -0,0 +1,84 @@
+package modbus
+
+import (
+	"io"
+	"net"
+	"time"
+	"context"
+	log "github.com/sirupsen/logrus"
+)
+
+// rtuOverTCPSilence ends the frames whose length is not given by their
+// function code, a stream has no line silence.
+const rtuOverTCPSilence = 100 * time.Millisecond
+
+// ServeRTUOverTCP accepts connections carrying RTU frames, with their CRC and
+// without MBAP header, until ctx is done. As on a serial line the frames for
+// an unknown unit and the broadcasts are not answered, but the serial line
+// counters are left to the serial port.
+func (s *Server) ServeRTUOverTCP(ctx context.Context, listener net.Listener) error {
+	return s.accept(ctx, listener, s.serveRTUConn)
+}
+
+func (s *Server) serveRTUConn(ctx context.Context, conn net.Conn) {
+	var buf []byte
+	chunk := make([]byte, rtuMaxFrame)
+	for {
+		deadline := time.Time{}
+		if len(buf) > 0 {
+			deadline = time.Now().Add(rtuOverTCPSilence)
+		}
+		conn.SetReadDeadline(deadline)
+
+		n, err := conn.Read(chunk)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			frame := buf
+			buf = nil
+			if !rtuValid(frame) {
+				log.WithFields(log.Fields{"remote": conn.RemoteAddr()}).Debugf("modbus: dropping an invalid rtu frame % x", frame)
+				continue
+			}
+			if err := s.serveRTUOverTCPFrame(conn, frame); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.WithFields(log.Fields{"remote": conn.RemoteAddr()}).Debugf("modbus: %s", err)
+			}
+			return
+		}
+
+		buf = append(buf, chunk[:n]...)
+		for {
+			n := rtuRequestLength(buf)
+			if n == 0 || len(buf) < n || !rtuValid(buf[:n]) {
+				break
+			}
+			if err := s.serveRTUOverTCPFrame(conn, buf[:n]); err != nil {
+				return
+			}
+			buf = buf[n:]
+		}
+		if len(buf) > rtuMaxFrame {
+			log.WithFields(log.Fields{"remote": conn.RemoteAddr()}).Debugf("modbus: rtu frame overrun, dropping %d bytes", len(buf))
+			buf = nil
+		}
+	}
+}
+
+func (s *Server) serveRTUOverTCPFrame(conn io.Writer, frame []byte) error {
+	req := &Request{
+		Unit: frame[0],
+		Function: frame[1],
+		Data: frame[2:len(frame)-2],
+		Broadcast: frame[0] == 0,
+	}
+	response, err := s.serve(req)
+	if err != nil || req.Broadcast {
+		return nil
+	}
+	_, err = conn.Write(rtuFrame(req.Unit, response))
+	return err
+}
@@ -0,0 +1,97 @@
+package modbus
+
+import (
+	"net"
+	"time"
+	"bytes"
+	"context"
+	"testing"
+)
+
+// withCRC appends the CRC to a hex encoded frame.
+func withCRC(t *testing.T, frame string) []byte {
+	b := decodeHex(t, frame)
+	return rtuFrame(b[0], b[1:])
+}
+
+// serveRTUConn serves RTU frames on one end of a pipe and returns the other.
+func serveRTUConn(t *testing.T, s *Server) net.Conn {
+	client, server := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.serveRTUConn(ctx, server)
+		server.Close()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+// rtuExchange writes the parts of a request and reads the response, want
+// being empty when none is expected past the silence.
+func rtuExchange(t *testing.T, conn net.Conn, want []byte, parts ...[]byte) {
+	t.Helper()
+	for _, part := range parts {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout := time.Second
+	if len(want) == 0 {
+		timeout = 2 * rtuOverTCPSilence
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	got := make([]byte, 0, len(want))
+	buf := make([]byte, rtuMaxFrame)
+	for len(got) < len(want) || len(want) == 0 {
+		n, err := conn.Read(buf)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("response % x, want % x", got, want)
+	}
+}
+
+func TestServeRTUOverTCP(t *testing.T) {
+	handler := &testHandler{}
+	s := NewServer(handler)
+	conn := serveRTUConn(t, s)
+	request, response := withCRC(t, "010300000001"), withCRC(t, "0103021234")
+
+	rtuExchange(t, conn, response, request)
+	rtuExchange(t, conn, response, request[:1], request[1:5], request[5:])
+	rtuExchange(t, conn, append(append([]byte(nil), response...), response...), append(append([]byte(nil), request...), request...))
+
+	// the length of the function 0x2b is only given by the silence
+	rtuExchange(t, conn, withCRC(t, "012b021234"), withCRC(t, "012b0e0100"))
+
+	bad := append([]byte(nil), request...)
+	bad[len(bad) - 1] ^= 0xff
+	rtuExchange(t, conn, nil, bad)
+	rtuExchange(t, conn, nil, withCRC(t, "020300000001"))
+	rtuExchange(t, conn, nil, withCRC(t, "000600010005"))
+	// a stream has no counters to read
+	rtuExchange(t, conn, withCRC(t, "018801"), withCRC(t, "010800000000"))
+
+	served := handler.served()
+	if len(served) != 8 || served[5].Unit != 2 || !served[6].Broadcast {
+		t.Errorf("served %+v, want 8 requests with unit 2 and a broadcast", served)
+	}
+	// the serial line counters are left to the serial port
+	if got := s.SerialCounters(); got != (SerialCounters{}) {
+		t.Errorf("counters %+v, want none", got)
+	}
+}
@@ -0,0 +1,103 @@
+package modbus
+
+import (
+	"encoding/binary"
+)
+
+// SerialCounters are the diagnostic counters of the serial lines, as read by
+// the sub-functions of the diagnostics function 0x08.
+type SerialCounters struct {
+	BusMessages		uint16	// valid frames seen on the bus
+	BusErrors		uint16	// frames with a bad CRC or LRC
+	Exceptions		uint16	// exception responses
+	SlaveMessages	uint16	// frames addressed to a served unit or broadcast
+	NoResponses		uint16	// served frames left unanswered
+	Overruns		uint16	// frames over the maximum size
+}
+
+// SerialCounters returns a copy of the counters.
+func (s *Server) SerialCounters() SerialCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters
+}
+
+func (s *Server) count(fn func(*SerialCounters)) {
+	s.mu.Lock()
+	fn(&s.counters)
+	s.mu.Unlock()
+}
+
+// serveSerial answers a request received on a serial line and returns the
+// response PDU, nil when there is none. The diagnostics function goes
+// through the handler first, so it only answers the served units, and then
+// falls back to the counters when the handler doesn't implement it.
+func (s *Server) serveSerial(req *Request) []byte {
+	s.count(func(c *SerialCounters) { c.BusMessages++ })
+
+	response, err := s.serve(req)
+	if err == ErrUnknownUnit {
+		return nil
+	}
+	if req.Function == 0x08 && len(response) == 2 && response[1] == byte(IllegalFunction) {
+		response = s.diagnostics(req)
+	}
+
+	s.count(func(c *SerialCounters) {
+		c.SlaveMessages++
+		if response[0] & 0x80 != 0 {
+			c.Exceptions++
+		}
+		if req.Broadcast {
+			c.NoResponses++
+		}
+	})
+	if req.Broadcast {
+		return nil
+	}
+	return response
+}
+
+// diagnostics answers the sub-functions of the function 0x08 reading the
+// serial line counters.
+func (s *Server) diagnostics(req *Request) []byte {
+	if len(req.Data) < 2 {
+		return responsePDU(req.Function, nil, IllegalDataValue)
+	}
+	subFunction := binary.BigEndian.Uint16(req.Data[0:2])
+	if subFunction == 0x00 {
+		// return query data
+		return responsePDU(req.Function, req.Data, nil)
+	}
+	if len(req.Data) != 4 {
+		return responsePDU(req.Function, nil, IllegalDataValue)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var value uint16
+	switch subFunction {
+	case 0x0a:
+		s.counters = SerialCounters{}
+	case 0x0b:
+		value = s.counters.BusMessages
+	case 0x0c:
+		value = s.counters.BusErrors
+	case 0x0d:
+		value = s.counters.Exceptions
+	case 0x0e:
+		value = s.counters.SlaveMessages
+	case 0x0f:
+		value = s.counters.NoResponses
+	case 0x10, 0x11:
+		// no NAK nor busy responses
+	case 0x12:
+		value = s.counters.Overruns
+	default:
+		return responsePDU(req.Function, nil, IllegalFunction)
+	}
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data[0:2], subFunction)
+	binary.BigEndian.PutUint16(data[2:4], value)
+	return responsePDU(req.Function, data, nil)
+}
@@ -0,0 +1,83 @@
+// Package modbus implements the slave side of Modbus over TCP and serial
+// lines, the requests being answered by a Handler.
+package modbus
+
+import (
+	"sync"
+	log "github.com/sirupsen/logrus"
+)
+
+// Request is a request PDU with the unit it is addressed to, Broadcast is set
+// for the serial broadcasts which get no response. Role is the role of the
+// client certificate on a TLS connection, empty on the other transports.
+type Request struct {
+	Unit		uint8
+	Function	uint8
+	Data		[]byte
+	Broadcast	bool
+	Role		string
+}
+
+// Handler answers the requests of a server with the data of the response, or
+// an error: an Exception, ErrUnknownUnit, anything else being reported as a
+// slave device failure. It is called concurrently by the connections.
+type Handler interface {
+	ServeModbus(req *Request) ([]byte, error)
+}
+
+// UnitHandler is implemented by the handlers knowing the units they serve,
+// a request to another unit is then dropped before being validated, so a
+// slave never answers the malformed frames addressed to the other ones.
+type UnitHandler interface {
+	Handler
+	ServesUnit(unit uint8) bool
+}
+
+// HandlerFunc adapts a function to the Handler interface.
+type HandlerFunc func(req *Request) ([]byte, error)
+
+func (f HandlerFunc) ServeModbus(req *Request) ([]byte, error) {
+	return f(req)
+}
+
+// Server serves a handler over any number of transports, each Serve method
+// runs until its context is done.
+type Server struct {
+	handler		Handler
+
+	mu			sync.Mutex
+	counters	SerialCounters
+}
+
+func NewServer(handler Handler) *Server {
+	return &Server{handler: handler}
+}
+
+// serve runs a request through the handler and returns the response PDU,
+// ErrUnknownUnit is passed to the transport.
+func (s *Server) serve(req *Request) ([]byte, error) {
+	if units, ok := s.handler.(UnitHandler); ok && !req.Broadcast && !units.ServesUnit(req.Unit) {
+		return nil, ErrUnknownUnit
+	}
+	var data []byte
+	err := checkRequest(req)
+	if err == nil {
+		data, err = s.handler.ServeModbus(req)
+	}
+	if err == ErrUnknownUnit {
+		return nil, err
+	}
+	return responsePDU(req.Function, data, err), nil
+}
+
+func responsePDU(function uint8, data []byte, err error) []byte {
+	if err == nil {
+		return append([]byte{function}, data...)
+	}
+	exception, ok := err.(Exception)
+	if !ok {
+		log.Warnf("modbus: function 0x%02x failed: %s", function, err)
+		exception = SlaveDeviceFailure
+	}
+	return []byte{function | 0x80, byte(exception)}
+}
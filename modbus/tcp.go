@@ -0,0 +1,162 @@
+package modbus
+
+import (
+	"io"
+	"errors"
+	"net"
+	"sync"
+	"bufio"
+	"context"
+	"encoding/binary"
+	log "github.com/sirupsen/logrus"
+)
+
+// mbapHeader is the header of a Modbus TCP frame, the length counts the unit
+// and the PDU.
+type mbapHeader struct {
+	transaction		uint16
+	protocol		uint16
+	length			uint16
+	unit			uint8
+}
+
+const mbapHeaderSize = 7
+
+var errFrameLength = errors.New("modbus: invalid frame length")
+
+// readMBAP reads a whole frame whatever the segmentation of the stream.
+func readMBAP(r io.Reader) (mbapHeader, []byte, error) {
+	var buf [mbapHeaderSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return mbapHeader{}, nil, err
+	}
+	header := mbapHeader{
+		transaction: binary.BigEndian.Uint16(buf[0:2]),
+		protocol: binary.BigEndian.Uint16(buf[2:4]),
+		length: binary.BigEndian.Uint16(buf[4:6]),
+		unit: buf[6],
+	}
+	// a PDU holds 1 to 253 bytes
+	if header.length < 2 || header.length > 254 {
+		return header, nil, errFrameLength
+	}
+	pdu := make([]byte, header.length - 1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return header, nil, err
+	}
+	return header, pdu, nil
+}
+
+func (h mbapHeader) frame(pdu []byte) []byte {
+	frame := make([]byte, mbapHeaderSize, mbapHeaderSize + len(pdu))
+	binary.BigEndian.PutUint16(frame[0:2], h.transaction)
+	binary.BigEndian.PutUint16(frame[2:4], h.protocol)
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(pdu) + 1))
+	frame[6] = h.unit
+	return append(frame, pdu...)
+}
+
+// ServeTCP accepts connections on listener until ctx is done, each one being
+// served by its own goroutine. The listener and connections are closed and
+// waited for before returning, the error is nil unless accepting failed.
+func (s *Server) ServeTCP(ctx context.Context, listener net.Listener) error {
+	return s.accept(ctx, listener, func(ctx context.Context, conn net.Conn) {
+		s.serveConn(ctx, conn, "")
+	})
+}
+
+func (s *Server) accept(ctx context.Context, listener net.Listener, serve func(context.Context, net.Conn)) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				log.Warnf("modbus: accept failed: %s", err)
+				continue
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer closeOnDone(ctx, conn)()
+
+			remote := conn.RemoteAddr()
+			log.WithFields(log.Fields{"remote": remote}).Debug("modbus: connection opened")
+			serve(ctx, conn)
+			log.WithFields(log.Fields{"remote": remote}).Debug("modbus: connection closed")
+		}()
+	}
+}
+
+// closeOnDone closes conn once ctx is done or the returned function called,
+// which unblocks its reads.
+func closeOnDone(ctx context.Context, conn io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// serveConn answers the frames of a connection in order until it is closed by
+// the client, on a framing error or when ctx is done. The requests carry the
+// role of the client.
+func (s *Server) serveConn(ctx context.Context, conn net.Conn, role string) {
+	reader := bufio.NewReader(conn)
+	for {
+		header, pdu, err := readMBAP(reader)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.WithFields(log.Fields{"remote": conn.RemoteAddr()}).Debugf("modbus: %s", err)
+			}
+			return
+		}
+		response := s.serveMBAP(header, pdu, role)
+		if response == nil {
+			continue
+		}
+		if _, err := conn.Write(response); err != nil {
+			if ctx.Err() == nil {
+				log.WithFields(log.Fields{"remote": conn.RemoteAddr()}).Debugf("modbus: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// serveMBAP answers a Modbus TCP frame, an unknown unit gets a gateway
+// exception. It returns nil for the frames of other protocols, which are
+// silently discarded.
+func (s *Server) serveMBAP(header mbapHeader, pdu []byte, role string) []byte {
+	if header.protocol != 0 {
+		return nil
+	}
+	req := &Request{Unit: header.unit, Function: pdu[0], Data: pdu[1:], Role: role}
+	response, err := s.serve(req)
+	if err == ErrUnknownUnit {
+		response = []byte{req.Function | 0x80, byte(GatewayTargetDeviceFailedToRespond)}
+	}
+	return header.frame(response)
+}
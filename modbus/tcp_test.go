@@ -0,0 +1,273 @@
+package modbus
+
+import (
+	"io"
+	"net"
+	"sync"
+	"bytes"
+	"errors"
+	"testing"
+	"context"
+	"encoding/hex"
+	"encoding/binary"
+)
+
+// testHandler answers every request of unit 1 with 2 bytes of data and
+// records them, function 0x41 fails with a plain error and 0x42 with an
+// exception, the diagnostics are not implemented. The other units are
+// unknown.
+type testHandler struct {
+	mu			sync.Mutex
+	requests	[]Request
+}
+
+func (h *testHandler) ServeModbus(req *Request) ([]byte, error) {
+	h.mu.Lock()
+	h.requests = append(h.requests, *req)
+	h.mu.Unlock()
+	switch {
+	case req.Unit != 1 && !req.Broadcast:
+		return nil, ErrUnknownUnit
+	case req.Function == 0x41:
+		return nil, errors.New("failed")
+	case req.Function == 0x42:
+		return nil, IllegalDataAddress
+	case req.Function == 0x08:
+		return nil, IllegalFunction
+	}
+	return []byte{0x02, 0x12, 0x34}, nil
+}
+
+func (h *testHandler) served() []Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Request(nil), h.requests...)
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// pipeConn serves the server end of a net.Pipe, closed as accept does once
+// serveConn returns, and returns the client end.
+func pipeConn(t *testing.T, s *Server) net.Conn {
+	client, server := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.serveConn(ctx, server, "")
+		server.Close()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+func readFrame(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	header := make([]byte, mbapHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("reading the response header: %s", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[4:6]) - 1)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatalf("reading the response: %s", err)
+	}
+	return append(header, body...)
+}
+
+func TestServeConnSplitFrame(t *testing.T) {
+	conn := pipeConn(t, NewServer(&testHandler{}))
+	request := decodeHex(t, "000100000006010300000001")
+	for _, part := range [][]byte{request[:3], request[3:7], request[7:8], request[8:]} {
+		if _, err := conn.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := readFrame(t, conn), decodeHex(t, "0001000000050103021234"); !bytes.Equal(got, want) {
+		t.Errorf("response % x, want % x", got, want)
+	}
+}
+
+func TestServeConnCoalescedFrames(t *testing.T) {
+	handler := &testHandler{}
+	conn := pipeConn(t, NewServer(handler))
+	frames := decodeHex(t, "000100000006010300000001" + "000200000006010400100002")
+	go conn.Write(frames)
+
+	for _, want := range []string{"0001000000050103021234", "0002000000050104021234"} {
+		got := readFrame(t, conn)
+		if hex.EncodeToString(got) != want {
+			t.Errorf("response % x, want %s", got, want)
+		}
+	}
+	if n := len(handler.served()); n != 2 {
+		t.Errorf("%d requests served, want 2", n)
+	}
+}
+
+func TestServeConnInvalidLength(t *testing.T) {
+	for _, length := range []uint16{0, 1, 255, 0xffff} {
+		conn := pipeConn(t, NewServer(&testHandler{}))
+		frame := decodeHex(t, "00010000000001")
+		binary.BigEndian.PutUint16(frame[4:6], length)
+		go conn.Write(append(frame, make([]byte, 8)...))
+		// the framing is lost, the connection is closed
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err != io.EOF {
+			t.Errorf("length %d: read %v, want the connection closed", length, err)
+		}
+	}
+}
+
+func TestServeConnProtocol(t *testing.T) {
+	handler := &testHandler{}
+	conn := pipeConn(t, NewServer(handler))
+	go conn.Write(decodeHex(t, "000100010006010300000001" + "000200000006010300000001"))
+
+	// the first frame is discarded, the connection keeps going
+	got := readFrame(t, conn)
+	if transaction := binary.BigEndian.Uint16(got[0:2]); transaction != 2 {
+		t.Errorf("answered transaction %d, want 2", transaction)
+	}
+	if n := len(handler.served()); n != 1 {
+		t.Errorf("%d requests served, want 1", n)
+	}
+}
+
+func TestServeConnExceptions(t *testing.T) {
+	tests := []struct {
+		name		string
+		request		string
+		response	string
+	}{
+		{"read 125 registers", "01030000007d", "0103021234"},
+		{"read 126 registers", "01030000007e", "018303"},
+		{"handler exception", "0142", "01c202"},
+		{"handler error", "0141", "01c104"},
+		{"unknown unit", "090300000001", "09830b"},
+	}
+	conn := pipeConn(t, NewServer(&testHandler{}))
+	for i, test := range tests {
+		pdu := decodeHex(t, test.request)
+		frame := make([]byte, mbapHeaderSize - 1, mbapHeaderSize - 1 + len(pdu))
+		binary.BigEndian.PutUint16(frame[0:2], uint16(i))
+		binary.BigEndian.PutUint16(frame[4:6], uint16(len(pdu)))
+		go conn.Write(append(frame, pdu...))
+
+		got := hex.EncodeToString(readFrame(t, conn)[6:])
+		if got != test.response {
+			t.Errorf("%s: response %s, want %s", test.name, got, test.response)
+		}
+	}
+}
+
+// writeRequest builds the data of a write multiple request of quantity
+// values with count bytes.
+func writeRequest(quantity int, count int) []byte {
+	data := make([]byte, 5 + count)
+	binary.BigEndian.PutUint16(data[2:4], uint16(quantity))
+	data[4] = byte(count)
+	return data
+}
+
+func TestCheckRequest(t *testing.T) {
+	read := func(quantity int) []byte {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint16(data[2:4], uint16(quantity))
+		return data
+	}
+	tests := []struct {
+		name		string
+		function	uint8
+		data		[]byte
+		err			error
+	}{
+		{"read coils", 0x01, read(2000), nil},
+		{"read coils over 2000", 0x01, read(2001), IllegalDataValue},
+		{"read discrete inputs", 0x02, read(2000), nil},
+		{"read discrete inputs over 2000", 0x02, read(2001), IllegalDataValue},
+		{"read no coil", 0x01, read(0), IllegalDataValue},
+		{"read holding registers", 0x03, read(125), nil},
+		{"read holding registers over 125", 0x03, read(126), IllegalDataValue},
+		{"read input registers over 125", 0x04, read(126), IllegalDataValue},
+		{"read no register", 0x04, read(0), IllegalDataValue},
+		{"read short", 0x03, []byte{0, 0, 0}, IllegalDataValue},
+		{"read long", 0x03, []byte{0, 0, 0, 1, 0}, IllegalDataValue},
+		{"write single coil", 0x05, []byte{0, 1, 0xff, 0}, nil},
+		{"write single coil short", 0x05, []byte{0, 1, 0xff}, IllegalDataValue},
+		{"write single register long", 0x06, []byte{0, 1, 0, 0, 0}, IllegalDataValue},
+		{"write coils", 0x0f, writeRequest(1968, 246), nil},
+		{"write coils over 1968", 0x0f, writeRequest(1969, 247), IllegalDataValue},
+		{"write no coil", 0x0f, writeRequest(0, 0), IllegalDataValue},
+		{"write coils byte count", 0x0f, writeRequest(9, 1), IllegalDataValue},
+		{"write registers", 0x10, writeRequest(123, 246), nil},
+		{"write registers over 123", 0x10, writeRequest(124, 248), IllegalDataValue},
+		{"write registers byte count", 0x10, writeRequest(2, 2), IllegalDataValue},
+		{"write registers short", 0x10, []byte{0, 0, 0, 1}, IllegalDataValue},
+		{"write registers truncated", 0x10, writeRequest(2, 4)[:8], IllegalDataValue},
+		{"other function", 0x2b, nil, nil},
+	}
+	for _, test := range tests {
+		err := checkRequest(&Request{Unit: 1, Function: test.function, Data: test.data})
+		if err != test.err {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+// unitHandler serves the requests of unit 1 and tells the other units apart.
+type unitHandler struct {
+	testHandler
+}
+
+func (h *unitHandler) ServesUnit(unit uint8) bool {
+	return unit == 1
+}
+
+func TestServeUnknownUnit(t *testing.T) {
+	handler := &unitHandler{}
+	s := NewServer(handler)
+
+	// a malformed frame of another unit isn't validated
+	tests := []struct {
+		name		string
+		unit		uint8
+		request		string
+		tcp			string
+	}{
+		{"unknown unit", 9, "0300000000", "830b"},
+		{"unknown unit short", 9, "03000000", "830b"},
+		{"served unit", 1, "0300000000", "8303"},
+	}
+	for _, test := range tests {
+		pdu := decodeHex(t, test.request)
+		response := s.serveMBAP(mbapHeader{unit: test.unit, length: uint16(len(pdu) + 1)}, pdu, "")
+		if got := hex.EncodeToString(response[mbapHeaderSize:]); got != test.tcp {
+			t.Errorf("%s: tcp response %s, want %s", test.name, got, test.tcp)
+		}
+
+		response = s.serveSerial(&Request{Unit: test.unit, Function: pdu[0], Data: pdu[1:]})
+		if test.unit != 1 && response != nil {
+			t.Errorf("%s: serial response % x, want none", test.name, response)
+		}
+		if test.unit == 1 && hex.EncodeToString(response) != test.tcp {
+			t.Errorf("%s: serial response % x, want %s", test.name, response, test.tcp)
+		}
+	}
+	if n := len(handler.served()); n != 0 {
+		t.Errorf("%d requests served, want none", n)
+	}
+	want := SerialCounters{BusMessages: 3, Exceptions: 1, SlaveMessages: 1}
+	if got := s.SerialCounters(); got != want {
+		t.Errorf("counters %+v, want %+v", got, want)
+	}
+}
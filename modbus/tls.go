@@ -0,0 +1,67 @@
+package modbus
+
+import (
+	"fmt"
+	"net"
+	"time"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	log "github.com/sirupsen/logrus"
+)
+
+// RoleOID is the certificate extension holding the role of a Modbus/TCP
+// Security client, an ASN.1 UTF8String.
+var RoleOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 50316, 802, 1}
+
+// tlsHandshakeTimeout drops the clients stalling the handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// ServeTLS accepts Modbus/TCP Security connections on listener until ctx is
+// done. The clients must present a certificate verified by config, at least
+// TLS 1.2 being negotiated, and the role it holds is passed on each request.
+// The certificates without role are refused.
+func (s *Server) ServeTLS(ctx context.Context, listener net.Listener, config *tls.Config) error {
+	config = config.Clone()
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return s.accept(ctx, tls.NewListener(listener, config), s.serveTLSConn)
+}
+
+func (s *Server) serveTLSConn(ctx context.Context, conn net.Conn) {
+	logger := log.WithFields(log.Fields{"remote": conn.RemoteAddr()})
+	tlsConn := conn.(*tls.Conn)
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		logger.Debugf("modbus: tls handshake failed: %s", err)
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	role, err := certificateRole(tlsConn.ConnectionState().PeerCertificates[0])
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	logger.WithFields(log.Fields{"role": role}).Debug("modbus: client authenticated")
+	s.serveConn(ctx, conn, role)
+}
+
+// certificateRole returns the role held by the RoleOID extension of cert.
+func certificateRole(cert *x509.Certificate) (string, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(RoleOID) {
+			continue
+		}
+		var role string
+		rest, err := asn1.UnmarshalWithParams(ext.Value, &role, "utf8")
+		if err != nil || len(rest) > 0 || role == "" {
+			return "", fmt.Errorf("modbus: invalid role in the certificate of %q", cert.Subject.CommonName)
+		}
+		return role, nil
+	}
+	return "", fmt.Errorf("modbus: the certificate of %q has no role", cert.Subject.CommonName)
+}
@@ -0,0 +1,230 @@
+package modbus
+
+import (
+	"io"
+	"net"
+	"time"
+	"context"
+	"testing"
+	"math/big"
+	"crypto/tls"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+)
+
+// testCA issues the certificates of a test, generated locally.
+type testCA struct {
+	cert	*x509.Certificate
+	key		*ecdsa.PrivateKey
+	serial	int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "test ca"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a certificate holding role, none when it is nil.
+func (ca *testCA) issue(t *testing.T, name string, role []byte, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if role != nil {
+		template.ExtraExtensions = []pkix.Extension{{Id: RoleOID, Value: role}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func roleExtension(t *testing.T, role string) []byte {
+	value, err := asn1.MarshalWithParams(role, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// serveTLS runs ServeTLS with a certificate of ca and returns its address.
+func serveTLS(t *testing.T, s *Server, ca *testCA) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", nil, x509.ExtKeyUsageServerAuth)},
+		ClientCAs: ca.pool(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.ServeTLS(ctx, listener, config)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("ServeTLS: %s", err)
+		}
+	})
+	return listener.Addr().String()
+}
+
+// tlsRequest sends a read request over a new connection and returns the
+// response, or the error of the connection.
+func tlsRequest(addr string, config *tls.Config) ([]byte, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request, _ := hex.DecodeString("000100000006010300000001")
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 11)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func TestServeTLSRole(t *testing.T) {
+	ca := newTestCA(t)
+	handler := &testHandler{}
+	addr := serveTLS(t, NewServer(handler), ca)
+
+	response, err := tlsRequest(addr, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "operator", roleExtension(t, "operator"), x509.ExtKeyUsageClientAuth)},
+		RootCAs: ca.pool(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(response); got != "0001000000050103021234" {
+		t.Errorf("response %s", got)
+	}
+	if served := handler.served(); len(served) != 1 || served[0].Role != "operator" {
+		t.Errorf("served %+v, want a request of the operator role", served)
+	}
+}
+
+func TestServeTLSRefused(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	handler := &testHandler{}
+	addr := serveTLS(t, NewServer(handler), ca)
+	client := func(cert tls.Certificate) []tls.Certificate {
+		return []tls.Certificate{cert}
+	}
+
+	tests := []struct {
+		name	string
+		config	*tls.Config
+	}{
+		{"no role", &tls.Config{
+			Certificates: client(ca.issue(t, "client", nil, x509.ExtKeyUsageClientAuth)),
+			RootCAs: ca.pool(),
+		}},
+		{"empty role", &tls.Config{
+			Certificates: client(ca.issue(t, "client", roleExtension(t, ""), x509.ExtKeyUsageClientAuth)),
+			RootCAs: ca.pool(),
+		}},
+		{"invalid role", &tls.Config{
+			Certificates: client(ca.issue(t, "client", []byte{0x02, 0x01, 0x01}, x509.ExtKeyUsageClientAuth)),
+			RootCAs: ca.pool(),
+		}},
+		{"no certificate", &tls.Config{
+			RootCAs: ca.pool(),
+		}},
+		{"other authority", &tls.Config{
+			Certificates: client(other.issue(t, "client", roleExtension(t, "operator"), x509.ExtKeyUsageClientAuth)),
+			RootCAs: ca.pool(),
+		}},
+		{"tls 1.1", &tls.Config{
+			Certificates: client(ca.issue(t, "client", roleExtension(t, "operator"), x509.ExtKeyUsageClientAuth)),
+			RootCAs: ca.pool(),
+			MinVersion: tls.VersionTLS10,
+			MaxVersion: tls.VersionTLS11,
+		}},
+	}
+	for _, test := range tests {
+		if response, err := tlsRequest(addr, test.config); err == nil {
+			t.Errorf("%s: answered % x", test.name, response)
+		} else {
+			t.Logf("%s: %s", test.name, err)
+		}
+	}
+	if served := handler.served(); len(served) > 0 {
+		t.Errorf("served %+v, want none", served)
+	}
+}
+
+func TestCertificateRole(t *testing.T) {
+	ca := newTestCA(t)
+	tests := []struct {
+		name	string
+		role	[]byte
+		want	string
+		valid	bool
+	}{
+		{"role", roleExtension(t, "viewer"), "viewer", true},
+		{"no role", nil, "", false},
+		{"integer", []byte{0x02, 0x01, 0x01}, "", false},
+		{"trailing data", append(roleExtension(t, "viewer"), 0), "", false},
+	}
+	for _, test := range tests {
+		cert, err := x509.ParseCertificate(ca.issue(t, "client", test.role, x509.ExtKeyUsageClientAuth).Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		role, err := certificateRole(cert)
+		if role != test.want || (err == nil) != test.valid {
+			t.Errorf("%s: role %q, error %v", test.name, role, err)
+		}
+	}
+}
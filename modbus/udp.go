@@ -0,0 +1,52 @@
+package modbus
+
+import (
+	"net"
+	"bytes"
+	"context"
+	log "github.com/sirupsen/logrus"
+)
+
+// udpMaxADU is the largest Modbus/UDP frame: MBAP header and 253 bytes of PDU.
+const udpMaxADU = mbapHeaderSize + 253
+
+// ServeUDP answers the Modbus/UDP datagrams of conn until ctx is done, which
+// closes it. Each datagram holds exactly one frame with its MBAP header, the
+// others are dropped.
+func (s *Server) ServeUDP(ctx context.Context, conn net.PacketConn) error {
+	defer closeOnDone(ctx, conn)()
+
+	// the datagrams are read whole, a frame over the maximum ADU would
+	// otherwise be truncated into a valid one
+	datagram := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(datagram)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		if n > udpMaxADU {
+			log.WithFields(log.Fields{"remote": addr}).Debugf("modbus: dropping a datagram of %d bytes", n)
+			continue
+		}
+		reader := bytes.NewReader(datagram[:n])
+		header, pdu, err := readMBAP(reader)
+		if err != nil || reader.Len() > 0 {
+			log.WithFields(log.Fields{"remote": addr}).Debugf("modbus: dropping an invalid datagram % x", datagram[:n])
+			continue
+		}
+		response := s.serveMBAP(header, pdu, "")
+		if response == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(response, addr); err != nil && ctx.Err() == nil {
+			log.WithFields(log.Fields{"remote": addr}).Debugf("modbus: %s", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package modbus
+
+import (
+	"net"
+	"time"
+	"bytes"
+	"context"
+	"testing"
+)
+
+// serveUDP runs ServeUDP on a local port and returns a client connected to
+// it.
+func serveUDP(t *testing.T, s *Server) net.Conn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeUDP(ctx, conn)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("ServeUDP: %s", err)
+		}
+	})
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// udpExchange sends a datagram and returns the response, nil when none comes.
+func udpExchange(t *testing.T, conn net.Conn, datagram []byte) []byte {
+	t.Helper()
+	if _, err := conn.Write(datagram); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// mbapFrame builds a Modbus/TCP frame of unit 1 around pdu.
+func mbapFrame(transaction uint16, pdu []byte) []byte {
+	return mbapHeader{transaction: transaction, unit: 1}.frame(pdu)
+}
+
+func TestServeUDP(t *testing.T) {
+	handler := &testHandler{}
+	conn := serveUDP(t, NewServer(handler))
+
+	tests := []struct {
+		name		string
+		datagram	[]byte
+		response	[]byte
+	}{
+		{"request", mbapFrame(1, decodeHex(t, "0300000001")), mbapFrame(1, decodeHex(t, "03021234"))},
+		{"unknown unit", mbapHeader{transaction: 2, unit: 9}.frame(decodeHex(t, "0300000001")), mbapHeader{transaction: 2, unit: 9}.frame(decodeHex(t, "830b"))},
+		{"trailing bytes", append(mbapFrame(3, decodeHex(t, "0300000001")), 0), nil},
+		{"truncated", mbapFrame(4, decodeHex(t, "0300000001"))[:10], nil},
+		{"other protocol", decodeHex(t, "000500010006010300000001"), nil},
+		{"largest frame", mbapFrame(6, append([]byte{0x2b}, make([]byte, 252)...)), mbapFrame(6, decodeHex(t, "2b021234"))},
+		// the 260 first bytes would make a valid frame
+		{"over the largest frame", append(mbapFrame(7, append([]byte{0x2b}, make([]byte, 252)...)), make([]byte, 40)...), nil},
+	}
+	for _, test := range tests {
+		if got := udpExchange(t, conn, test.datagram); !bytes.Equal(got, test.response) {
+			t.Errorf("%s: response % x, want % x", test.name, got, test.response)
+		}
+	}
+	if n := len(handler.served()); n != 3 {
+		t.Errorf("%d requests served, want 3", n)
+	}
+}
@@ -0,0 +1,279 @@
+package poller
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"encoding/binary"
+	"github.com/ggueret/mbpio/i2c"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	bmeRegCalib00 = 0x88
+	bmeRegChipID = 0xd0
+	bmeRegReset = 0xe0
+	bmeRegCalib26 = 0xe1
+	bmeRegCtrlHum = 0xf2
+	bmeRegStatus = 0xf3
+	bmeRegCtrlMeas = 0xf4
+	bmeRegData = 0xf7
+
+	bmeChipBME280 = 0x60
+	bmeChipBMP280 = 0x58
+
+	// x1 oversampling of every channel in forced mode
+	bmeCtrlHum = 0x01
+	bmeCtrlMeas = 0x01 << 5 | 0x01 << 2 | 0x01
+)
+
+type bmeCalibration struct {
+	T1			uint16
+	T2, T3		int16
+	P1			uint16
+	P2, P3, P4, P5, P6, P7, P8, P9	int16
+	H1, H3		uint8
+	H2, H4, H5	int16
+	H6			int8
+}
+
+// compensate applies the integer formulas of the Bosch datasheet, it returns
+// °C, hPa and %RH.
+func (c *bmeCalibration) compensate(adcT, adcP, adcH int32) (temperature, pressure, humidity float64) {
+	var1 := (((adcT >> 3) - (int32(c.T1) << 1)) * int32(c.T2)) >> 11
+	var2 := (((((adcT >> 4) - int32(c.T1)) * ((adcT >> 4) - int32(c.T1))) >> 12) * int32(c.T3)) >> 14
+	tFine := var1 + var2
+	temperature = float64((tFine * 5 + 128) >> 8) / 100
+
+	p1 := int64(tFine) - 128000
+	p2 := p1 * p1 * int64(c.P6)
+	p2 += (p1 * int64(c.P5)) << 17
+	p2 += int64(c.P4) << 35
+	p1 = ((p1 * p1 * int64(c.P3)) >> 8) + ((p1 * int64(c.P2)) << 12)
+	p1 = (((int64(1) << 47) + p1) * int64(c.P1)) >> 33
+	if p1 != 0 {
+		p := 1048576 - int64(adcP)
+		p = (((p << 31) - p2) * 3125) / p1
+		p1 = (int64(c.P9) * (p >> 13) * (p >> 13)) >> 25
+		p2 = (int64(c.P8) * p) >> 19
+		p = ((p + p1 + p2) >> 8) + (int64(c.P7) << 4)
+		pressure = float64(p) / 256 / 100
+	}
+
+	h := tFine - 76800
+	h = (((((adcH << 14) - (int32(c.H4) << 20) - (int32(c.H5) * h)) + 16384) >> 15) *
+		(((((((h * int32(c.H6)) >> 10) * (((h * int32(c.H3)) >> 11) + 32768)) >> 10) + 2097152) * int32(c.H2) + 8192) >> 14))
+	h = h - (((((h >> 15) * (h >> 15)) >> 7) * int32(c.H1)) >> 4)
+	if h < 0 {
+		h = 0
+	} else if h > 419430400 {
+		h = 419430400
+	}
+	humidity = float64(h >> 12) / 1024
+	return temperature, pressure, humidity
+}
+
+type bmeSensor struct {
+	device		i2c.Device
+	name		string
+	humidity	bool
+	calib		bmeCalibration
+	inputs		[]Input
+}
+
+func (s *bmeSensor) init() error {
+	id := make([]byte, 1)
+	if err := s.device.ReadReg(bmeRegChipID, id); err != nil {
+		return err
+	}
+	switch id[0] {
+	case bmeChipBME280:
+		s.name, s.humidity = "BME280", true
+	case bmeChipBMP280:
+		s.name = "BMP280"
+	default:
+		return fmt.Errorf("unknown chip id 0x%02x", id[0])
+	}
+
+	if err := s.device.WriteReg(bmeRegReset, 0xb6); err != nil {
+		return err
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	calib := make([]byte, 26)
+	if err := s.device.ReadReg(bmeRegCalib00, calib); err != nil {
+		return err
+	}
+	c := &s.calib
+	c.T1 = binary.LittleEndian.Uint16(calib[0:])
+	c.T2 = int16(binary.LittleEndian.Uint16(calib[2:]))
+	c.T3 = int16(binary.LittleEndian.Uint16(calib[4:]))
+	c.P1 = binary.LittleEndian.Uint16(calib[6:])
+	for i, p := range []*int16{&c.P2, &c.P3, &c.P4, &c.P5, &c.P6, &c.P7, &c.P8, &c.P9} {
+		*p = int16(binary.LittleEndian.Uint16(calib[8+2*i:]))
+	}
+	c.H1 = calib[25]
+
+	if !s.humidity {
+		return nil
+	}
+	calib = calib[:7]
+	if err := s.device.ReadReg(bmeRegCalib26, calib); err != nil {
+		return err
+	}
+	c.H2 = int16(binary.LittleEndian.Uint16(calib[0:]))
+	c.H3 = calib[2]
+	c.H4 = int16(int8(calib[3])) << 4 | int16(calib[4] & 0x0f)
+	c.H5 = int16(int8(calib[5])) << 4 | int16(calib[4] >> 4)
+	c.H6 = int8(calib[6])
+
+	return s.device.WriteReg(bmeRegCtrlHum, bmeCtrlHum)
+}
+
+func (s *bmeSensor) read(ctx context.Context) (temperature, pressure, humidity float64, err error) {
+	if err = s.device.WriteReg(bmeRegCtrlMeas, bmeCtrlMeas); err != nil {
+		return
+	}
+
+	// a forced x1 measurement takes less than 10ms
+	status := make([]byte, 1)
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(5 * time.Millisecond):
+		case <-ctx.Done():
+			return 0, 0, 0, ctx.Err()
+		}
+		if err = s.device.ReadReg(bmeRegStatus, status); err != nil {
+			return
+		}
+		if status[0] & 0x08 == 0 {
+			break
+		}
+		if attempt >= 10 {
+			return 0, 0, 0, fmt.Errorf("measurement timeout")
+		}
+	}
+
+	data := make([]byte, 8)
+	if !s.humidity {
+		data = data[:6]
+	}
+	if err = s.device.ReadReg(bmeRegData, data); err != nil {
+		return
+	}
+	adcP := int32(data[0]) << 12 | int32(data[1]) << 4 | int32(data[2]) >> 4
+	adcT := int32(data[3]) << 12 | int32(data[4]) << 4 | int32(data[5]) >> 4
+	adcH := int32(0)
+	if s.humidity {
+		adcH = int32(data[6]) << 8 | int32(data[7])
+	}
+	temperature, pressure, humidity = s.calib.compensate(adcT, adcP, adcH)
+	return temperature, pressure, humidity, nil
+}
+
+// bme280Poller reads Bosch BME280/BMP280 sensors on /dev/i2c-N buses, the
+// inputs sharing a bus and address are filled from a single measurement.
+// Pressure is published in hPa, all values with the scale of the input.
+type bme280Poller struct {
+	env			*Env
+	open		func(bus int) (i2c.Bus, error)
+	buses		map[int]i2c.Bus
+	sensors		[]*bmeSensor
+}
+
+func init() {
+	for _, name := range []string{"BME280", "BMP280"} {
+		Register(Descriptor{
+			Name: name,
+			Values: []string{"temperature", "pressure", "humidity"},
+			Options: []Option{
+				{Name: "bus", Type: Int, Default: 1},
+				{Name: "address", Type: Int, Default: 0x76},
+				{Name: "scale", Type: Float, Default: 10.0},
+			},
+			Interval: time.Minute,
+			MinInterval: time.Second,
+			New: func() Poller {
+				return &bme280Poller{open: i2c.Open}
+			},
+		})
+	}
+}
+
+func (p *bme280Poller) Init(env *Env) error {
+	p.env = env
+	p.buses = make(map[int]i2c.Bus)
+
+	sensors := make(map[[2]int]*bmeSensor)
+	for _, input := range env.Inputs {
+		key := [2]int{input.Options.Int("bus"), input.Options.Int("address")}
+		sensor, ok := sensors[key]
+		if !ok {
+			bus, ok := p.buses[key[0]]
+			if !ok {
+				var err error
+				bus, err = p.open(key[0])
+				if err != nil {
+					p.Close()
+					return err
+				}
+				p.buses[key[0]] = bus
+			}
+
+			sensor = &bmeSensor{device: i2c.Device{Bus: bus, Addr: uint16(key[1])}}
+			if err := sensor.init(); err != nil {
+				p.Close()
+				return fmt.Errorf("sensor 0x%02x on bus %d: %s", key[1], key[0], err)
+			}
+			sensors[key] = sensor
+			p.sensors = append(p.sensors, sensor)
+		}
+		if input.Value == "humidity" && !sensor.humidity {
+			p.Close()
+			return fmt.Errorf("input %d: sensor 0x%02x on bus %d is a BMP280 without humidity", input.Addr, key[1], key[0])
+		}
+		sensor.inputs = append(sensor.inputs, input)
+	}
+	return nil
+}
+
+func (p *bme280Poller) Poll(ctx context.Context) error {
+	for _, sensor := range p.sensors {
+		temperature, pressure, humidity, err := sensor.read(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.WithFields(log.Fields{"address": sensor.device.Addr}).Warningf("%s poller: %s", sensor.name, err)
+			continue
+		}
+
+		for _, input := range sensor.inputs {
+			value := temperature
+			switch input.Value {
+			case "pressure":
+				value = pressure
+			case "humidity":
+				value = humidity
+			}
+			p.env.Store.SetInputRegister(input.Addr, FixedPoint(value, input.Options.Float("scale")))
+		}
+		log.WithFields(log.Fields{"address": sensor.device.Addr, "temperature": temperature, "pressure": pressure, "humidity": humidity}).Tracef("%s poller: value refreshed.", sensor.name)
+	}
+	return nil
+}
+
+func (p *bme280Poller) Close() error {
+	for _, bus := range p.buses {
+		bus.Close()
+	}
+	return nil
+}
+
+func (p *bme280Poller) Registers() []Address {
+	registers := make([]Address, 0, len(p.env.Inputs))
+	for _, input := range p.env.Inputs {
+		registers = append(registers, Address{InputRegister, input.Addr})
+	}
+	return registers
+}
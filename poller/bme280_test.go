@@ -0,0 +1,205 @@
+package poller
+
+import (
+	"sync"
+	"errors"
+	"math"
+	"bytes"
+	"context"
+	"testing"
+	"encoding/binary"
+	"github.com/ggueret/mbpio/i2c"
+)
+
+// bmeDatasheet is the compensation example of the BMP280 datasheet, with a
+// typical humidity trimming of BME280 whose result is checked against the
+// floating point formula of the BME280 datasheet.
+var bmeDatasheet = bmeCalibration{
+	T1: 27504, T2: 26435, T3: -1000,
+	P1: 36477, P2: -10685, P3: 3024, P4: 2855, P5: 140, P6: -7, P7: 15500, P8: -14600, P9: 6000,
+	H1: 75, H2: 362, H3: 0, H4: 313, H5: 50, H6: 30,
+}
+
+const (
+	bmeAdcT = 519888
+	bmeAdcP = 415148
+	bmeAdcH = 28000
+)
+
+// mockI2C is the register map of a sensor, reads start at the register
+// written first and the writes are recorded.
+type mockI2C struct {
+	mu			sync.Mutex
+	addr		uint16
+	regs		[256]byte
+	writes		[][]byte
+	closed		bool
+}
+
+func (b *mockI2C) Tx(addr uint16, w, r []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if addr != b.addr {
+		return errNack
+	}
+	if len(r) > 0 {
+		copy(r, b.regs[w[0]:])
+	} else {
+		b.writes = append(b.writes, append([]byte(nil), w...))
+	}
+	return nil
+}
+
+func (b *mockI2C) Close() error {
+	b.closed = true
+	return nil
+}
+
+var errNack = errors.New("i2c: no acknowledge")
+
+// bmeDump fills the registers of a sensor from its calibration and raw
+// readings, as the chip lays them out.
+func bmeDump(chipID byte, c bmeCalibration, adcT, adcP, adcH int32) [256]byte {
+	var regs [256]byte
+	regs[bmeRegChipID] = chipID
+
+	calib := regs[bmeRegCalib00:]
+	binary.LittleEndian.PutUint16(calib[0:], c.T1)
+	for i, v := range []int16{c.T2, c.T3} {
+		binary.LittleEndian.PutUint16(calib[2+2*i:], uint16(v))
+	}
+	binary.LittleEndian.PutUint16(calib[6:], c.P1)
+	for i, v := range []int16{c.P2, c.P3, c.P4, c.P5, c.P6, c.P7, c.P8, c.P9} {
+		binary.LittleEndian.PutUint16(calib[8+2*i:], uint16(v))
+	}
+	calib[25] = c.H1
+
+	calib = regs[bmeRegCalib26:]
+	binary.LittleEndian.PutUint16(calib[0:], uint16(c.H2))
+	calib[2] = c.H3
+	calib[3] = byte(c.H4 >> 4)
+	calib[4] = byte(c.H4 & 0x0f) | byte(c.H5 & 0x0f) << 4
+	calib[5] = byte(c.H5 >> 4)
+	calib[6] = byte(c.H6)
+
+	data := regs[bmeRegData:]
+	for i, adc := range []int32{adcP, adcT} {
+		data[3*i] = byte(adc >> 12)
+		data[3*i+1] = byte(adc >> 4)
+		data[3*i+2] = byte(adc << 4)
+	}
+	binary.BigEndian.PutUint16(data[6:], uint16(adcH))
+	return regs
+}
+
+// bmeHumidity is the floating point humidity formula of the datasheet.
+func bmeHumidity(c bmeCalibration, tFine float64, adcH float64) float64 {
+	h := tFine - 76800
+	h = (adcH - (float64(c.H4) * 64 + float64(c.H5) / 16384 * h)) *
+		(float64(c.H2) / 65536 * (1 + float64(c.H6) / 67108864 * h * (1 + float64(c.H3) / 67108864 * h)))
+	h = h * (1 - float64(c.H1) * h / 524288)
+	return math.Max(0, math.Min(100, h))
+}
+
+func TestBMECompensate(t *testing.T) {
+	temperature, pressure, humidity := bmeDatasheet.compensate(bmeAdcT, bmeAdcP, bmeAdcH)
+	if temperature != 25.08 {
+		t.Errorf("temperature %v°C, want 25.08", temperature)
+	}
+	// 100653.27Pa with the floating point formula, the integer one rounds
+	// to 1/256Pa
+	if math.Abs(pressure * 100 - 100653.27) > 0.05 {
+		t.Errorf("pressure %vhPa, want 1006.5327", pressure)
+	}
+	// t_fine is 128422 in the example
+	if want := bmeHumidity(bmeDatasheet, 128422, bmeAdcH); math.Abs(humidity - want) > 0.01 {
+		t.Errorf("humidity %v%%, want %v", humidity, want)
+	}
+}
+
+func pollBME(t *testing.T, name string, bus *mockI2C, values map[int]string) (*testStore, error) {
+	t.Helper()
+	store := newTestStore()
+	p := &bme280Poller{open: func(n int) (i2c.Bus, error) {
+		if n != 1 {
+			t.Errorf("opened the bus %d, want 1", n)
+		}
+		return bus, nil
+	}}
+	err := p.Init(&Env{Store: store, Inputs: testInputs(t, name, values, nil)})
+	if err != nil {
+		return store, err
+	}
+	defer p.Close()
+	return store, p.Poll(context.Background())
+}
+
+func TestBME280Poller(t *testing.T) {
+	bus := &mockI2C{addr: 0x76, regs: bmeDump(bmeChipBME280, bmeDatasheet, bmeAdcT, bmeAdcP, bmeAdcH)}
+	store, err := pollBME(t, "BME280", bus, map[int]string{0: "temperature", 1: "pressure", 2: "humidity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, humidity := bmeDatasheet.compensate(bmeAdcT, bmeAdcP, bmeAdcH)
+	for addr, want := range map[int]uint16{0: 251, 1: 10065, 2: FixedPoint(humidity, 10)} {
+		if got, _ := store.inputRegister(addr); got != want {
+			t.Errorf("input register %d = %d, want %d", addr, got, want)
+		}
+	}
+
+	// reset, humidity oversampling, then a forced measurement
+	want := [][]byte{{bmeRegReset, 0xb6}, {bmeRegCtrlHum, bmeCtrlHum}, {bmeRegCtrlMeas, bmeCtrlMeas}}
+	if len(bus.writes) != len(want) {
+		t.Fatalf("writes % x, want % x", bus.writes, want)
+	}
+	for i := range want {
+		if !bytes.Equal(bus.writes[i], want[i]) {
+			t.Errorf("write %d % x, want % x", i, bus.writes[i], want[i])
+		}
+	}
+	if !bus.closed {
+		t.Error("bus left open")
+	}
+}
+
+func TestBMP280Poller(t *testing.T) {
+	bus := &mockI2C{addr: 0x76, regs: bmeDump(bmeChipBMP280, bmeDatasheet, bmeAdcT, bmeAdcP, 0)}
+	store, err := pollBME(t, "BMP280", bus, map[int]string{0: "temperature", 1: "pressure"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[int]uint16{0: 251, 1: 10065} {
+		if got, _ := store.inputRegister(addr); got != want {
+			t.Errorf("input register %d = %d, want %d", addr, got, want)
+		}
+	}
+	for _, write := range bus.writes {
+		if write[0] == bmeRegCtrlHum {
+			t.Error("humidity oversampling set on a BMP280")
+		}
+	}
+
+	sensor := &bmeSensor{device: i2c.Device{Bus: bus, Addr: 0x76}}
+	if err := sensor.init(); err != nil || sensor.name != "BMP280" || sensor.humidity {
+		t.Errorf("sensor %s, humidity %t, error %v", sensor.name, sensor.humidity, err)
+	}
+
+	if _, err := pollBME(t, "BMP280", bus, map[int]string{0: "humidity"}); err == nil {
+		t.Error("humidity read from a BMP280")
+	}
+}
+
+func TestBMEPollerErrors(t *testing.T) {
+	bus := &mockI2C{addr: 0x76, regs: bmeDump(0x55, bmeDatasheet, bmeAdcT, bmeAdcP, bmeAdcH)}
+	if _, err := pollBME(t, "BME280", bus, map[int]string{0: "temperature"}); err == nil {
+		t.Error("unknown chip id accepted")
+	}
+	if !bus.closed {
+		t.Error("bus left open")
+	}
+
+	bus = &mockI2C{addr: 0x77, regs: bmeDump(bmeChipBME280, bmeDatasheet, bmeAdcT, bmeAdcP, bmeAdcH)}
+	if _, err := pollBME(t, "BME280", bus, map[int]string{0: "temperature"}); err == nil {
+		t.Error("sensor found on the wrong address")
+	}
+}
@@ -0,0 +1,198 @@
+package poller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"context"
+	"strings"
+	"github.com/ggueret/mbpio/gpio"
+	log "github.com/sirupsen/logrus"
+)
+
+var counterEdges = map[string]gpio.Edge {
+	"rising": gpio.RiseEdge,
+	"falling": gpio.FallEdge,
+	"both": gpio.AnyEdge,
+}
+
+// counterPoller counts the debounced edges of a pin. The count value is the
+// 32 bits total over two input registers (high word first), the frequency
+// value the counted edges per second over the last poll. The optional reset
+// coil clears the total and the preset holding registers (high word first,
+// applied when the low word is written) load it. The edge and debounce of a
+// pin are taken from its first input, the debounce option falling back to
+// the debounce of the input.
+type counterPoller struct {
+	env			*Env
+	pin			gpio.Pin
+	key			string
+
+	mu			sync.Mutex
+	total		uint32
+	preset		uint32
+	lastTotal	uint32
+	lastPoll	time.Time
+
+	resets		map[int]bool
+	presets		map[int]bool
+	wg			sync.WaitGroup
+}
+
+func init() {
+	Register(Descriptor{
+		Name: "COUNTER",
+		Values: []string{"count", "frequency"},
+		Options: []Option{
+			{Name: "edge", Type: String, Default: "rising"},
+			{Name: "debounce", Type: Duration, Default: time.Duration(0)},
+			{Name: "scale", Type: Float, Default: 1.0},
+			{Name: "reset", Type: Int},
+			{Name: "preset", Type: Int},
+		},
+		Interval: time.Second,
+		New: func() Poller {
+			return &counterPoller{}
+		},
+	})
+}
+
+func (p *counterPoller) Init(env *Env) error {
+	p.env = env
+	p.resets = make(map[int]bool)
+	p.presets = make(map[int]bool)
+
+	first := env.Inputs[0]
+	p.pin = first.Pin
+	p.key = fmt.Sprintf("counter/%d", p.pin)
+
+	edge, ok := counterEdges[strings.ToLower(first.Options.String("edge"))]
+	if !ok {
+		return fmt.Errorf("input %d: unknown edge %q, choices: rising, falling, both", first.Addr, first.Options.String("edge"))
+	}
+	for _, input := range env.Inputs {
+		if input.Options.Has("reset") {
+			p.resets[input.Options.Int("reset")] = true
+		}
+		if input.Options.Has("preset") {
+			p.presets[input.Options.Int("preset")] = true
+		}
+	}
+
+	if env.Retainer != nil {
+		if total, ok := env.Retainer.Retained(p.key); ok {
+			p.total = uint32(total)
+			log.WithFields(log.Fields{"pin": p.pin, "total": p.total}).Debug("COUNTER poller: total restored")
+		}
+	}
+	p.lastTotal, p.lastPoll = p.total, time.Now()
+
+	env.GPIO.PinMode(p.pin, gpio.Input)
+	events, err := env.GPIO.Watch(p.pin, edge)
+	if err != nil {
+		return err
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		debouncer := gpio.Debouncer{Interval: first.Options.Duration("debounce")}
+		if debouncer.Interval == 0 {
+			debouncer.Interval = first.Debounce
+		}
+		for event := range events {
+			if !debouncer.Accept(event) {
+				continue
+			}
+			p.mu.Lock()
+			p.total++
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (p *counterPoller) Poll(ctx context.Context) error {
+	p.mu.Lock()
+	total, now := p.total, time.Now()
+	frequency := 0.0
+	if elapsed := now.Sub(p.lastPoll).Seconds(); elapsed > 0 {
+		frequency = float64(total - p.lastTotal) / elapsed
+	}
+	p.lastTotal, p.lastPoll = total, now
+	p.mu.Unlock()
+
+	for _, input := range p.env.Inputs {
+		if input.Value == "frequency" {
+			p.env.Store.SetInputRegister(input.Addr, FixedPoint(frequency, input.Options.Float("scale")))
+			continue
+		}
+		p.env.Store.SetInputRegister(input.Addr, uint16(total >> 16))
+		p.env.Store.SetInputRegister(input.Addr + 1, uint16(total))
+	}
+	if p.env.Retainer != nil {
+		p.env.Retainer.Retain(p.key, int64(total))
+	}
+	log.WithFields(log.Fields{"pin": p.pin, "total": total, "frequency": frequency}).Trace("COUNTER poller: value refreshed.")
+	return nil
+}
+
+func (p *counterPoller) WriteCoil(addr int, value bool) (bool, error) {
+	if !p.resets[addr] {
+		return false, fmt.Errorf("coil %d is not a reset of the counter on pin %d", addr, p.pin)
+	}
+	if value {
+		p.mu.Lock()
+		p.total, p.lastTotal = 0, 0
+		p.mu.Unlock()
+		log.WithFields(log.Fields{"pin": p.pin}).Info("COUNTER poller: total reset")
+	}
+	// the reset coil is momentary
+	return false, nil
+}
+
+func (p *counterPoller) WriteHoldingRegister(addr int, value uint16) (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case p.presets[addr]:
+		p.preset = p.preset & 0xffff | uint32(value) << 16
+	case p.presets[addr - 1]:
+		p.preset = p.preset &^ 0xffff | uint32(value)
+		p.total, p.lastTotal = p.preset, p.preset
+		log.WithFields(log.Fields{"pin": p.pin, "total": p.total}).Info("COUNTER poller: total preset")
+	default:
+		return 0, fmt.Errorf("holding register %d is not a preset of the counter on pin %d", addr, p.pin)
+	}
+	return value, nil
+}
+
+// Close unwatches the pin and retains the final total.
+func (p *counterPoller) Close() error {
+	p.env.GPIO.Unwatch(p.pin)
+	p.wg.Wait()
+	if p.env.Retainer != nil {
+		p.mu.Lock()
+		p.env.Retainer.Retain(p.key, int64(p.total))
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+func (p *counterPoller) Registers() []Address {
+	registers := []Address{}
+	for _, input := range p.env.Inputs {
+		registers = append(registers, Address{InputRegister, input.Addr})
+		if input.Value == "count" {
+			registers = append(registers, Address{InputRegister, input.Addr + 1})
+		}
+	}
+	for addr := range p.resets {
+		registers = append(registers, Address{Coil, addr})
+	}
+	for addr := range p.presets {
+		registers = append(registers, Address{HoldingRegister, addr}, Address{HoldingRegister, addr + 1})
+	}
+	return registers
+}
@@ -0,0 +1,159 @@
+package poller
+
+import (
+	"time"
+	"context"
+	"testing"
+)
+
+// testRetainer keeps the retained values in memory.
+type testRetainer struct {
+	values		map[string]int64
+}
+
+func (r *testRetainer) Retained(key string) (int64, bool) {
+	value, ok := r.values[key]
+	return value, ok
+}
+
+func (r *testRetainer) Retain(key string, value int64) {
+	r.values[key] = value
+}
+
+// runCounter starts a counter on pin 5 of the sim driver, its count on input
+// registers 100 and 101 and its frequency on 102.
+func runCounter(t *testing.T, retainer *testRetainer, raw map[string]interface{}) (*counterPoller, *testStore, func(string)) {
+	t.Helper()
+	driver, sim := openSim(t)
+	inputs := testInputs(t, "COUNTER", map[int]string{100: "count", 102: "frequency"}, raw)
+	for i := range inputs {
+		inputs[i].Pin = 5
+	}
+
+	store := newTestStore()
+	p := &counterPoller{}
+	env := &Env{GPIO: driver, Store: store, Inputs: inputs}
+	// a nil *testRetainer is not a nil Retainer
+	if retainer != nil {
+		env.Retainer = retainer
+	}
+	if err := p.Init(env); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, store, sim
+}
+
+// waitTotal waits for the counter to reach want, the edges are counted by
+// another goroutine.
+func waitTotal(t *testing.T, p *counterPoller, want uint32) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.mu.Lock()
+		total := p.total
+		p.mu.Unlock()
+		if total == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("total %d, want %d", total, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pulse drives n pulses on pin 5.
+func pulse(sim func(string), n int) {
+	for i := 0; i < n; i++ {
+		sim("5 high")
+		sim("5 low")
+	}
+}
+
+func TestCounterEdges(t *testing.T) {
+	tests := []struct {
+		edge		string
+		want		uint32
+	}{
+		{"rising", 3},
+		{"falling", 3},
+		{"both", 6},
+	}
+	for _, test := range tests {
+		p, _, sim := runCounter(t, nil, map[string]interface{}{"edge": test.edge})
+		pulse(sim, 3)
+		waitTotal(t, p, test.want)
+	}
+
+	driver, _ := openSim(t)
+	inputs := testInputs(t, "COUNTER", map[int]string{100: "count"}, map[string]interface{}{"edge": "up"})
+	if err := (&counterPoller{}).Init(&Env{GPIO: driver, Inputs: inputs}); err == nil {
+		t.Error("unknown edge accepted")
+	}
+}
+
+func TestCounterDebounce(t *testing.T) {
+	p, _, sim := runCounter(t, nil, map[string]interface{}{"debounce": "1h"})
+	pulse(sim, 3)
+	waitTotal(t, p, 1)
+	time.Sleep(10 * time.Millisecond)
+	waitTotal(t, p, 1)
+}
+
+func TestCounterRegisters(t *testing.T) {
+	retainer := &testRetainer{values: map[string]int64{"counter/5": 0x1fffe}}
+	p, store, sim := runCounter(t, retainer, map[string]interface{}{"reset": 10, "preset": 20, "scale": 10})
+
+	// the total restarts from the retained one, over two words
+	pulse(sim, 4)
+	waitTotal(t, p, 0x20002)
+	p.mu.Lock()
+	p.lastPoll = time.Now().Add(-2 * time.Second)
+	p.mu.Unlock()
+	if err := p.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	high, _ := store.inputRegister(100)
+	low, _ := store.inputRegister(101)
+	if high != 2 || low != 2 {
+		t.Errorf("count registers %#04x %#04x, want 0x20002", high, low)
+	}
+	// 4 edges over the last 2s, scaled by 10
+	if frequency, _ := store.inputRegister(102); frequency < 19 || frequency > 20 {
+		t.Errorf("frequency register %d, want 20", frequency)
+	}
+	if retained := retainer.values["counter/5"]; retained != 0x20002 {
+		t.Errorf("retained %#x after the poll, want 0x20002", retained)
+	}
+
+	// the reset coil is momentary
+	if value, err := p.WriteCoil(10, true); value || err != nil {
+		t.Errorf("reset coil: %v, %v", value, err)
+	}
+	waitTotal(t, p, 0)
+	if _, err := p.WriteCoil(11, true); err == nil {
+		t.Error("wrote a coil besides the reset")
+	}
+
+	// the preset is applied with its low word
+	if _, err := p.WriteHoldingRegister(20, 0x0001); err != nil {
+		t.Fatal(err)
+	}
+	waitTotal(t, p, 0)
+	if _, err := p.WriteHoldingRegister(21, 0x0000); err != nil {
+		t.Fatal(err)
+	}
+	waitTotal(t, p, 0x10000)
+	if _, err := p.WriteHoldingRegister(22, 0); err == nil {
+		t.Error("wrote a register after the preset")
+	}
+
+	// closing retains the last total
+	pulse(sim, 1)
+	waitTotal(t, p, 0x10001)
+	p.Close()
+	if retained := retainer.values["counter/5"]; retained != 0x10001 {
+		t.Errorf("retained %#x on close, want 0x10001", retained)
+	}
+}
@@ -0,0 +1,105 @@
+package poller
+
+import (
+	"time"
+	"context"
+	"github.com/ggueret/mbpio/dht"
+	"github.com/ggueret/mbpio/gpio"
+	log "github.com/sirupsen/logrus"
+)
+
+var DHTRetries = 3
+var DHTBackoff = 2 * time.Second
+
+// dhtPoller reads each pin once per poll and fills every input mapped on it
+// according to its value selector. Readings are published as signed
+// fixed-point values, the default scale of 10 gives tenths.
+type dhtPoller struct {
+	model		dht.Model
+	env			*Env
+	pins		map[gpio.Pin][]Input
+}
+
+func init() {
+	for _, name := range []string{"DHT11", "DHT22", "AM2302"} {
+		model, _ := dht.ParseModel(name)
+		minInterval := 2 * time.Second
+		if model == dht.DHT11 {
+			minInterval = time.Second
+		}
+		Register(Descriptor{
+			Name: name,
+			Values: []string{"temperature", "humidity"},
+			Options: []Option{
+				{Name: "scale", Type: Float, Default: 10.0},
+			},
+			Interval: time.Minute,
+			MinInterval: minInterval,
+			New: func() Poller {
+				return &dhtPoller{model: model}
+			},
+		})
+	}
+}
+
+func (p *dhtPoller) Init(env *Env) error {
+	p.env = env
+	p.pins = make(map[gpio.Pin][]Input)
+	for _, input := range env.Inputs {
+		p.pins[input.Pin] = append(p.pins[input.Pin], input)
+	}
+	return nil
+}
+
+func (p *dhtPoller) Poll(ctx context.Context) error {
+	name := dht.ModelStrings[p.model]
+	for pin, inputs := range p.pins {
+		reading, err := p.read(ctx, pin)
+		if err != nil {
+			log.WithFields(log.Fields{"pin": pin}).Warningf("%s poller: %s", name, err)
+			continue
+		}
+
+		for _, input := range inputs {
+			value := reading.Temperature
+			if input.Value == "humidity" {
+				value = reading.Humidity
+			}
+			p.env.Store.SetInputRegister(input.Addr, FixedPoint(value, input.Options.Float("scale")))
+		}
+		log.WithFields(log.Fields{"pin": pin, "temperature": reading.Temperature, "humidity": reading.Humidity}).Tracef("%s poller: value refreshed.", name)
+	}
+	return nil
+}
+
+// read retries failed reads with an exponential backoff, the sensor cannot
+// be read more than once every 2 seconds anyway.
+func (p *dhtPoller) read(ctx context.Context, pin gpio.Pin) (dht.Reading, error) {
+	backoff := DHTBackoff
+	for attempt := 1; ; attempt++ {
+		reading, err := dht.Read(p.env.GPIO, pin, p.model)
+		if err == nil || attempt > DHTRetries {
+			return reading, err
+		}
+		log.WithFields(log.Fields{"pin": pin, "attempt": attempt}).Debugf("%s read failed: %s", dht.ModelStrings[p.model], err)
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return reading, err
+		}
+	}
+}
+
+func (p *dhtPoller) Close() error {
+	return nil
+}
+
+func (p *dhtPoller) Registers() []Address {
+	registers := make([]Address, 0, len(p.env.Inputs))
+	for _, input := range p.env.Inputs {
+		registers = append(registers, Address{InputRegister, input.Addr})
+	}
+	return registers
+}
@@ -0,0 +1,290 @@
+package poller
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+	"context"
+	"strings"
+	"github.com/ggueret/mbpio/gpio"
+	log "github.com/sirupsen/logrus"
+)
+
+// quadrature gives the step of a transition, indexed by the previous and
+// the new A<<1|B states. Channel A leading B counts up, invalid transitions
+// (both channels changed) are ignored.
+var quadrature = [16]int64{0, -1, 1, 0, 1, 0, 0, -1, -1, 0, 0, 1, 0, 1, -1, 0}
+
+// encoderPoller decodes a quadrature encoder with channel A on the input pin
+// and channel B on pin_b, counting every edge of both. The position value is
+// signed, over two input registers (high word first) with 32 bits or one
+// with 16 bits, and either wraps or saturates at the bounds. The velocity
+// value is the counts per second over the last poll times scale. The
+// optional preset holding registers load the position. The bits and overflow
+// of an encoder are taken from its first input, pin_b from any of them.
+type encoderPoller struct {
+	env			*Env
+	pinA, pinB	gpio.Pin
+	bits		int
+	saturate	bool
+
+	mu			sync.Mutex
+	position	int64
+	preset		uint32
+	moved		int64
+	lastPoll	time.Time
+
+	presets		map[int]bool
+	wg			sync.WaitGroup
+}
+
+func init() {
+	Register(Descriptor{
+		Name: "ENCODER",
+		Values: []string{"position", "velocity"},
+		Options: []Option{
+			{Name: "pin_b", Type: Int},
+			{Name: "bits", Type: Int, Default: 32},
+			{Name: "overflow", Type: String, Default: "wrap"},
+			{Name: "scale", Type: Float, Default: 1.0},
+			{Name: "preset", Type: Int},
+		},
+		Interval: time.Second,
+		New: func() Poller {
+			return &encoderPoller{}
+		},
+	})
+}
+
+func (p *encoderPoller) Init(env *Env) error {
+	p.env = env
+	p.presets = make(map[int]bool)
+
+	first := env.Inputs[0]
+	p.pinA, p.pinB = first.Pin, -1
+	for _, input := range env.Inputs {
+		if !input.Options.Has("pin_b") {
+			continue
+		}
+		pin := gpio.Pin(input.Options.Int("pin_b"))
+		if p.pinB >= 0 && pin != p.pinB {
+			return fmt.Errorf("input %d: pin_b %d differs from the pin_b %d of the encoder on pin %d", input.Addr, pin, p.pinB, p.pinA)
+		}
+		p.pinB = pin
+	}
+	if p.pinB < 0 {
+		return fmt.Errorf("input %d: missing pin_b for the channel B of the encoder on pin %d", first.Addr, p.pinA)
+	}
+	if p.pinA == p.pinB {
+		return fmt.Errorf("input %d: pin_b is the pin of channel A", first.Addr)
+	}
+	p.bits = first.Options.Int("bits")
+	if p.bits != 16 && p.bits != 32 {
+		return fmt.Errorf("input %d: bits must be 16 or 32", first.Addr)
+	}
+	switch strings.ToLower(first.Options.String("overflow")) {
+	case "wrap":
+	case "saturate":
+		p.saturate = true
+	default:
+		return fmt.Errorf("input %d: unknown overflow %q, choices: wrap, saturate", first.Addr, first.Options.String("overflow"))
+	}
+	for _, input := range env.Inputs {
+		if input.Options.Has("preset") {
+			p.presets[input.Options.Int("preset")] = true
+		}
+	}
+	p.lastPoll = time.Now()
+
+	// channel B shares the pull and polarity of the input
+	driver := env.GPIO
+	if first.Pull != nil {
+		driver.PullMode(p.pinB, *first.Pull)
+	}
+	if first.ActiveLow {
+		driver.ActiveLow(p.pinB, true)
+	}
+	driver.PinMode(p.pinA, gpio.Input)
+	driver.PinMode(p.pinB, gpio.Input)
+	eventsA, err := driver.Watch(p.pinA, gpio.AnyEdge)
+	if err != nil {
+		return err
+	}
+	eventsB, err := driver.Watch(p.pinB, gpio.AnyEdge)
+	if err != nil {
+		driver.Unwatch(p.pinA)
+		return err
+	}
+	decoder := &quadratureDecoder{pinA: p.pinA, state: int(driver.ReadPin(p.pinA)) << 1 | int(driver.ReadPin(p.pinB))}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		var wake <-chan time.Time
+		for eventsA != nil || eventsB != nil {
+			select {
+			case event, ok := <-eventsA:
+				if !ok {
+					eventsA = nil
+					continue
+				}
+				decoder.push(event)
+			case event, ok := <-eventsB:
+				if !ok {
+					eventsB = nil
+					continue
+				}
+				decoder.push(event)
+			case <-wake:
+				wake = nil
+			}
+			decoder.decode(time.Now().Add(-encoderHoldback), p.step)
+			if len(decoder.pending) > 0 && wake == nil {
+				wake = time.After(encoderHoldback)
+			}
+		}
+	}()
+	return nil
+}
+
+// encoderHoldback is how long an edge waits for the edges of the other
+// channel stamped before it, both channels come on their own stream.
+const encoderHoldback = 2 * time.Millisecond
+
+// quadratureDecoder merges the edges of both channels in the order of their
+// timestamps, state is A<<1|B.
+type quadratureDecoder struct {
+	pinA		gpio.Pin
+	state		int
+	pending		[]gpio.Event
+}
+
+func (d *quadratureDecoder) push(event gpio.Event) {
+	d.pending = append(d.pending, event)
+}
+
+// decode steps through the pending edges stamped until the given time, the
+// later ones are kept for the next call.
+func (d *quadratureDecoder) decode(until time.Time, step func(int64)) {
+	sort.SliceStable(d.pending, func(i, j int) bool {
+		return d.pending[i].Time.Before(d.pending[j].Time)
+	})
+	n := 0
+	for ; n < len(d.pending) && !d.pending[n].Time.After(until); n++ {
+		event, previous := d.pending[n], d.state
+		if event.Pin == d.pinA {
+			d.state = d.state &^ 2 | int(event.State()) << 1
+		} else {
+			d.state = d.state &^ 1 | int(event.State())
+		}
+		if delta := quadrature[previous << 2 | d.state]; delta != 0 {
+			step(delta)
+		}
+	}
+	d.pending = append(d.pending[:0], d.pending[n:]...)
+}
+
+// bounds returns the range of the position for the configured width.
+func (p *encoderPoller) bounds() (int64, int64) {
+	if p.bits == 16 {
+		return math.MinInt16, math.MaxInt16
+	}
+	return math.MinInt32, math.MaxInt32
+}
+
+func (p *encoderPoller) step(delta int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.moved += delta
+	min, max := p.bounds()
+	position := p.position + delta
+	switch {
+	case position > max && p.saturate:
+		position = max
+	case position > max:
+		position = min
+	case position < min && p.saturate:
+		position = min
+	case position < min:
+		position = max
+	}
+	p.position = position
+}
+
+func (p *encoderPoller) Poll(ctx context.Context) error {
+	p.mu.Lock()
+	position, moved, now := p.position, p.moved, time.Now()
+	velocity := 0.0
+	if elapsed := now.Sub(p.lastPoll).Seconds(); elapsed > 0 {
+		velocity = float64(moved) / elapsed
+	}
+	p.moved, p.lastPoll = 0, now
+	p.mu.Unlock()
+
+	for _, input := range p.env.Inputs {
+		if input.Value == "velocity" {
+			p.env.Store.SetInputRegister(input.Addr, FixedPoint(velocity, input.Options.Float("scale")))
+			continue
+		}
+		if p.bits == 16 {
+			p.env.Store.SetInputRegister(input.Addr, uint16(position))
+		} else {
+			p.env.Store.SetInputRegister(input.Addr, uint16(uint32(position) >> 16))
+			p.env.Store.SetInputRegister(input.Addr + 1, uint16(position))
+		}
+	}
+	log.WithFields(log.Fields{"pin": p.pinA, "position": position, "velocity": velocity}).Trace("ENCODER poller: value refreshed.")
+	return nil
+}
+
+func (p *encoderPoller) WriteCoil(addr int, value bool) (bool, error) {
+	return false, fmt.Errorf("the encoder on pin %d has no coil", p.pinA)
+}
+
+func (p *encoderPoller) WriteHoldingRegister(addr int, value uint16) (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case p.presets[addr] && p.bits == 16:
+		p.position = int64(int16(value))
+	case p.presets[addr]:
+		p.preset = p.preset & 0xffff | uint32(value) << 16
+		return value, nil
+	case p.presets[addr - 1] && p.bits == 32:
+		p.preset = p.preset &^ 0xffff | uint32(value)
+		p.position = int64(int32(p.preset))
+	default:
+		return 0, fmt.Errorf("holding register %d is not a preset of the encoder on pin %d", addr, p.pinA)
+	}
+	log.WithFields(log.Fields{"pin": p.pinA, "position": p.position}).Info("ENCODER poller: position preset")
+	return value, nil
+}
+
+// Close unwatches both channels, which ends the decoding goroutine.
+func (p *encoderPoller) Close() error {
+	p.env.GPIO.Unwatch(p.pinA)
+	p.env.GPIO.Unwatch(p.pinB)
+	p.wg.Wait()
+	return nil
+}
+
+func (p *encoderPoller) Registers() []Address {
+	registers := []Address{}
+	for _, input := range p.env.Inputs {
+		registers = append(registers, Address{InputRegister, input.Addr})
+		if input.Value == "position" && p.bits == 32 {
+			registers = append(registers, Address{InputRegister, input.Addr + 1})
+		}
+	}
+	for addr := range p.presets {
+		registers = append(registers, Address{HoldingRegister, addr})
+		if p.bits == 32 {
+			registers = append(registers, Address{HoldingRegister, addr + 1})
+		}
+	}
+	return registers
+}
@@ -0,0 +1,171 @@
+package poller
+
+import (
+	"math"
+	"time"
+	"context"
+	"testing"
+	"github.com/ggueret/mbpio/gpio"
+)
+
+// runEncoder starts an encoder with channel A on pin 5 and B on pin 6 of the
+// sim driver, its position on input register 100 and the preset on holding
+// register 200.
+func runEncoder(t *testing.T, raw map[string]interface{}) (*encoderPoller, *testStore, func(string)) {
+	t.Helper()
+	driver, sim := openSim(t)
+	options := map[string]interface{}{"pin_b": 6, "preset": 200}
+	for name, value := range raw {
+		options[name] = value
+	}
+	inputs := testInputs(t, "ENCODER", map[int]string{100: "position"}, options)
+	inputs[0].Pin = 5
+
+	store := newTestStore()
+	p := &encoderPoller{}
+	if err := p.Init(&Env{GPIO: driver, Store: store, Inputs: inputs}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, store, sim
+}
+
+// waitPosition waits for the decoder to reach want, the edges are held back
+// for a while before being decoded.
+func waitPosition(t *testing.T, p *encoderPoller, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.mu.Lock()
+		position := p.position
+		p.mu.Unlock()
+		if position == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("position %d, want %d", position, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEncoderDecode(t *testing.T) {
+	p, store, sim := runEncoder(t, nil)
+
+	// A leading B counts up, a step per edge
+	for i, command := range []string{"5 high", "6 high", "5 low", "6 low"} {
+		sim(command)
+		waitPosition(t, p, int64(i + 1))
+	}
+	// B leading A counts down
+	for i, command := range []string{"6 high", "5 high", "6 low", "5 low", "6 high", "5 high"} {
+		sim(command)
+		waitPosition(t, p, int64(3 - i))
+	}
+
+	if err := p.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	high, _ := store.inputRegister(100)
+	low, _ := store.inputRegister(101)
+	if high != 0xffff || low != 0xfffe {
+		t.Errorf("position registers %#04x %#04x, want -2", high, low)
+	}
+}
+
+func TestEncoderOverflow(t *testing.T) {
+	tests := []struct {
+		name		string
+		raw			map[string]interface{}
+		preset		[]uint16
+		up			bool
+		want		int64
+	}{
+		{"16 bits wrap up", map[string]interface{}{"bits": 16}, []uint16{0x7fff}, true, math.MinInt16},
+		{"16 bits wrap down", map[string]interface{}{"bits": 16}, []uint16{0x8000}, false, math.MaxInt16},
+		{"16 bits saturate up", map[string]interface{}{"bits": 16, "overflow": "saturate"}, []uint16{0x7fff}, true, math.MaxInt16},
+		{"16 bits saturate down", map[string]interface{}{"bits": 16, "overflow": "saturate"}, []uint16{0x8000}, false, math.MinInt16},
+		{"32 bits wrap up", nil, []uint16{0x7fff, 0xffff}, true, math.MinInt32},
+		{"32 bits saturate down", map[string]interface{}{"overflow": "saturate"}, []uint16{0x8000, 0}, false, math.MinInt32},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, _, sim := runEncoder(t, test.raw)
+			for i, value := range test.preset {
+				if _, err := p.WriteHoldingRegister(200 + i, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.up {
+				sim("5 high")
+			} else {
+				sim("6 high")
+			}
+			waitPosition(t, p, test.want)
+		})
+	}
+}
+
+func TestEncoderPreset(t *testing.T) {
+	p, store, sim := runEncoder(t, nil)
+	sim("5 high")
+	waitPosition(t, p, 1)
+
+	// the high word waits for the low one
+	if _, err := p.WriteHoldingRegister(200, 0x0001); err != nil {
+		t.Fatal(err)
+	}
+	waitPosition(t, p, 1)
+	if _, err := p.WriteHoldingRegister(201, 0x0002); err != nil {
+		t.Fatal(err)
+	}
+	waitPosition(t, p, 0x10002)
+	sim("6 high")
+	waitPosition(t, p, 0x10003)
+	p.Poll(context.Background())
+	if high, _ := store.inputRegister(100); high != 1 {
+		t.Errorf("high word %#04x, want 1", high)
+	}
+	if low, _ := store.inputRegister(101); low != 3 {
+		t.Errorf("low word %#04x, want 3", low)
+	}
+	if _, err := p.WriteHoldingRegister(202, 0); err == nil {
+		t.Error("wrote a register after the preset")
+	}
+
+	p16, _, _ := runEncoder(t, map[string]interface{}{"bits": 16})
+	if _, err := p16.WriteHoldingRegister(200, 0xfff6); err != nil {
+		t.Fatal(err)
+	}
+	waitPosition(t, p16, -10)
+	if _, err := p16.WriteHoldingRegister(201, 0); err == nil {
+		t.Error("wrote a second preset register with 16 bits")
+	}
+}
+
+func TestQuadratureDecoder(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	d := &quadratureDecoder{pinA: 5}
+	var position int64
+	step := func(delta int64) { position += delta }
+
+	// B is read before A while A rose first: counting up
+	d.push(gpio.Event{Pin: 6, Edge: gpio.RiseEdge, Time: at.Add(time.Microsecond)})
+	d.push(gpio.Event{Pin: 5, Edge: gpio.RiseEdge, Time: at})
+	d.decode(at, step)
+	if position != 1 || len(d.pending) != 1 {
+		t.Errorf("position %d with %d edges pending, want 1 with the edge of B", position, len(d.pending))
+	}
+	d.decode(at.Add(time.Microsecond), step)
+	if position != 2 || len(d.pending) != 0 || d.state != 3 {
+		t.Errorf("position %d, state %d and %d edges pending, want 2 with both channels high", position, d.state, len(d.pending))
+	}
+
+	// A falls after B: counting down
+	d.push(gpio.Event{Pin: 5, Edge: gpio.FallEdge, Time: at.Add(3 * time.Microsecond)})
+	d.push(gpio.Event{Pin: 6, Edge: gpio.FallEdge, Time: at.Add(2 * time.Microsecond)})
+	d.decode(at.Add(time.Second), step)
+	if position != 0 || d.state != 0 {
+		t.Errorf("position %d and state %d, want 0", position, d.state)
+	}
+}
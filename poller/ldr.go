@@ -0,0 +1,70 @@
+package poller
+
+import (
+	"time"
+	"context"
+	"github.com/ggueret/mbpio/gpio"
+	log "github.com/sirupsen/logrus"
+)
+
+// ldrPoller times the charge of a capacitor through a photoresistor, the
+// published value is the number of reads it took.
+type ldrPoller struct {
+	env			*Env
+}
+
+func init() {
+	Register(Descriptor{
+		Name: "LDR",
+		Interval: 10 * time.Second,
+		New: func() Poller {
+			return &ldrPoller{}
+		},
+	})
+}
+
+func (p *ldrPoller) Init(env *Env) error {
+	p.env = env
+	return nil
+}
+
+func (p *ldrPoller) Poll(ctx context.Context) error {
+	driver := p.env.GPIO
+	for _, input := range p.env.Inputs {
+		driver.PinMode(input.Pin, gpio.Input)
+		if driver.ReadPin(input.Pin) == gpio.Low {
+			continue
+		}
+
+		driver.PinMode(input.Pin, gpio.Output)
+		driver.WritePin(input.Pin, gpio.Low)
+		time.Sleep(100 * time.Millisecond)
+		driver.PinMode(input.Pin, gpio.Input)
+
+		count := 0
+		for driver.ReadPin(input.Pin) == gpio.Low {
+			count++
+			if count > 65535 {
+				log.WithFields(log.Fields{"addr": input.Addr, "pin": input.Pin}).Warning("LDR poller: timeout reached")
+				break
+			}
+		}
+		if count <= 65535 {
+			p.env.Store.SetInputRegister(input.Addr, uint16(count))
+			log.WithFields(log.Fields{"addr": input.Addr, "pin": input.Pin, "value": count}).Trace("LDR poller: value refreshed.")
+		}
+	}
+	return nil
+}
+
+func (p *ldrPoller) Close() error {
+	return nil
+}
+
+func (p *ldrPoller) Registers() []Address {
+	registers := make([]Address, 0, len(p.env.Inputs))
+	for _, input := range p.env.Inputs {
+		registers = append(registers, Address{InputRegister, input.Addr})
+	}
+	return registers
+}
@@ -0,0 +1,153 @@
+package poller
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"github.com/ggueret/mbpio/spi"
+	log "github.com/sirupsen/logrus"
+)
+
+// mcpADC is one MCP3x08 converter, identified by its bus and chip select.
+type mcpADC struct {
+	conn		spi.Conn
+	bus, cs		int
+	inputs		[]Input
+}
+
+// mcpPoller reads the channels of Microchip MCP3008 (10 bits) and MCP3208
+// (12 bits) converters on /dev/spidevB.C devices, each channel is read
+// oversample times and the average is published raw.
+type mcpPoller struct {
+	env			*Env
+	open		func(bus, cs int, cfg spi.Config) (spi.Conn, error)
+	name		string
+	bits		uint
+	adcs		[]*mcpADC
+}
+
+func init() {
+	for name, bits := range map[string]uint{"MCP3008": 10, "MCP3208": 12} {
+		name, bits := name, bits
+		Register(Descriptor{
+			Name: name,
+			Options: []Option{
+				{Name: "channel", Type: Int, Required: true},
+				{Name: "differential", Type: Bool, Default: false},
+				{Name: "oversample", Type: Int, Default: 1},
+				{Name: "bus", Type: Int, Default: 0},
+				{Name: "cs", Type: Int, Default: 0},
+				{Name: "speed", Type: Int, Default: 1000000},
+			},
+			Interval: time.Second,
+			New: func() Poller {
+				return &mcpPoller{open: spi.Open, name: name, bits: bits}
+			},
+		})
+	}
+}
+
+func (p *mcpPoller) Init(env *Env) error {
+	p.env = env
+
+	adcs := make(map[[2]int]*mcpADC)
+	speeds := make(map[[2]int]int)
+	for _, input := range env.Inputs {
+		if channel := input.Options.Int("channel"); channel < 0 || channel > 7 {
+			p.Close()
+			return fmt.Errorf("input %d: channel %d out of range 0-7", input.Addr, channel)
+		}
+		if oversample := input.Options.Int("oversample"); oversample < 1 {
+			p.Close()
+			return fmt.Errorf("input %d: oversample must be at least 1", input.Addr)
+		}
+
+		key := [2]int{input.Options.Int("bus"), input.Options.Int("cs")}
+		speed := input.Options.Int("speed")
+		adc, ok := adcs[key]
+		if !ok {
+			conn, err := p.open(key[0], key[1], spi.Config{Speed: uint32(speed), Bits: 8})
+			if err != nil {
+				p.Close()
+				return err
+			}
+			adc = &mcpADC{conn: conn, bus: key[0], cs: key[1]}
+			adcs[key] = adc
+			speeds[key] = speed
+			p.adcs = append(p.adcs, adc)
+		} else if speeds[key] != speed {
+			p.Close()
+			return fmt.Errorf("input %d: speed %d differs from the %d of spidev%d.%d", input.Addr, speed, speeds[key], key[0], key[1])
+		}
+		adc.inputs = append(adc.inputs, input)
+	}
+	return nil
+}
+
+// sample runs a single conversion, in differential mode the channel selects
+// the pair as in the datasheet (0 is CH0+/CH1-, 1 is CH0-/CH1+ and so on).
+func (p *mcpPoller) sample(adc *mcpADC, channel int, differential bool) (uint16, error) {
+	single := byte(1)
+	if differential {
+		single = 0
+	}
+
+	w, r := make([]byte, 3), make([]byte, 3)
+	if p.bits == 10 {
+		// start bit, then SGL/DIFF and D2-D0 in the high nibble of the next byte
+		w[0] = 0x01
+		w[1] = single << 7 | byte(channel) << 4
+	} else {
+		// start bit and SGL/DIFF aligned so the 12 bits end on the last byte
+		w[0] = 0x04 | single << 1 | byte(channel) >> 2
+		w[1] = byte(channel) << 6
+	}
+	if err := adc.conn.Tx(w, r); err != nil {
+		return 0, err
+	}
+	mask := byte(1 << (p.bits - 8) - 1)
+	return uint16(r[1] & mask) << 8 | uint16(r[2]), nil
+}
+
+func (p *mcpPoller) Poll(ctx context.Context) error {
+	for _, adc := range p.adcs {
+		for _, input := range adc.inputs {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			oversample := input.Options.Int("oversample")
+			sum := 0
+			var err error
+			for i := 0; i < oversample && err == nil; i++ {
+				var value uint16
+				value, err = p.sample(adc, input.Options.Int("channel"), input.Options.Bool("differential"))
+				sum += int(value)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{"addr": input.Addr, "bus": adc.bus, "cs": adc.cs}).Warningf("%s poller: %s", p.name, err)
+				continue
+			}
+
+			value := (sum + oversample / 2) / oversample
+			p.env.Store.SetInputRegister(input.Addr, uint16(value))
+			log.WithFields(log.Fields{"addr": input.Addr, "channel": input.Options.Int("channel"), "value": value}).Tracef("%s poller: value refreshed.", p.name)
+		}
+	}
+	return nil
+}
+
+func (p *mcpPoller) Close() error {
+	for _, adc := range p.adcs {
+		adc.conn.Close()
+	}
+	return nil
+}
+
+func (p *mcpPoller) Registers() []Address {
+	registers := make([]Address, 0, len(p.env.Inputs))
+	for _, input := range p.env.Inputs {
+		registers = append(registers, Address{InputRegister, input.Addr})
+	}
+	return registers
+}
@@ -0,0 +1,156 @@
+package poller
+
+import (
+	"fmt"
+	"context"
+	"testing"
+	"github.com/ggueret/mbpio/spi"
+)
+
+// mockMCP answers the conversions as a MCP3x08 clocks them out: after the
+// start bit come SGL/DIFF and D2-D0, then a sampling clock, a null bit and
+// the result MSB first. The bits the chip doesn't drive read as 1.
+type mockMCP struct {
+	bits		int
+	cfg			spi.Config
+	commands	[][]byte
+	sample		func(channel int, differential bool) uint16
+	closed		bool
+}
+
+func (m *mockMCP) Tx(w, r []byte) error {
+	if len(w) != len(r) {
+		return fmt.Errorf("tx of %d bytes, read %d", len(w), len(r))
+	}
+	m.commands = append(m.commands, append([]byte(nil), w...))
+	bit := func(i int) int {
+		return int(w[i/8] >> uint(7 - i%8) & 1)
+	}
+
+	clocks := 8 * len(w)
+	start := 0
+	for start < clocks && bit(start) == 0 {
+		start++
+	}
+	if start + 4 >= clocks {
+		return fmt.Errorf("no command in % x", w)
+	}
+	differential := bit(start + 1) == 0
+	channel := bit(start + 2) << 2 | bit(start + 3) << 1 | bit(start + 4)
+	value := m.sample(channel, differential)
+
+	// D0, the sampling clock and the null bit
+	first := start + 7
+	for i := range r {
+		r[i] = 0xff
+	}
+	for i := first - 1; i < first + m.bits && i < clocks; i++ {
+		out := 0
+		if i >= first {
+			out = int(value >> uint(m.bits - 1 - (i - first)) & 1)
+		}
+		r[i/8] = r[i/8] &^ (1 << uint(7 - i%8)) | byte(out) << uint(7 - i%8)
+	}
+	return nil
+}
+
+func (m *mockMCP) Close() error {
+	m.closed = true
+	return nil
+}
+
+func pollMCP(t *testing.T, name string, device *mockMCP, raw map[string]interface{}) (*testStore, error) {
+	t.Helper()
+	descriptor, _ := Lookup(name)
+	store := newTestStore()
+	p := descriptor.New().(*mcpPoller)
+	p.open = func(bus, cs int, cfg spi.Config) (spi.Conn, error) {
+		if bus != 0 || cs != 0 {
+			t.Errorf("opened spidev%d.%d, want spidev0.0", bus, cs)
+		}
+		device.cfg = cfg
+		return device, nil
+	}
+	err := p.Init(&Env{Store: store, Inputs: testInputs(t, name, map[int]string{0: ""}, raw)})
+	if err != nil {
+		return store, err
+	}
+	defer p.Close()
+	return store, p.Poll(context.Background())
+}
+
+func TestMCPPoller(t *testing.T) {
+	tests := []struct {
+		name			string
+		channel			int
+		differential	bool
+		value			uint16
+		command			[]byte
+	}{
+		{"MCP3008", 0, false, 0, []byte{0x01, 0x80, 0x00}},
+		{"MCP3008", 5, false, 1023, []byte{0x01, 0xd0, 0x00}},
+		{"MCP3008", 7, false, 0x2aa, []byte{0x01, 0xf0, 0x00}},
+		{"MCP3008", 3, true, 0x155, []byte{0x01, 0x30, 0x00}},
+		{"MCP3208", 0, false, 0, []byte{0x06, 0x00, 0x00}},
+		{"MCP3208", 5, false, 4095, []byte{0x07, 0x40, 0x00}},
+		{"MCP3208", 3, false, 0xabc, []byte{0x06, 0xc0, 0x00}},
+		{"MCP3208", 6, true, 0x543, []byte{0x05, 0x80, 0x00}},
+	}
+	for _, test := range tests {
+		bits := 10
+		if test.name == "MCP3208" {
+			bits = 12
+		}
+		device := &mockMCP{bits: bits, sample: func(channel int, differential bool) uint16 {
+			if channel != test.channel || differential != test.differential {
+				t.Errorf("%s: sampled channel %d differential %t", test.name, channel, differential)
+			}
+			return test.value
+		}}
+		store, err := pollMCP(t, test.name, device, map[string]interface{}{"channel": test.channel, "differential": test.differential})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if got, _ := store.inputRegister(0); got != test.value {
+			t.Errorf("%s channel %d: %#x, want %#x", test.name, test.channel, got, test.value)
+		}
+		if len(device.commands) != 1 || fmt.Sprintf("% x", device.commands[0]) != fmt.Sprintf("% x", test.command) {
+			t.Errorf("%s channel %d: commands % x, want % x", test.name, test.channel, device.commands, test.command)
+		}
+		if device.cfg != (spi.Config{Speed: 1000000, Bits: 8}) || !device.closed {
+			t.Errorf("%s: config %+v, closed %t", test.name, device.cfg, device.closed)
+		}
+	}
+}
+
+func TestMCPOversample(t *testing.T) {
+	values := []uint16{100, 101, 101, 103}
+	device := &mockMCP{bits: 10, sample: func(int, bool) uint16 {
+		value := values[0]
+		values = values[1:]
+		return value
+	}}
+	store, err := pollMCP(t, "MCP3008", device, map[string]interface{}{"channel": 1, "oversample": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 405 / 4 rounded
+	if got, _ := store.inputRegister(0); got != 101 || len(device.commands) != 4 {
+		t.Errorf("%d after %d conversions, want 101 after 4", got, len(device.commands))
+	}
+}
+
+func TestMCPInitErrors(t *testing.T) {
+	for _, raw := range []map[string]interface{}{
+		{"channel": 8},
+		{"channel": -1},
+		{"channel": 0, "oversample": 0},
+	} {
+		device := &mockMCP{bits: 10}
+		if _, err := pollMCP(t, "MCP3008", device, raw); err == nil {
+			t.Errorf("%v accepted", raw)
+		}
+	}
+}
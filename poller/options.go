@@ -0,0 +1,140 @@
+package poller
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+type OptionType int
+
+const (
+	String OptionType = iota
+	Int
+	Float
+	Bool
+	Duration
+)
+
+var OptionTypeStrings = map[OptionType]string {
+	String: "string",
+	Int: "integer",
+	Float: "number",
+	Bool: "boolean",
+	Duration: "duration",
+}
+
+// Option describes one key of the options map of an input. A required option
+// has no default.
+type Option struct {
+	Name			string
+	Type			OptionType
+	Default			interface{}
+	Required		bool
+}
+
+// Options holds validated values, converted to string, int, float64, bool or
+// time.Duration according to the schema.
+type Options map[string]interface{}
+
+func (o Options) Has(name string) bool {
+	_, ok := o[name]
+	return ok
+}
+
+func (o Options) String(name string) string {
+	value, _ := o[name].(string)
+	return value
+}
+
+func (o Options) Int(name string) int {
+	value, _ := o[name].(int)
+	return value
+}
+
+func (o Options) Float(name string) float64 {
+	value, _ := o[name].(float64)
+	return value
+}
+
+func (o Options) Bool(name string) bool {
+	value, _ := o[name].(bool)
+	return value
+}
+
+func (o Options) Duration(name string) time.Duration {
+	value, _ := o[name].(time.Duration)
+	return value
+}
+
+func convert(opt Option, raw interface{}) (interface{}, error) {
+	switch opt.Type {
+	case String:
+		if value, ok := raw.(string); ok {
+			return value, nil
+		}
+	case Int:
+		switch value := raw.(type) {
+		case int:
+			return value, nil
+		case float64:
+			if value == math.Trunc(value) {
+				return int(value), nil
+			}
+		}
+	case Float:
+		switch value := raw.(type) {
+		case int:
+			return float64(value), nil
+		case float64:
+			return value, nil
+		}
+	case Bool:
+		if value, ok := raw.(bool); ok {
+			return value, nil
+		}
+	case Duration:
+		switch value := raw.(type) {
+		case time.Duration:
+			return value, nil
+		case string:
+			return time.ParseDuration(value)
+		}
+	}
+	return nil, fmt.Errorf("expected a %s, got %v", OptionTypeStrings[opt.Type], raw)
+}
+
+// Validate checks the raw options of an input against the schema of the
+// poller and fills the defaults.
+func (d Descriptor) Validate(raw map[string]interface{}) (Options, error) {
+	options := make(Options)
+	known := make(map[string]bool)
+
+	for _, opt := range d.Options {
+		known[opt.Name] = true
+
+		value, ok := raw[opt.Name]
+		if !ok {
+			if opt.Required {
+				return nil, fmt.Errorf("%s poller: missing option %q", d.Name, opt.Name)
+			}
+			if opt.Default == nil {
+				continue
+			}
+			value = opt.Default
+		}
+
+		converted, err := convert(opt, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s poller: option %q: %s", d.Name, opt.Name, err)
+		}
+		options[opt.Name] = converted
+	}
+
+	for name := range raw {
+		if !known[name] {
+			return nil, fmt.Errorf("%s poller: unknown option %q", d.Name, name)
+		}
+	}
+	return options, nil
+}
@@ -0,0 +1,112 @@
+package poller
+
+import (
+	"sync"
+	"time"
+	"context"
+	"github.com/ggueret/mbpio/gpio"
+	log "github.com/sirupsen/logrus"
+)
+
+// pbPoller mirrors the level of its pins into discrete inputs on every edge,
+// the periodic poll only resynchronizes them. With a debounce the level is
+// published once the pin stopped bouncing. Inputs without poller are handled
+// by it too.
+type pbPoller struct {
+	env			*Env
+	pins		map[gpio.Pin][]int
+	wg			sync.WaitGroup
+}
+
+func init() {
+	Register(Descriptor{
+		Name: "PB",
+		Interval: 10 * time.Second,
+		New: func() Poller {
+			return &pbPoller{}
+		},
+	})
+}
+
+func (p *pbPoller) Init(env *Env) error {
+	p.env = env
+	p.pins = make(map[gpio.Pin][]int)
+	debounces := make(map[gpio.Pin]time.Duration)
+	for _, input := range env.Inputs {
+		p.pins[input.Pin] = append(p.pins[input.Pin], input.Addr)
+		if input.Debounce > debounces[input.Pin] {
+			debounces[input.Pin] = input.Debounce
+		}
+	}
+
+	for pin, addrs := range p.pins {
+		env.GPIO.PinMode(pin, gpio.Input)
+		events, err := env.GPIO.Watch(pin, gpio.AnyEdge)
+		if err != nil {
+			p.Close()
+			return err
+		}
+
+		p.wg.Add(1)
+		go p.watch(pin, addrs, events, debounces[pin])
+	}
+	return nil
+}
+
+// watch publishes the level of pin on every edge, or once it has been stable
+// for the debounce interval.
+func (p *pbPoller) watch(pin gpio.Pin, addrs []int, events <-chan gpio.Event, debounce time.Duration) {
+	defer p.wg.Done()
+
+	var settled <-chan time.Time
+	for {
+		state := gpio.Low
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if debounce > 0 {
+				settled = time.After(debounce)
+				continue
+			}
+			state = event.State()
+		case <-settled:
+			settled = nil
+			state = p.env.GPIO.ReadPin(pin)
+		}
+		p.publish(addrs, state)
+		log.WithFields(log.Fields{"addrs": addrs, "pin": pin, "state": gpio.StateStrings[state]}).Trace("PB poller: input changed")
+	}
+}
+
+func (p *pbPoller) publish(addrs []int, state gpio.State) {
+	for _, addr := range addrs {
+		p.env.Store.SetDiscreteInput(addr, state == gpio.High)
+	}
+}
+
+func (p *pbPoller) Poll(ctx context.Context) error {
+	for pin, addrs := range p.pins {
+		p.publish(addrs, p.env.GPIO.ReadPin(pin))
+	}
+	return nil
+}
+
+// Close unwatches the pins, which closes the event channels and ends the
+// goroutines.
+func (p *pbPoller) Close() error {
+	for pin := range p.pins {
+		p.env.GPIO.Unwatch(pin)
+	}
+	p.wg.Wait()
+	return nil
+}
+
+func (p *pbPoller) Registers() []Address {
+	registers := make([]Address, 0, len(p.env.Inputs))
+	for _, input := range p.env.Inputs {
+		registers = append(registers, Address{DiscreteInput, input.Addr})
+	}
+	return registers
+}
@@ -0,0 +1,168 @@
+package poller
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+	"context"
+	"strings"
+	"github.com/ggueret/mbpio/gpio"
+)
+
+type Kind int
+
+const (
+	InputRegister Kind = iota
+	DiscreteInput
+	HoldingRegister
+	Coil
+)
+
+var KindStrings = map[Kind]string {
+	InputRegister: "input register",
+	DiscreteInput: "discrete input",
+	HoldingRegister: "holding register",
+	Coil: "coil",
+}
+
+// Address is a Modbus register a poller writes to.
+type Address struct {
+	Kind			Kind
+	Addr			int
+}
+
+// Store receives the values published by the pollers.
+type Store interface {
+	SetInputRegister(addr int, value uint16)
+	SetDiscreteInput(addr int, value bool)
+}
+
+// Input is one configured input handled by a poller, Value is its value
+// selector and Options its validated options. Pull is nil when the input
+// keeps the pull of the board, the polarity is applied by the driver before
+// Init and Debounce is left to the pollers watching edges.
+type Input struct {
+	Addr			int
+	Pin				gpio.Pin
+	Pull			*gpio.Pull
+	ActiveLow		bool
+	Debounce		time.Duration
+	Value			string
+	Options			Options
+}
+
+// Retainer keeps values across restarts, the keys are chosen by the pollers.
+type Retainer interface {
+	Retained(key string) (int64, bool)
+	Retain(key string, value int64)
+}
+
+type Env struct {
+	GPIO			gpio.Driver
+	Store			Store
+	Retainer		Retainer
+	Inputs			[]Input
+}
+
+// Poller reads a kind of sensor. Init is called once with the inputs it
+// handles, then Poll on every interval until the server stops and Close is
+// called.
+type Poller interface {
+	Init(env *Env) error
+	Poll(ctx context.Context) error
+	Close() error
+	Registers() []Address
+}
+
+// Writer is implemented by the pollers taking Modbus writes on the coils or
+// holding registers they declare. It is called with the register map locked
+// and returns the value to store, an error rejects the write.
+type Writer interface {
+	WriteCoil(addr int, value bool) (bool, error)
+	WriteHoldingRegister(addr int, value uint16) (uint16, error)
+}
+
+// Descriptor declares a poller type. Values lists the accepted value
+// selectors, the first one is the default, and Options the schema of the
+// per-input options. Interval is the default polling interval, MinInterval
+// the fastest rate the sensor supports.
+type Descriptor struct {
+	Name			string
+	Values			[]string
+	Options			[]Option
+	Interval		time.Duration
+	MinInterval		time.Duration
+	New				func() Poller
+}
+
+var (
+	mu sync.RWMutex
+	registry = make(map[string]Descriptor)
+)
+
+// Register makes a poller type available to the configuration, it is meant
+// to be called from the init function of the package implementing it.
+func Register(d Descriptor) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	name := strings.ToUpper(d.Name)
+	if d.New == nil {
+		panic(fmt.Sprintf("poller: %s registered without constructor", name))
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("poller: %s registered twice", name))
+	}
+	registry[name] = d
+}
+
+func Lookup(name string) (Descriptor, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	d, ok := registry[strings.ToUpper(name)]
+	return d, ok
+}
+
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Value checks the value selector of an input, an empty one gets the default.
+func (d Descriptor) Value(value string) (string, error) {
+	if len(d.Values) == 0 {
+		if value != "" {
+			return "", fmt.Errorf("%s poller does not take a value", d.Name)
+		}
+		return "", nil
+	}
+	if value == "" {
+		return d.Values[0], nil
+	}
+	for _, v := range d.Values {
+		if strings.EqualFold(v, value) {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("unknown %s value %q, choices: %s", d.Name, value, strings.Join(d.Values, ", "))
+}
+
+// FixedPoint converts a reading to a signed fixed-point register value,
+// saturating at the int16 bounds.
+func FixedPoint(value, scale float64) uint16 {
+	scaled := math.Round(value * scale)
+	if scaled > math.MaxInt16 {
+		scaled = math.MaxInt16
+	} else if scaled < math.MinInt16 {
+		scaled = math.MinInt16
+	}
+	return uint16(int16(scaled))
+}
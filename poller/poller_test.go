@@ -0,0 +1,117 @@
+package poller
+
+import (
+	"net"
+	"sync"
+	"time"
+	"bufio"
+	"strings"
+	"testing"
+	"path/filepath"
+	"github.com/ggueret/mbpio/gpio"
+)
+
+// testStore records the values published by a poller.
+type testStore struct {
+	mu					sync.Mutex
+	inputRegisters		map[int]uint16
+	discreteInputs		map[int]bool
+}
+
+func newTestStore() *testStore {
+	return &testStore{inputRegisters: make(map[int]uint16), discreteInputs: make(map[int]bool)}
+}
+
+func (s *testStore) SetInputRegister(addr int, value uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inputRegisters[addr] = value
+}
+
+func (s *testStore) SetDiscreteInput(addr int, value bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discreteInputs[addr] = value
+}
+
+func (s *testStore) inputRegister(addr int) (uint16, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.inputRegisters[addr]
+	return value, ok
+}
+
+// openSim opens the sim driver, closed with the test, and returns a function
+// sending a command to its control socket.
+func openSim(t *testing.T) (gpio.Driver, func(command string)) {
+	t.Helper()
+	control := filepath.Join(t.TempDir(), "sim.sock")
+	driver, err := gpio.New("sim", gpio.Options{Control: control})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { driver.Close() })
+
+	return driver, func(command string) {
+		t.Helper()
+		conn, err := net.Dial("unix", control)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(command + "\n"))
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply = strings.TrimSpace(reply); reply != "ok" {
+			t.Fatalf("%s: %s", command, reply)
+		}
+	}
+}
+
+// testInputs builds the inputs of a poller type with their default options,
+// value selectors being given by address.
+func testInputs(t *testing.T, name string, values map[int]string, raw map[string]interface{}) []Input {
+	t.Helper()
+	descriptor, ok := Lookup(name)
+	if !ok {
+		t.Fatalf("no %s poller", name)
+	}
+	options, err := descriptor.Validate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inputs []Input
+	for addr, value := range values {
+		value, err := descriptor.Value(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, Input{Addr: addr, Value: value, Options: options})
+	}
+	return inputs
+}
+
+func TestFixedPoint(t *testing.T) {
+	tests := []struct {
+		value	float64
+		scale	float64
+		want	uint16
+	}{
+		{25.08, 10, 251},
+		{-10.1, 10, 0xff9b},
+		{1006.53, 10, 10065},
+		{4000, 10, 0x7fff},
+		{-4000, 10, 0x8000},
+	}
+	for _, test := range tests {
+		if got := FixedPoint(test.value, test.scale); got != test.want {
+			t.Errorf("FixedPoint(%v, %v) = %#x, want %#x", test.value, test.scale, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package poller
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"errors"
+	"context"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errW1CRC = errors.New("crc check failed")
+	errW1Reset = errors.New("power-on reset value, no conversion done")
+)
+
+// w1thermPoller reads the 1-Wire thermometers exposed by the w1_therm kernel
+// driver, inputs are mapped to the probes by their ROM ID (28-00000a1b2c3d).
+// The temperature is published as a signed fixed-point value, the optional
+// status discrete input is raised when a read or its CRC fails.
+type w1thermPoller struct {
+	env			*Env
+}
+
+func init() {
+	for _, name := range []string{"DS18B20", "W1THERM"} {
+		Register(Descriptor{
+			Name: name,
+			Options: []Option{
+				{Name: "rom", Type: String, Required: true},
+				{Name: "root", Type: String, Default: "/sys/bus/w1/devices"},
+				{Name: "scale", Type: Float, Default: 10.0},
+				{Name: "status", Type: Int},
+			},
+			Interval: time.Minute,
+			MinInterval: time.Second,
+			New: func() Poller {
+				return &w1thermPoller{}
+			},
+		})
+	}
+}
+
+// discoverW1 lists the devices of the bus, the bus masters are left out.
+func discoverW1(root string) ([]string, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	roms := []string{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "w1_bus_master") {
+			roms = append(roms, entry.Name())
+		}
+	}
+	return roms, nil
+}
+
+func (p *w1thermPoller) Init(env *Env) error {
+	p.env = env
+
+	mapped := make(map[string]map[string]bool)
+	for _, input := range env.Inputs {
+		root, rom := input.Options.String("root"), strings.ToLower(input.Options.String("rom"))
+		if _, ok := mapped[root]; !ok {
+			mapped[root] = make(map[string]bool)
+		}
+		if mapped[root][rom] {
+			return fmt.Errorf("rom %s mapped twice", rom)
+		}
+		mapped[root][rom] = true
+	}
+
+	for root, roms := range mapped {
+		found, err := discoverW1(root)
+		if err != nil {
+			log.Warnf("W1THERM poller: cannot list %s: %s", root, err)
+			continue
+		}
+		for _, rom := range found {
+			if !roms[rom] {
+				log.WithFields(log.Fields{"root": root, "rom": rom}).Info("W1THERM poller: unmapped device found")
+			}
+			delete(roms, rom)
+		}
+		for rom := range roms {
+			log.WithFields(log.Fields{"root": root, "rom": rom}).Warn("W1THERM poller: device not found on the bus")
+		}
+	}
+	return nil
+}
+
+// parseW1Slave decodes the content of w1_slave, the first line holds the
+// scratchpad with the CRC verdict and the second one the temperature in
+// millidegrees:
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+//
+// A probe which lost its power reads 85°C with the scratchpad of its reset
+// (50 05 ... 0c), that reading is dropped.
+func parseW1Slave(content string) (int, error) {
+	lines := strings.Split(strings.TrimSpace(content), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected w1_slave content %q", content)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, errW1CRC
+	}
+	i := strings.LastIndex(lines[1], "t=")
+	if i < 0 {
+		return 0, fmt.Errorf("no temperature in %q", lines[1])
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(lines[1][i+2:]))
+	if err != nil {
+		return 0, err
+	}
+	scratchpad := strings.Fields(lines[1][:i])
+	if milli == 85000 && len(scratchpad) == 9 && scratchpad[0] == "50" && scratchpad[1] == "05" && scratchpad[6] == "0c" {
+		return 0, errW1Reset
+	}
+	return milli, nil
+}
+
+func (p *w1thermPoller) Poll(ctx context.Context) error {
+	for _, input := range p.env.Inputs {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		rom := strings.ToLower(input.Options.String("rom"))
+		content, err := ioutil.ReadFile(filepath.Join(input.Options.String("root"), rom, "w1_slave"))
+		milli := 0
+		if err == nil {
+			milli, err = parseW1Slave(string(content))
+		}
+		if input.Options.Has("status") {
+			p.env.Store.SetDiscreteInput(input.Options.Int("status"), err != nil)
+		}
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = errors.New("device not found on the bus")
+			}
+			log.WithFields(log.Fields{"addr": input.Addr, "rom": rom}).Warnf("W1THERM poller: %s", err)
+			continue
+		}
+
+		value := float64(milli) / 1000
+		p.env.Store.SetInputRegister(input.Addr, FixedPoint(value, input.Options.Float("scale")))
+		log.WithFields(log.Fields{"addr": input.Addr, "rom": rom, "temperature": value}).Trace("W1THERM poller: value refreshed.")
+	}
+	return nil
+}
+
+func (p *w1thermPoller) Close() error {
+	return nil
+}
+
+func (p *w1thermPoller) Registers() []Address {
+	registers := make([]Address, 0, len(p.env.Inputs))
+	for _, input := range p.env.Inputs {
+		registers = append(registers, Address{InputRegister, input.Addr})
+		if input.Options.Has("status") {
+			registers = append(registers, Address{DiscreteInput, input.Options.Int("status")})
+		}
+	}
+	return registers
+}
@@ -0,0 +1,98 @@
+package poller
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseW1Slave(t *testing.T) {
+	tests := []struct {
+		content		string
+		milli		int
+		err			error
+	}{
+		{"72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n", 23125, nil},
+		{"72 01 4b 46 7f ff 0e 10 57 : crc=a4 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n", 0, errW1CRC},
+		{"50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n", 0, errW1Reset},
+		{"50 05 4b 46 7f ff 10 10 bb : crc=bb YES\n50 05 4b 46 7f ff 10 10 bb t=85000\n", 85000, nil},
+	}
+	for _, test := range tests {
+		milli, err := parseW1Slave(test.content)
+		if milli != test.milli || err != test.err {
+			t.Errorf("%q: %d %v, want %d %v", test.content, milli, err, test.milli, test.err)
+		}
+	}
+	for _, content := range []string{"", "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES", "00 : crc=00 YES\n00", "00 : crc=00 YES\n00 t=abc"} {
+		if milli, err := parseW1Slave(content); err == nil {
+			t.Errorf("%q: parsed %d", content, milli)
+		}
+	}
+}
+
+// TestW1ThermPoller polls the probes of testdata/w1, each one with its
+// status discrete input at the address of its register.
+func TestW1ThermPoller(t *testing.T) {
+	descriptor, _ := Lookup("DS18B20")
+	roms := []string{
+		"28-0000072a1b2c",	// 23.125°C
+		"28-0000072A1B2D",	// crc NO
+		"28-0000072a1b2e",	// power-on reset
+		"28-0000072a1b2f",	// -10.125°C
+		"28-0000072a1b30",	// 85°C
+		"28-0000072a1b31",	// not on the bus
+	}
+	var inputs []Input
+	for addr, rom := range roms {
+		options, err := descriptor.Validate(map[string]interface{}{"rom": rom, "root": "testdata/w1", "status": addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, Input{Addr: addr, Options: options})
+	}
+
+	store := newTestStore()
+	p := descriptor.New()
+	if err := p.Init(&Env{Store: store, Inputs: inputs}); err != nil {
+		t.Fatal(err)
+	}
+	// a register left unset by a failed read is kept at -1
+	for addr := range roms {
+		store.SetInputRegister(addr, 0xffff)
+	}
+	if err := p.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		value	uint16
+		failed	bool
+	}{
+		{231, false},
+		{0xffff, true},
+		{0xffff, true},
+		{0xff9b, false},
+		{850, false},
+		{0xffff, true},
+	}
+	for addr, want := range want {
+		value, _ := store.inputRegister(addr)
+		if value != want.value || store.discreteInputs[addr] != want.failed {
+			t.Errorf("%s: register %#x status %t, want %#x %t", roms[addr], value, store.discreteInputs[addr], want.value, want.failed)
+		}
+	}
+}
+
+func TestW1ThermInit(t *testing.T) {
+	descriptor, _ := Lookup("W1THERM")
+	var inputs []Input
+	for addr, rom := range []string{"28-0000072a1b2c", "28-0000072A1B2C"} {
+		options, err := descriptor.Validate(map[string]interface{}{"rom": rom, "root": "testdata/w1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, Input{Addr: addr, Options: options})
+	}
+	if err := descriptor.New().Init(&Env{Store: newTestStore(), Inputs: inputs}); err == nil {
+		t.Error("rom mapped twice accepted")
+	}
+}
@@ -1,223 +1,300 @@
 package main
 
 import (
+	"fmt"
+	"sort"
 	"time"
-	"errors"
-//	"github.com/d2r2/go-dht"
-//	"github.com/ggueret/mbpio/config"
+	"context"
+	"strings"
+	"math/rand"
 	"github.com/ggueret/mbpio/gpio"
+	"github.com/ggueret/mbpio/poller"
 	log "github.com/sirupsen/logrus"
-	"github.com/stianeikeland/go-rpio"
 )
 
-var DHTMaxCount = 32000
-var TimeoutError = errors.New("Timeout")
+// pollerGroup is a poller instance with the inputs it handles, the inputs
+// of a type sharing a pin are grouped so the sensor is read once per poll.
+type pollerGroup struct {
+	descriptor		poller.Descriptor
+	poller			poller.Poller
+	env				*poller.Env
+	pin				gpio.Pin
+	interval		time.Duration
+	jitter			time.Duration
+}
 
-func (s *Server) RegisterPollers() {
-	var pollers = map[string]func([]int){
-		"DHT22": s.PollDHT22,
-		"LDR": s.PollLDR,
-		"PB": s.PollPB,
+// pollerSettings returns the interval and jitter of a poller type, from the
+// pollers section, the global settings or the poller defaults.
+func (s *Server) pollerSettings(descriptor poller.Descriptor) (interval, jitter time.Duration) {
+	interval, jitter = descriptor.Interval, s.cfg.PollJitter
+	if s.cfg.PollEvery > 0 {
+		interval = time.Duration(s.cfg.PollEvery)
 	}
-
-	for name, function := range pollers {
-		s.pollers[name] = function
+	for name, settings := range s.cfg.Pollers {
+		if !strings.EqualFold(name, descriptor.Name) {
+			continue
+		}
+		if settings.Interval > 0 {
+			interval = settings.Interval
+		}
+		if settings.Jitter > 0 {
+			jitter = settings.Jitter
+		}
 	}
+	return interval, jitter
 }
 
-
-func (s *Server) PollPB(inputs []int) {
-	s.wg.Add(1)
-	defer s.wg.Done()
-
-	doPoll := func() {
-
-		for _, addr := range inputs {
-			input := s.cfg.Inputs[addr]
-			state := input.Pin.Read()
-
-			s.mu.Lock()
-			s.mb.DiscreteInputs[addr] = uint8(state)
-			s.mu.Unlock()
+// LoadPollers builds the poller groups from the configured inputs, unknown
+// types and invalid options are reported before anything is started.
+func (s *Server) LoadPollers() error {
+	for name := range s.cfg.Pollers {
+		if _, ok := poller.Lookup(name); !ok {
+			return fmt.Errorf("pollers: unknown poller type %q, choices: %s", name, strings.Join(poller.Names(), ", "))
 		}
 	}
 
-	ticker := time.NewTicker(time.Second * 10)
-	defer ticker.Stop()
-
-
-	doPoll()
-	for {
-		select {
-			case <- ticker.C:
-				doPoll()
-			case <- s.quit:
-				log.Info("PB poller terminated.")
-				return
-			default:
+	for _, u := range s.units {
+		if err := s.loadUnitPollers(u); err != nil {
+			return u.wrap(err)
 		}
 	}
+	return nil
 }
 
-func (s *Server) PollLDR(inputs []int) {
-	s.wg.Add(1)
-	defer s.wg.Done()
-
-	doPoll := func() {
+func (s *Server) loadUnitPollers(u *unit) error {
+	addrs := make([]int, 0, len(u.inputs))
+	for addr := range u.inputs {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+
+	groups := make(map[string]*pollerGroup)
+	for _, addr := range addrs {
+		input := u.inputs[addr]
+
+		// inputs without poller are plain discrete inputs
+		name, value, options := "PB", "", map[string]interface{}(nil)
+		if input.Poller != nil {
+			name, options = input.Poller.Type, input.Poller.Options
+			if input.Poller.Value != nil {
+				value = *input.Poller.Value
+			}
+		}
 
-		for _, addr := range inputs {
-			input := s.cfg.Inputs[addr]
+		descriptor, ok := poller.Lookup(name)
+		if !ok {
+			return fmt.Errorf("input %d: unknown poller type %q, choices: %s", addr, name, strings.Join(poller.Names(), ", "))
+		}
+		value, err := descriptor.Value(value)
+		if err != nil {
+			return fmt.Errorf("input %d: %s", addr, err)
+		}
+		validated, err := descriptor.Validate(options)
+		if err != nil {
+			return fmt.Errorf("input %d: %s", addr, err)
+		}
 
-			input.Pin.Input()
-			if input.Pin.Read() == gpio.Low {
-				continue
+		var pull *gpio.Pull
+		if input.Pull != "" {
+			parsed, err := gpio.ParsePull(input.Pull)
+			if err != nil {
+				return fmt.Errorf("input %d: %s", addr, err)
 			}
+			pull = &parsed
+		}
 
-			input.Pin.Output()
-			input.Pin.Low()
-			time.Sleep(100 * time.Millisecond)
-			input.Pin.Input()
-
-			count := uint16(0)
-			for input.Pin.Read() == gpio.Low {
-				count++
-				if count > 65535 {
-					log.WithFields(log.Fields{"addr": addr, "pin": input.Pin}).Warning("LDR poller: timeout reached")
-					break
-				}
+		interval, jitter := s.pollerSettings(descriptor)
+		if input.Poller != nil && input.Poller.Interval > 0 {
+			interval = input.Poller.Interval
+		}
+		if interval < descriptor.MinInterval {
+			log.WithFields(log.Fields{"addr": addr, "pin": input.Pin, "type": descriptor.Name}).Warnf("interval %s is below the %s minimum, using %s", interval, descriptor.Name, descriptor.MinInterval)
+			interval = descriptor.MinInterval
+		}
+		if interval <= 0 {
+			return fmt.Errorf("input %d: %s poller needs an interval", addr, descriptor.Name)
+		}
+
+		key := fmt.Sprintf("%s/%d", descriptor.Name, input.Pin)
+		group, ok := groups[key]
+		if !ok {
+			group = &pollerGroup{
+				descriptor: descriptor,
+				env: &poller.Env{GPIO: s.gpio, Store: u},
+				pin: input.Pin,
+				interval: interval,
+				jitter: jitter,
 			}
-			if count <= 65535 {
-				s.mu.Lock()
-				s.mb.InputRegisters[addr] = count
-				s.mu.Unlock()
-				log.WithFields(log.Fields{"addr": addr, "pin": input.Pin, "value": count}).Trace("LDR poller: value refreshed.")
+			if s.state != nil {
+				group.env.Retainer = s.state
 			}
+			groups[key] = group
+			u.pollers = append(u.pollers, group)
+		} else if interval < group.interval {
+			group.interval = interval
 		}
-	}
-
-	ticker := time.NewTicker(time.Second * 10)
-	defer ticker.Stop()
 
+		log.WithFields(log.Fields{"unit": u.id, "addr": addr, "pin": input.Pin, "type": descriptor.Name, "value": value, "interval": interval}).Debug("Registering i/o input")
+		group.env.Inputs = append(group.env.Inputs, poller.Input{
+			Addr: addr,
+			Pin: input.Pin,
+			Pull: pull,
+			ActiveLow: input.ActiveLow,
+			Debounce: input.Debounce,
+			Value: value,
+			Options: validated,
+		})
+	}
+	return nil
+}
 
-	doPoll()
-	for {
-		select {
-			case <- ticker.C:
-				doPoll()
-			case <- s.quit:
-				log.Info("LDR poller terminated.")
-				return
-			default:
+// InitPollers initializes every poller and checks that no register of a unit
+// is declared twice, the coils and holding registers of the pollers taking
+// writes are routed to them.
+func (s *Server) InitPollers() error {
+	for _, u := range s.units {
+		if err := s.initUnitPollers(u); err != nil {
+			return u.wrap(err)
 		}
 	}
+	return nil
 }
 
-func (s *Server) PollDHT22(inputs []int) {
-	s.wg.Add(1)
-	defer s.wg.Done()
-
-	doPoll := func() {
-		for _, addr := range inputs {
-			input := s.cfg.Inputs[addr]
-
-			lengths := make([]time.Duration, 40)
-			iteration := 0
-
-			// Send init
-			input.Pin.Output()
+func (s *Server) initUnitPollers(u *unit) error {
+	owners := make(map[poller.Address]string)
+	u.writers = make(map[poller.Address]poller.Writer)
 
-			input.Pin.High()
-			time.Sleep(250 * time.Millisecond)
-
-			input.Pin.Low()
-			time.Sleep(5 * time.Millisecond)
-
-			input.Pin.High()
-			time.Sleep(20 * time.Microsecond)
-
-			input.Pin.Input()
+	for _, group := range u.pollers {
+		for _, input := range group.env.Inputs {
+			s.setupInput(input)
+		}
 
-			for {
-				log.Print(input.Pin.Read())
-				iteration++
-				if iteration >= 80 {
-					break
-				}
+		group.poller = group.descriptor.New()
+		if err := group.poller.Init(group.env); err != nil {
+			return fmt.Errorf("%s poller: %s", group.descriptor.Name, err)
+		}
 
+		for _, register := range group.poller.Registers() {
+			if register.Addr < 0 || register.Addr > 65535 {
+				return fmt.Errorf("%s poller: %s %d out of range", group.descriptor.Name, poller.KindStrings[register.Kind], register.Addr)
 			}
-			continue
-			for {
-				duration, err := TimePulse(&input.Pin, gpio.High)
-				if err != nil {
-					log.WithFields(log.Fields{"addr": addr, "pin": input.Pin}).Warning("DHT22 poller: timeout reached")
-					break
-				}
-				lengths[iteration] = duration
-				iteration++
-				if iteration >= 40 {
-					break
-				}
+			if owner, ok := owners[register]; ok {
+				return fmt.Errorf("%s poller: %s %d already used by %s", group.descriptor.Name, poller.KindStrings[register.Kind], register.Addr, owner)
+			}
+			if _, ok := u.outputs[register.Addr]; ok && (register.Kind == poller.Coil || register.Kind == poller.HoldingRegister) {
+				return fmt.Errorf("%s poller: %s %d already used by an output", group.descriptor.Name, poller.KindStrings[register.Kind], register.Addr)
+			}
+			owners[register] = fmt.Sprintf("the %s poller", group.descriptor.Name)
+
+			if writer, ok := group.poller.(poller.Writer); ok && (register.Kind == poller.Coil || register.Kind == poller.HoldingRegister) {
+				u.writers[register] = writer
 			}
-			break
 		}
 	}
 
-	ticker := time.NewTicker(time.Second * 60)
-	defer ticker.Stop()
+	// the current input registers of the pwm outputs are owned like the
+	// registers of a poller
+	addrs := make([]int, 0, len(u.outputs))
+	for addr := range u.outputs {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		output := u.outputs[addr]
+		if output.Pwm == nil || output.Pwm.Current == nil {
+			continue
+		}
+		register := poller.Address{Kind: poller.InputRegister, Addr: *output.Pwm.Current}
+		if owner, ok := owners[register]; ok {
+			return fmt.Errorf("output %d: current input register %d already used by %s", addr, *output.Pwm.Current, owner)
+		}
+		owners[register] = fmt.Sprintf("output %d", addr)
+	}
 
-	doPoll()
-	for {
-		select {
-			case <- ticker.C:
-				doPoll()
-			case <- s.quit:
-				log.Info("DHT22 poller terminated.")
-				return
-			default:
+	if status := s.cfg.CommStatus; status != nil {
+		register := poller.Address{Kind: poller.DiscreteInput, Addr: *status}
+		if owner, ok := owners[register]; ok {
+			return fmt.Errorf("comm_status: discrete input %d already used by %s", *status, owner)
 		}
 	}
+	return nil
 }
 
-
-func TimePulse(pin *gpio.Pin, state rpio.State) (time.Duration, error) {
-	aroundState := gpio.Low
-	if state == gpio.Low {
-		aroundState = gpio.High
+// setupInput applies the pull and polarity of an input to its pin.
+func (s *Server) setupInput(input poller.Input) {
+	if input.Pull != nil {
+		log.WithFields(log.Fields{"addr": input.Addr, "pin": input.Pin, "pull": gpio.PullStrings[*input.Pull]}).Debug("Setting the input pull")
+		s.gpio.PullMode(input.Pin, *input.Pull)
 	}
-	cnt := 0
-	for {
-		if pin.Read() == aroundState {
-			break
-		}
-		cnt++
-		if cnt >= DHTMaxCount {
-			return time.Duration(0), TimeoutError
-		}
+	if input.ActiveLow {
+		log.WithFields(log.Fields{"addr": input.Addr, "pin": input.Pin}).Debug("Setting the input active low")
+		s.gpio.ActiveLow(input.Pin, true)
 	}
+}
 
-	cnt = 0
+// runPoller polls the group every interval plus a random part of the jitter,
+// the first poll is only delayed by the jitter so the groups don't all
+// hit the bus at once.
+func (s *Server) runPoller(ctx context.Context, group *pollerGroup) {
+	defer s.wg.Done()
+	defer group.poller.Close()
+
+	name := group.descriptor.Name
+	delay := time.Duration(0)
 	for {
-		if pin.Read() == state {
-			break
-		}
-		cnt++
-		if cnt >= DHTMaxCount {
-			return time.Duration(0), TimeoutError
+		if group.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(group.jitter)))
 		}
-	}
 
-	startTime := time.Now()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			log.WithFields(log.Fields{"pin": group.pin}).Infof("%s poller terminated.", name)
+			return
+		}
 
-	cnt = 0
-	for {
-		if pin.Read() == aroundState {
-			break
+		started := time.Now()
+		if err := group.poller.Poll(ctx); err != nil && ctx.Err() == nil {
+			log.WithFields(log.Fields{"pin": group.pin}).Warningf("%s poller: %s", name, err)
 		}
-		cnt++
-		if cnt >= DHTMaxCount {
-			return time.Duration(0), TimeoutError
+
+		// keep the period regardless of the time spent polling
+		delay = group.interval - time.Since(started)
+		if delay < 0 {
+			delay = 0
 		}
 	}
+}
 
-	return time.Since(startTime), nil
-}
\ No newline at end of file
+// writePollerCoil hands a coil write to the poller owning the coil, handled
+// is false when there is none. The register map must be locked.
+func (s *Server) writePollerCoil(u *unit, addr int, value bool) (handled bool, err error) {
+	writer, ok := u.writers[poller.Address{Kind: poller.Coil, Addr: addr}]
+	if !ok {
+		return false, nil
+	}
+	value, err = writer.WriteCoil(addr, value)
+	if err != nil {
+		return true, err
+	}
+	u.coils[addr] = 0
+	if value {
+		u.coils[addr] = 1
+	}
+	return true, nil
+}
+
+func (s *Server) writePollerHoldingRegister(u *unit, addr int, value uint16) (handled bool, err error) {
+	writer, ok := u.writers[poller.Address{Kind: poller.HoldingRegister, Addr: addr}]
+	if !ok {
+		return false, nil
+	}
+	value, err = writer.WriteHoldingRegister(addr, value)
+	if err != nil {
+		return true, err
+	}
+	u.holdingRegisters[addr] = value
+	return true, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestInitPollersOwners checks that the registers written by the server are
+// never owned by a poller, err is a part of the expected error.
+func TestInitPollersOwners(t *testing.T) {
+	tests := []configTest{
+		{"comm status", `
+comm_status: 500
+inputs: {103: {pin: 23}}
+`, ""},
+		{"comm status last address", `
+comm_status: 65535
+inputs: {103: {pin: 23}}
+`, ""},
+		{"comm status negative", `
+comm_status: -1
+`, "comm_status -1 out of range"},
+		{"comm status over 65535", `
+comm_status: 65536
+`, "comm_status 65536 out of range"},
+		{"comm status on a discrete input", `
+comm_status: 103
+inputs: {103: {pin: 23}}
+`, "comm_status: discrete input 103 already used by the PB poller"},
+		{"comm status on a poller status", `
+comm_status: 200
+inputs: {120: {poller: {type: DS18B20, options: {rom: 28-00000a1b2c3d, root: testdata, status: 200}}}}
+`, "comm_status: discrete input 200 already used by the DS18B20 poller"},
+		{"comm status on a unit input", `
+comm_status: 7
+units:
+  1: {inputs: {6: {pin: 23}}}
+  2: {inputs: {7: {pin: 24}}}
+`, "unit 2: comm_status: discrete input 7 already used"},
+		{"pwm current", `
+outputs:
+  8: {pin: 18, pwm: {current: 120}}
+  9: {pin: 19, pwm: {current: 121}}
+`, ""},
+		{"pwm current negative", `
+outputs: {8: {pin: 18, pwm: {current: -1}}}
+`, "output 8: current input register -1 out of range"},
+		{"pwm current over 65535", `
+outputs: {8: {pin: 18, pwm: {current: 65536}}}
+`, "output 8: current input register 65536 out of range"},
+		{"pwm current twice", `
+outputs:
+  8: {pin: 18, pwm: {current: 120}}
+  9: {pin: 19, pwm: {current: 120}}
+`, "output 9: current input register 120 already used by output 8"},
+		{"pwm current on a poller register", `
+inputs: {120: {pin: 24, poller: {type: LDR}}}
+outputs: {8: {pin: 18, pwm: {current: 120}}}
+`, "output 8: current input register 120 already used by the LDR poller"},
+		{"pwm current of another unit", `
+units:
+  1: {outputs: {8: {pin: 18, pwm: {current: 120}}}}
+  2: {outputs: {8: {pin: 19, pwm: {current: 120}}}}
+`, ""},
+	}
+	checkConfigs(t, tests, func(config string) error {
+		s, err := loadServer(t, "gpio: {driver: sim}\n" + config)
+		if err == nil {
+			err = s.initOutputs()
+		}
+		if err == nil {
+			err = s.InitPollers()
+		}
+		return err
+	})
+}
+
+func TestCheckPwmChannels(t *testing.T) {
+	tests := []configTest{
+		{"both channels", `
+outputs:
+  1: {pin: 12, pwm: {}}
+  2: {pin: 13, pwm: {}}
+`, ""},
+		{"same channel", `
+outputs:
+  1: {pin: 12, pwm: {}}
+  2: {pin: 18, pwm: {}}
+`, "output 2: pin 18 shares pwmchip0 channel 0 with pin 12 of output 1"},
+		{"same channel as a coil", `
+outputs:
+  1: {pin: 13, pwm: {}}
+  2: {pin: 19}
+`, ""},
+		{"same channel in two units", `
+units:
+  1: {outputs: {1: {pin: 13, pwm: {}}}}
+  2: {outputs: {1: {pin: 19, pwm: {}}}}
+`, "unit 2: output 1: pin 19 shares pwmchip0 channel 1 with pin 13 of unit 1 output 1"},
+		{"configured channels", `
+outputs:
+  1: {pin: 12, pwm: {}}
+  2: {pin: 18, pwm: {}}
+gpio: {driver: sim, pwm: sysfs, pwm_channels: {18: {chip: 1, channel: 0}}}
+`, ""},
+		{"configured channel taken", `
+outputs:
+  1: {pin: 12, pwm: {}}
+  2: {pin: 22, pwm: {}}
+gpio: {driver: sim, pwm: sysfs, pwm_channels: {12: {chip: 0, channel: 0}, 22: {chip: 0, channel: 0}}}
+`, "output 2: pin 22 shares pwmchip0 channel 0 with pin 12 of output 1"},
+		{"configured channels replace the defaults", `
+outputs:
+  1: {pin: 12, pwm: {}}
+  2: {pin: 22, pwm: {}}
+gpio: {driver: sim, pwm: sysfs, pwm_channels: {22: {chip: 0, channel: 0}}}
+`, ""},
+	}
+	checkConfigs(t, tests, func(config string) error {
+		if !strings.Contains(config, "gpio:") {
+			config += "gpio: {driver: sim, pwm: sysfs}\n"
+		}
+		_, err := loadServer(t, config)
+		return err
+	})
+
+	// the channels only apply to the sysfs backend
+	if _, err := loadServer(t, "gpio: {driver: sim}\noutputs: {1: {pin: 12, pwm: {}}, 2: {pin: 18, pwm: {}}}\n"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+	"context"
+	"strings"
+	"github.com/ggueret/mbpio/gpio"
+	"github.com/ggueret/mbpio/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const rampTick = 20 * time.Millisecond
+
+// pwmRamp is the duty applied to a ramp output, moving towards the target
+// on every tick.
+type pwmRamp struct {
+	current		float64
+	target		float64
+}
+
+// step moves the duty towards the target by at most delta.
+func (r *pwmRamp) step(delta float64) {
+	if math.Abs(r.target - r.current) <= delta {
+		r.current = r.target
+	} else if r.target > r.current {
+		r.current += delta
+	} else {
+		r.current -= delta
+	}
+}
+
+// checkPwmChannels rejects the pwm outputs driven by the same sysfs channel,
+// such as pins 12 and 18 of a Raspberry Pi, whatever their unit.
+func (s *Server) checkPwmChannels(channels map[gpio.Pin]gpio.PwmChannel) error {
+	type owner struct {
+		unit	*unit
+		addr	int
+		pin		gpio.Pin
+	}
+	owners := make(map[gpio.PwmChannel]owner)
+	for _, u := range s.units {
+		addrs := make([]int, 0, len(u.outputs))
+		for addr := range u.outputs {
+			addrs = append(addrs, addr)
+		}
+		sort.Ints(addrs)
+
+		for _, addr := range addrs {
+			output := u.outputs[addr]
+			channel, ok := channels[output.Pin]
+			if output.Pwm == nil || !ok {
+				continue
+			}
+			if other, ok := owners[channel]; ok {
+				by := fmt.Sprintf("output %d", other.addr)
+				if other.unit != u {
+					by = fmt.Sprintf("unit %d output %d", other.unit.id, other.addr)
+				}
+				return u.wrap(fmt.Errorf("output %d: pin %d shares pwmchip%d channel %d with pin %d of %s", addr, output.Pin, channel.Chip, channel.Channel, other.pin, by))
+			}
+			owners[channel] = owner{u, addr, output.Pin}
+		}
+	}
+	return nil
+}
+
+// setupPwm checks the pwm settings of an output and fills the defaults of its
+// mode, a servo gets a 50Hz period with microsecond ticks.
+func setupPwm(addr int, pwm *config.OutputPwm) error {
+	pwm.Mode = strings.ToLower(pwm.Mode)
+	switch pwm.Mode {
+	case "", "duty":
+		pwm.Mode = "duty"
+	case "servo":
+		if pwm.Freq == nil {
+			freq := 1000000
+			pwm.Freq = &freq
+		}
+		if pwm.Cycle == nil {
+			cycle := uint32(*pwm.Freq / 50)
+			pwm.Cycle = &cycle
+		}
+		if pwm.MinPulse == 0 {
+			pwm.MinPulse = time.Millisecond
+		}
+		if pwm.MaxPulse == 0 {
+			pwm.MaxPulse = 2 * time.Millisecond
+		}
+		if pwm.MinPulse >= pwm.MaxPulse {
+			return fmt.Errorf("output %d: min_pulse must be below max_pulse", addr)
+		}
+		if pwm.Angle == 0 {
+			pwm.Angle = 180
+		}
+		pwm.Unit = strings.ToLower(pwm.Unit)
+		switch pwm.Unit {
+		case "":
+			pwm.Unit = "angle"
+		case "angle", "us":
+		default:
+			return fmt.Errorf("output %d: unknown servo unit %q, choices: angle, us", addr, pwm.Unit)
+		}
+	case "ramp":
+		if pwm.Rate <= 0 {
+			return fmt.Errorf("output %d: a ramp needs a positive rate", addr)
+		}
+	default:
+		return fmt.Errorf("output %d: unknown pwm mode %q, choices: duty, servo, ramp", addr, pwm.Mode)
+	}
+
+	if pwm.Freq == nil {
+		pwm.Freq = &PWM_DEFAULT_FREQ
+	}
+	if pwm.Cycle == nil {
+		pwm.Cycle = &PWM_DEFAULT_CYCLE
+	}
+	if *pwm.Freq <= 0 || *pwm.Cycle == 0 {
+		return fmt.Errorf("output %d: pwm freq and cycle must be positive", addr)
+	}
+	if pwm.Current != nil && (*pwm.Current < 0 || *pwm.Current > 65535) {
+		return fmt.Errorf("output %d: current input register %d out of range", addr, *pwm.Current)
+	}
+	return nil
+}
+
+// pwmFullScale is the register value of a pwm output driven by a coil write.
+func pwmFullScale(pwm *config.OutputPwm) uint16 {
+	if pwm.Mode == "servo" {
+		if pwm.Unit == "us" {
+			return uint16(pwm.MaxPulse / time.Microsecond)
+		}
+		return pwm.Angle
+	}
+	return uint16(*pwm.Cycle)
+}
+
+// pwmSetpoint clamps a register value to the range of the output and returns
+// the matching duty.
+func pwmSetpoint(pwm *config.OutputPwm, value uint16) (uint16, uint32) {
+	if pwm.Mode != "servo" {
+		if uint32(value) > *pwm.Cycle {
+			value = uint16(*pwm.Cycle)
+		}
+		return value, uint32(value)
+	}
+
+	var pulse time.Duration
+	if pwm.Unit == "us" {
+		pulse = time.Duration(value) * time.Microsecond
+		if pulse < pwm.MinPulse {
+			pulse = pwm.MinPulse
+		} else if pulse > pwm.MaxPulse {
+			pulse = pwm.MaxPulse
+		}
+		value = uint16(pulse / time.Microsecond)
+	} else {
+		if value > pwm.Angle {
+			value = pwm.Angle
+		}
+		pulse = pwm.MinPulse + (pwm.MaxPulse - pwm.MinPulse) * time.Duration(value) / time.Duration(pwm.Angle)
+	}
+	return value, uint32(math.Round(pulse.Seconds() * float64(*pwm.Freq)))
+}
+
+// setDuty applies a duty to a pwm output and reports it in its current input
+// register.
+func (s *Server) setDuty(u *unit, output config.Output, duty uint32) {
+	s.gpio.SetDutyCycle(output.Pin, duty, *output.Pwm.Cycle)
+	if output.Pwm.Current != nil {
+		u.inputRegisters[*output.Pwm.Current] = uint16(duty)
+	}
+}
+
+// writePwm sets the holding register of a pwm output and drives it, a ramp
+// moves towards the new duty unless immediate. The register map must be
+// locked.
+func (s *Server) writePwm(u *unit, addr int, output config.Output, value uint16, immediate bool) {
+	value, duty := pwmSetpoint(output.Pwm, value)
+	u.holdingRegisters[addr] = value
+
+	if output.Pwm.Mode == "ramp" {
+		if u.ramps == nil {
+			u.ramps = make(map[int]*pwmRamp)
+		}
+		ramp, ok := u.ramps[addr]
+		if !ok {
+			ramp = &pwmRamp{}
+			u.ramps[addr] = ramp
+			immediate = true
+		}
+		ramp.target = float64(duty)
+		if !immediate {
+			return
+		}
+		ramp.current = ramp.target
+	}
+	s.setDuty(u, output, duty)
+}
+
+// runRamps moves the ramp outputs towards their targets at their rates.
+func (s *Server) runRamps(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(rampTick)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			elapsed := now.Sub(last).Seconds()
+			last = now
+
+			s.mu.Lock()
+			for _, u := range s.units {
+				for addr, ramp := range u.ramps {
+					if ramp.current == ramp.target {
+						continue
+					}
+					output := u.outputs[addr]
+					ramp.step(output.Pwm.Rate * elapsed)
+					s.setDuty(u, output, uint32(math.Round(ramp.current)))
+				}
+			}
+			s.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// initPwm configures the pin of a pwm output and applies its initial value.
+func (s *Server) initPwm(u *unit, addr int, output config.Output, value uint16) {
+	log.WithFields(log.Fields{"unit": u.id, "addr": addr, "pin": output.Pin, "mode": output.Pwm.Mode, "freq": *output.Pwm.Freq, "value": value, "cycle": *output.Pwm.Cycle}).Debug("Registering i/o output holding register")
+	s.gpio.PinMode(output.Pin, gpio.Pwm)
+	s.gpio.SetFreq(output.Pin, *output.Pwm.Freq)
+	s.writePwm(u, addr, output, value, true)
+}
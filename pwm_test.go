@@ -0,0 +1,159 @@
+package main
+
+import (
+	"time"
+	"context"
+	"testing"
+	"github.com/ggueret/mbpio/config"
+)
+
+func TestPwmSetpoint(t *testing.T) {
+	cycle := uint32(100)
+	tests := []struct {
+		name		string
+		pwm			config.OutputPwm
+		value		uint16
+		clamped		uint16
+		duty		uint32
+	}{
+		// 1MHz ticks, the duty is the pulse in microseconds
+		{"servo at 0", config.OutputPwm{Mode: "servo"}, 0, 0, 1000},
+		{"servo at 90", config.OutputPwm{Mode: "servo"}, 90, 90, 1500},
+		{"servo at 180", config.OutputPwm{Mode: "servo"}, 180, 180, 2000},
+		{"servo over the angle", config.OutputPwm{Mode: "servo"}, 200, 180, 2000},
+		{"servo custom range", config.OutputPwm{Mode: "servo", MinPulse: 500 * time.Microsecond, MaxPulse: 2500 * time.Microsecond, Angle: 270}, 135, 135, 1500},
+		{"servo 50kHz ticks", config.OutputPwm{Mode: "servo", Freq: intPtr(50000)}, 90, 90, 75},
+		{"servo us", config.OutputPwm{Mode: "servo", Unit: "us"}, 1200, 1200, 1200},
+		{"servo us under min_pulse", config.OutputPwm{Mode: "servo", Unit: "us"}, 500, 1000, 1000},
+		{"servo us over max_pulse", config.OutputPwm{Mode: "servo", Unit: "us"}, 2500, 2000, 2000},
+		{"duty", config.OutputPwm{Cycle: &cycle}, 40, 40, 40},
+		{"duty over the cycle", config.OutputPwm{Cycle: &cycle}, 150, 100, 100},
+	}
+	for _, test := range tests {
+		pwm := test.pwm
+		if err := setupPwm(1, &pwm); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		value, duty := pwmSetpoint(&pwm, test.value)
+		if value != test.clamped || duty != test.duty {
+			t.Errorf("%s: %d gives %d with duty %d, want %d with duty %d", test.name, test.value, value, duty, test.clamped, test.duty)
+		}
+	}
+}
+
+func TestPwmFullScale(t *testing.T) {
+	cycle := uint32(255)
+	tests := []struct {
+		name		string
+		pwm			config.OutputPwm
+		want		uint16
+	}{
+		{"servo", config.OutputPwm{Mode: "servo"}, 180},
+		{"servo us", config.OutputPwm{Mode: "servo", Unit: "us", MaxPulse: 2400 * time.Microsecond}, 2400},
+		{"duty", config.OutputPwm{Cycle: &cycle}, 255},
+	}
+	for _, test := range tests {
+		pwm := test.pwm
+		if err := setupPwm(1, &pwm); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := pwmFullScale(&pwm); got != test.want {
+			t.Errorf("%s: full scale %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPwmRampStep(t *testing.T) {
+	ramp := &pwmRamp{current: 0, target: 100}
+	for _, want := range []float64{30, 60, 90, 100, 100} {
+		ramp.step(30)
+		if ramp.current != want {
+			t.Fatalf("ramp up at %g, want %g", ramp.current, want)
+		}
+	}
+	ramp.target = 20
+	for _, want := range []float64{70, 40, 20} {
+		ramp.step(30)
+		if ramp.current != want {
+			t.Fatalf("ramp down at %g, want %g", ramp.current, want)
+		}
+	}
+	// a step over the distance lands on the target
+	ramp.target = 21.5
+	ramp.step(1000)
+	if ramp.current != 21.5 {
+		t.Errorf("ramp at %g, want the target", ramp.current)
+	}
+}
+
+func TestRunRamps(t *testing.T) {
+	s, err := loadServer(t, "gpio: {driver: sim}\noutputs: {1: {pin: 12, pwm: {mode: ramp, rate: 500, cycle: 100, current: 120}}}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.initOutputs(); err != nil {
+		t.Fatal(err)
+	}
+	u := s.units[0]
+	current := func() uint16 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return u.inputRegisters[120]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.runRamps(ctx)
+	t.Cleanup(func() {
+		cancel()
+		s.wg.Wait()
+	})
+
+	// 100 at 500/s is reached in 200ms, moving up on every tick
+	s.mu.Lock()
+	s.writePwm(u, 1, u.outputs[1], 100, false)
+	s.mu.Unlock()
+	start := time.Now()
+	if got := current(); got != 0 {
+		t.Errorf("ramp output jumped to %d", got)
+	}
+	var last uint16
+	for last != 100 {
+		if time.Since(start) > 2 * time.Second {
+			t.Fatalf("ramp stuck at %d", last)
+		}
+		time.Sleep(5 * time.Millisecond)
+		got := current()
+		if got < last || got > 100 {
+			t.Fatalf("ramp went from %d to %d on its way to 100", last, got)
+		}
+		last = got
+	}
+	if elapsed := time.Since(start); elapsed < 150 * time.Millisecond {
+		t.Errorf("ramp converged in %s, want 200ms", elapsed)
+	}
+
+	// and down, staying on the target
+	s.mu.Lock()
+	s.writePwm(u, 1, u.outputs[1], 90, false)
+	s.mu.Unlock()
+	for last != 90 {
+		if time.Since(start) > 4 * time.Second {
+			t.Fatalf("ramp stuck at %d", last)
+		}
+		time.Sleep(5 * time.Millisecond)
+		got := current()
+		if got > last || got < 90 {
+			t.Fatalf("ramp went from %d to %d on its way to 90", last, got)
+		}
+		last = got
+	}
+	time.Sleep(3 * rampTick)
+	if got := current(); got != 90 {
+		t.Errorf("ramp left its target for %d", got)
+	}
+}
+
+func intPtr(value int) *int {
+	return &value
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"sync"
+	"time"
+	"strings"
+	"github.com/goburrow/serial"
+	"github.com/ggueret/mbpio/gpio"
+	"github.com/ggueret/mbpio/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// rs485Port drives the driver enable pin of a half-duplex transceiver around
+// each write, the pin is released once the frame left the line as timed from
+// the baud rate. When the receiver stays on during transmit the echo of the
+// sent frames is dropped from the reads.
+type rs485Port struct {
+	io.ReadWriteCloser
+	driver		gpio.Driver
+	pin			gpio.Pin
+	before		time.Duration
+	after		time.Duration
+	charTime	time.Duration
+
+	mu			sync.Mutex
+	echo		[]byte
+	dropEcho	bool
+}
+
+// openRTU opens the serial port of the rtu section with its rs485 settings.
+func (s *Server) openRTU(cfg *config.RTUConfig) (io.ReadWriteCloser, error) {
+	rs485 := cfg.RS485
+	serialConfig := &serial.Config{
+		Address: cfg.Address,
+		BaudRate: cfg.BaudRate,
+		DataBits: cfg.DataBits,
+		StopBits: cfg.StopBits,
+		Parity: cfg.Parity,
+		Timeout: cfg.Timeout,
+	}
+
+	mode := strings.ToLower(rs485.Mode)
+	switch mode {
+	case "", "off":
+		if rs485.DEPin != nil {
+			return nil, fmt.Errorf("rtu: de_pin needs the gpio rs485 mode")
+		}
+	case "kernel":
+		if rs485.DEPin != nil {
+			return nil, fmt.Errorf("rtu: de_pin needs the gpio rs485 mode, the kernel drives RTS")
+		}
+		serialConfig.RS485 = serial.RS485Config{
+			Enabled: true,
+			DelayRtsBeforeSend: rs485.DelayBeforeSend,
+			DelayRtsAfterSend: rs485.DelayAfterSend,
+			RtsHighDuringSend: true,
+			RxDuringTx: rs485.RxDuringTx,
+		}
+	case "gpio":
+		if rs485.DEPin == nil {
+			return nil, fmt.Errorf("rtu: the gpio rs485 mode needs a de_pin")
+		}
+	default:
+		return nil, fmt.Errorf("rtu: unknown rs485 mode %q, choices: off, kernel, gpio", rs485.Mode)
+	}
+
+	port, err := serial.Open(serialConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %s", cfg.Address, err)
+	}
+	if mode != "gpio" && !rs485.RxDuringTx {
+		return port, nil
+	}
+
+	wrapped := &rs485Port{
+		ReadWriteCloser: port,
+		dropEcho: rs485.RxDuringTx,
+	}
+	if mode == "gpio" {
+		wrapped.driver = s.gpio
+		wrapped.pin = *rs485.DEPin
+		wrapped.before = rs485.DelayBeforeSend
+		wrapped.after = rs485.DelayAfterSend
+		// a character has a start bit, the data, parity and stop bits
+		bits := 1 + cfg.DataBits + cfg.StopBits
+		if !strings.EqualFold(cfg.Parity, "N") {
+			bits++
+		}
+		wrapped.charTime = time.Duration(bits) * time.Second / time.Duration(cfg.BaudRate)
+
+		log.WithFields(log.Fields{"pin": wrapped.pin}).Debug("Driving the rs485 driver enable pin")
+		s.gpio.PinMode(wrapped.pin, gpio.Output)
+		s.gpio.WritePin(wrapped.pin, gpio.Low)
+	}
+	return wrapped, nil
+}
+
+func (p *rs485Port) Write(b []byte) (int, error) {
+	if p.dropEcho {
+		p.mu.Lock()
+		p.echo = append(p.echo, b...)
+		p.mu.Unlock()
+	}
+	if p.driver == nil {
+		return p.ReadWriteCloser.Write(b)
+	}
+
+	p.driver.WritePin(p.pin, gpio.High)
+	defer p.driver.WritePin(p.pin, gpio.Low)
+	time.Sleep(p.before)
+	started := time.Now()
+	n, err := p.ReadWriteCloser.Write(b)
+	// the write returns once the kernel buffered the frame
+	time.Sleep(p.charTime * time.Duration(n) - time.Since(started) + p.after)
+	return n, err
+}
+
+// Read drops the bytes matching the echo of the last writes.
+func (p *rs485Port) Read(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Read(b)
+	if !p.dropEcho || n == 0 {
+		return n, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	skip := 0
+	for skip < n && skip < len(p.echo) && b[skip] == p.echo[skip] {
+		skip++
+	}
+	if skip < len(p.echo) && skip < n {
+		// the echo was lost, the rest comes from the bus
+		p.echo = nil
+	} else {
+		p.echo = p.echo[skip:]
+	}
+	return copy(b, b[skip:n]), err
+}
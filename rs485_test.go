@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+	"bytes"
+	"testing"
+	"github.com/ggueret/mbpio/gpio"
+)
+
+// testPort is a serial port reading the given chunks and taking delay to
+// buffer each write.
+type testPort struct {
+	mu			sync.Mutex
+	reads		[][]byte
+	written		[]byte
+	delay		time.Duration
+	onWrite		func()
+}
+
+func (p *testPort) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, p.reads[0])
+	p.reads = p.reads[1:]
+	return n, nil
+}
+
+func (p *testPort) Write(b []byte) (int, error) {
+	if p.onWrite != nil {
+		p.onWrite()
+	}
+	time.Sleep(p.delay)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.written = append(p.written, b...)
+	return len(b), nil
+}
+
+func (p *testPort) Close() error {
+	return nil
+}
+
+// dePin records the writes of the driver enable pin.
+type dePin struct {
+	gpio.Driver
+	states		[]gpio.State
+	times		[]time.Time
+}
+
+func (d *dePin) WritePin(pin gpio.Pin, state gpio.State) {
+	d.states = append(d.states, state)
+	d.times = append(d.times, time.Now())
+	d.Driver.WritePin(pin, state)
+}
+
+func TestRS485Write(t *testing.T) {
+	sim, err := gpio.New("sim", gpio.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	sim.PinMode(17, gpio.Output)
+	de := &dePin{Driver: sim}
+	port := &testPort{delay: 5 * time.Millisecond}
+	port.onWrite = func() {
+		if sim.ReadPin(17) != gpio.High {
+			t.Error("frame written with the driver disabled")
+		}
+	}
+	p := &rs485Port{
+		ReadWriteCloser: port,
+		driver: de,
+		pin: 17,
+		before: 2 * time.Millisecond,
+		after: 3 * time.Millisecond,
+		charTime: time.Millisecond,
+	}
+
+	// 20 characters of 1ms, less the 5ms taken by the write, then the delay
+	// after
+	frame := bytes.Repeat([]byte{0x55}, 20)
+	if n, err := p.Write(frame); n != len(frame) || err != nil {
+		t.Fatalf("write: %d, %v", n, err)
+	}
+	if !bytes.Equal(port.written, frame) {
+		t.Errorf("wrote %x, want %x", port.written, frame)
+	}
+	if len(de.states) != 2 || de.states[0] != gpio.High || de.states[1] != gpio.Low {
+		t.Fatalf("driver enable went %v, want high then low", de.states)
+	}
+	held := de.times[1].Sub(de.times[0])
+	if held < 25 * time.Millisecond || held > 35 * time.Millisecond {
+		t.Errorf("driver enabled for %s, want 2ms before, 20ms of frame and 3ms after", held)
+	}
+	if sim.ReadPin(17) != gpio.Low {
+		t.Error("driver left enabled")
+	}
+}
+
+func TestRS485Echo(t *testing.T) {
+	tests := []struct {
+		name		string
+		dropEcho	bool
+		reads		[]string
+		want		[]string
+	}{
+		{"echo then response", true, []string{"abcXY"}, []string{"XY"}},
+		{"echo over two reads", true, []string{"ab", "cX"}, []string{"", "X"}},
+		{"echo lost", true, []string{"xyz", "abc"}, []string{"xyz", "abc"}},
+		{"echo cut short", true, []string{"aZ", "bc"}, []string{"Z", "bc"}},
+		{"receiver off", false, []string{"abcXY"}, []string{"abcXY"}},
+	}
+	for _, test := range tests {
+		port := &testPort{}
+		for _, read := range test.reads {
+			port.reads = append(port.reads, []byte(read))
+		}
+		p := &rs485Port{ReadWriteCloser: port, dropEcho: test.dropEcho}
+		if _, err := p.Write([]byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range test.want {
+			b := make([]byte, 16)
+			n, err := p.Read(b)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			if got := string(b[:n]); got != want {
+				t.Errorf("%s: read %d gave %q, want %q", test.name, i, got, want)
+			}
+		}
+	}
+}
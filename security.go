@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/ggueret/mbpio/config"
+	"github.com/ggueret/mbpio/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+// permission is a parsed config.Permission, the addresses from first to last
+// included.
+type permission struct {
+	table	string
+	first	int
+	last	int
+	write	bool
+}
+
+var permissionTables = map[string]bool{
+	"coils": true,
+	"discrete_inputs": true,
+	"holding_registers": true,
+	"input_registers": true,
+}
+
+// loadRoles parses the permissions of the roles of the tls section.
+func (s *Server) loadRoles() error {
+	s.roles = make(map[string][]permission)
+	for role, permissions := range s.cfg.TLS.Roles {
+		for _, p := range permissions {
+			parsed, err := parsePermission(p)
+			if err != nil {
+				return fmt.Errorf("tls: role %q: %s", role, err)
+			}
+			s.roles[role] = append(s.roles[role], parsed)
+		}
+	}
+	return nil
+}
+
+func parsePermission(p config.Permission) (permission, error) {
+	parsed := permission{table: p.Table, last: 0xffff}
+	if p.Table != "" && !permissionTables[p.Table] {
+		return parsed, fmt.Errorf("unknown table %q, choices: coils, discrete_inputs, holding_registers, input_registers", p.Table)
+	}
+	switch strings.ToLower(p.Access) {
+	case "read":
+	case "rw":
+		parsed.write = true
+	default:
+		return parsed, fmt.Errorf("unknown access %q, choices: read, rw", p.Access)
+	}
+
+	if p.Addresses != "" {
+		bounds := strings.SplitN(p.Addresses, "-", 2)
+		var err error
+		parsed.first, err = strconv.Atoi(strings.TrimSpace(bounds[0]))
+		parsed.last = parsed.first
+		if err == nil && len(bounds) == 2 {
+			parsed.last, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		}
+		if err != nil || parsed.first < 0 || parsed.last > 0xffff || parsed.first > parsed.last {
+			return parsed, fmt.Errorf("invalid addresses %q", p.Addresses)
+		}
+	}
+	return parsed, nil
+}
+
+// tlsConfig loads the certificate of the tls section and the authority of
+// its clients.
+func tlsConfig(cfg *config.TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %s", err)
+	}
+	pem, err := ioutil.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificate found in %s", cfg.CAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs: pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// authorize checks the role of a request against the permissions of the
+// addresses it reads or writes. The requests of the other transports have no
+// role and are always authorized, a denied one gets an illegal function as
+// the Modbus/TCP Security profile requires.
+func (s *Server) authorize(req *modbus.Request) error {
+	if req.Role == "" {
+		return nil
+	}
+	var table string
+	write := false
+	switch req.Function {
+	case 0x01:
+		table = "coils"
+	case 0x02:
+		table = "discrete_inputs"
+	case 0x03:
+		table = "holding_registers"
+	case 0x04:
+		table = "input_registers"
+	case 0x05, 0x0f:
+		table, write = "coils", true
+	case 0x06, 0x10:
+		table, write = "holding_registers", true
+	default:
+		return modbus.IllegalFunction
+	}
+
+	first, quantity, _ := modbus.RegisterAddressAndNumber(req)
+	if req.Function == 0x05 || req.Function == 0x06 {
+		quantity = 1
+	}
+	for addr := first; addr < first + quantity; addr++ {
+		if !s.permitted(req.Role, table, addr, write) {
+			log.WithFields(log.Fields{"role": req.Role, "function": req.Function, "addr": addr}).Warn("Request denied")
+			return modbus.IllegalFunction
+		}
+	}
+	return nil
+}
+
+func (s *Server) permitted(role string, table string, addr int, write bool) bool {
+	for _, p := range s.roles[role] {
+		if (p.table == "" || p.table == table) && addr >= p.first && addr <= p.last && (p.write || !write) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"encoding/hex"
+	"github.com/ggueret/mbpio/config"
+	"github.com/ggueret/mbpio/modbus"
+)
+
+// rolesServer serves a unit whose handlers all succeed with the roles of
+// the tls section.
+func rolesServer(t *testing.T, roles map[string][]config.Permission) *Server {
+	s := &Server{cfg: &config.Config{TLS: &config.TLSConfig{Roles: roles}}}
+	if err := s.loadRoles(); err != nil {
+		t.Fatal(err)
+	}
+	s.units = []*unit{newUnit(1, nil, nil, &sync.Mutex{})}
+	for function := range s.handlers {
+		s.handlers[function] = func(*unit, *modbus.Request) ([]byte, error) {
+			return nil, nil
+		}
+	}
+	return s
+}
+
+func TestAuthorize(t *testing.T) {
+	s := rolesServer(t, map[string][]config.Permission{
+		"operator": {{Access: "rw"}},
+		"viewer": {
+			{Table: "coils", Addresses: "0-9", Access: "read"},
+			{Table: "holding_registers", Access: "read"},
+			{Table: "holding_registers", Addresses: "100", Access: "rw"},
+		},
+	})
+
+	tests := []struct {
+		name	string
+		role	string
+		request	string
+		err		error
+	}{
+		{"plain transport", "", "0f00000001010f", nil},
+		{"operator write", "operator", "10000000020400010002", nil},
+		{"operator read", "operator", "0200000010", nil},
+		{"unknown role", "guest", "0100000001", modbus.IllegalFunction},
+		{"viewer read coils", "viewer", "010000000a", nil},
+		{"viewer read coils past the range", "viewer", "010000000b", modbus.IllegalFunction},
+		{"viewer write coil", "viewer", "050001ff00", modbus.IllegalFunction},
+		{"viewer write coils", "viewer", "0f00000001010f", modbus.IllegalFunction},
+		{"viewer read holding registers", "viewer", "03fff00010", nil},
+		{"viewer write holding register", "viewer", "0600010005", modbus.IllegalFunction},
+		{"viewer write rw holding register", "viewer", "0600640005", nil},
+		{"viewer write past rw holding register", "viewer", "10006400020400010002", modbus.IllegalFunction},
+		{"viewer read discrete inputs", "viewer", "0200000001", modbus.IllegalFunction},
+		{"viewer read input registers", "viewer", "0400000001", modbus.IllegalFunction},
+		{"other function", "operator", "2b0e0100", modbus.IllegalFunction},
+	}
+	for _, test := range tests {
+		pdu, err := hex.DecodeString(test.request)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		_, err = s.ServeModbus(&modbus.Request{Unit: 1, Function: pdu[0], Data: pdu[1:], Role: test.role})
+		if err != test.err {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestLoadRoles(t *testing.T) {
+	tests := []struct {
+		permission	config.Permission
+		valid		bool
+	}{
+		{config.Permission{Access: "READ"}, true},
+		{config.Permission{Table: "coils", Addresses: "5", Access: "rw"}, true},
+		{config.Permission{Table: "input_registers", Addresses: " 0 - 65535 ", Access: "read"}, true},
+		{config.Permission{Table: "registers", Access: "read"}, false},
+		{config.Permission{Access: "write"}, false},
+		{config.Permission{Addresses: "9-1", Access: "read"}, false},
+		{config.Permission{Addresses: "0-65536", Access: "read"}, false},
+		{config.Permission{Addresses: "-1", Access: "read"}, false},
+		{config.Permission{Addresses: "a-b", Access: "read"}, false},
+	}
+	for _, test := range tests {
+		s := &Server{cfg: &config.Config{TLS: &config.TLSConfig{
+			Roles: map[string][]config.Permission{"role": {test.permission}},
+		}}}
+		if err := s.loadRoles(); (err == nil) != test.valid {
+			t.Errorf("%+v: %v", test.permission, err)
+		}
+	}
+}
@@ -1,25 +1,36 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"sync"
+	"time"
+	"context"
+	"strings"
 	"runtime"
 	"encoding/binary"
-	"github.com/goburrow/serial"
-	"github.com/tbrandon/mbserver"
 	"github.com/ggueret/mbpio/gpio"
 	"github.com/ggueret/mbpio/config"
 	"github.com/ggueret/mbpio/modbus"
+	"github.com/ggueret/mbpio/poller"
 	log "github.com/sirupsen/logrus"
 )
 
 type Server struct {
-	mb		*mbserver.Server
+	mb		*modbus.Server
 	cfg		*config.Config
+	gpio	gpio.Driver
 	mu		sync.Mutex
 	done	chan struct{}
 	quit	chan struct{}
 	wg		sync.WaitGroup
-	pollers	map[string]func([]int)
+	state	*stateFile
+	units	[]*unit
+	roles	map[string][]permission
+
+	handlers	[256]unitHandler
+	lastRequest	time.Time
+	tripped		bool
 }
 
 var (
@@ -37,135 +48,302 @@ func NewServer(config_path string) (*Server, error) {
 		return nil, err
 	}
 
-	return &Server{
-		mb: mbserver.NewServer(),
+	driver, err := gpio.New(cfg.GPIO.Driver, gpio.Options{
+		Chip: cfg.GPIO.Chip,
+		Script: cfg.GPIO.Script,
+		Control: cfg.GPIO.Control,
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.GPIO.Pwm {
+	case "":
+	case "sysfs":
+		driver = gpio.NewSysfsPwm(driver, cfg.GPIO.PwmRoot, cfg.GPIO.PwmChannels)
+	default:
+		return nil, fmt.Errorf("unknown pwm backend %q, choices: sysfs", cfg.GPIO.Pwm)
+	}
+	driver = gpio.NewSoftPwm(driver)
+
+	s := &Server{
 		cfg: cfg,
+		gpio: driver,
 		done: make(chan struct{}),
 		quit: make(chan struct{}),
 		wg: sync.WaitGroup{},
-		pollers: make(map[string]func([]int)),
-	}, nil
+	}
+	s.mb = modbus.NewServer(s)
+
+	if cfg.StateFile != "" {
+		s.state, err = loadState(cfg.StateFile)
+		if err != nil {
+			return nil, fmt.Errorf("state file: %s", err)
+		}
+	}
+
+	err = s.loadUnits()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.GPIO.Pwm == "sysfs" {
+		err = s.checkPwmChannels(cfg.GPIO.PwmChannels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.LoadPollers()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS != nil {
+		err = s.loadRoles()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 func (s *Server) Start() error {
+	// Stop waits for done, whichever way Start returns
+	defer close(s.done)
 	log.Printf("starting mbpio v%s for %s/%s", Version, runtime.GOOS, runtime.GOARCH)
 
-	err := gpio.Open()
+	log.Infof("using the %s gpio driver", s.cfg.GPIO.Driver)
+	err := s.gpio.Open()
 	if err != nil {
 		return err
 	}
-	defer gpio.Close()
-
-	s.RegisterPollers()
+	defer s.gpio.Close()
 
-	s.mb.RegisterFunctionHandler(0x1, s.ReadCoils)
-	s.mb.RegisterFunctionHandler(0x2, s.ReadDiscreteInputs)
-	s.mb.RegisterFunctionHandler(0x3, s.ReadHoldingRegisters)
-	s.mb.RegisterFunctionHandler(0x4, s.ReadInputRegisters)
+	s.handlers[0x1] = s.feedWatchdog(s.ReadCoils)
+	s.handlers[0x2] = s.feedWatchdog(s.ReadDiscreteInputs)
+	s.handlers[0x3] = s.feedWatchdog(s.ReadHoldingRegisters)
+	s.handlers[0x4] = s.feedWatchdog(s.ReadInputRegisters)
 
-	s.mb.RegisterFunctionHandler(0x5, s.WriteSingleCoil)
-	s.mb.RegisterFunctionHandler(0x6, s.WriteHoldingRegister)
-	s.mb.RegisterFunctionHandler(0xf, s.WriteMultipleCoils)
-	s.mb.RegisterFunctionHandler(0x10, s.WriteHoldingRegisters)
+	s.handlers[0x5] = s.feedWatchdog(s.WriteSingleCoil)
+	s.handlers[0x6] = s.feedWatchdog(s.WriteHoldingRegister)
+	s.handlers[0xf] = s.feedWatchdog(s.WriteMultipleCoils)
+	s.handlers[0x10] = s.feedWatchdog(s.WriteHoldingRegisters)
 
-	// init outputs as mb.Coils and mb.HoldingRegisters for PWM
-	for addr, output := range s.cfg.Outputs {
-		if output.Pwm != nil {
-			// Output is a HoldingRegister
-			pwmFreq := output.Pwm.Freq
-			if pwmFreq == nil {
-				pwmFreq = &PWM_DEFAULT_FREQ
-			}
+	err = s.initOutputs()
+	if err != nil {
+		return err
+	}
 
-			pwmCycle := output.Pwm.Cycle
-			if pwmCycle == nil {
-				pwmCycle = &PWM_DEFAULT_CYCLE
-			}
+	// init inputs as discrete inputs for on/off and input registers for the others
+	err = s.InitPollers()
+	if err != nil {
+		return err
+	}
 
-			pwmDuty := uint32(OUTPUT_DEFAULT_VALUE)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-			log.WithFields(log.Fields{"addr": addr, "pin": output.Pin, "freq": *pwmFreq, "duty": pwmDuty, "cycle": *pwmCycle}).Debug("Registering i/o output holding register")
-			output.Pin.Mode(gpio.Pwm)
-			output.Pin.Freq(*pwmFreq)
-			output.Pin.DutyCycle(pwmDuty, *pwmCycle)
-		} else {
-			// Output is a Coil
-			log.WithFields(log.Fields{"addr": addr, "pin": output.Pin, "state": gpio.Low}).Debug("Registering i/o output coil")
-			output.Pin.Mode(gpio.Output)
-			output.Pin.Write(gpio.Low)
+	ramps := false
+	for _, u := range s.units {
+		for _, group := range u.pollers {
+			log.WithFields(log.Fields{"unit": u.id, "pin": group.pin, "interval": group.interval, "jitter": group.jitter}).Debugf("Spawning the %s poller...", group.descriptor.Name)
+			s.wg.Add(1)
+			go s.runPoller(ctx, group)
 		}
+		ramps = ramps || len(u.ramps) > 0
 	}
 
-	// init inputs as mb.DiscreteInputs for on/off and mb.InputRegisters for the others
-	pollersInputs := make(map[string][]int)
+	if ramps {
+		s.wg.Add(1)
+		go s.runRamps(ctx)
+	}
 
-	for addr, input := range s.cfg.Inputs {
-		if input.Poller != nil {
-			// Input is a InputRegister
-			if _, ok := s.pollers[input.Poller.Type]; ok {
-				log.WithFields(log.Fields{"addr": addr, "pin": input.Pin, "type": input.Poller.Type, "value": input.Poller.Value}).Debug("Registering i/o input register")
-				pollersInputs[input.Poller.Type] = append(pollersInputs[input.Poller.Type], addr)
+	if s.cfg.CommTimeout > 0 {
+		log.Infof("Applying the safe states after %s without request", s.cfg.CommTimeout)
+		s.lastRequest = time.Now()
+		s.wg.Add(1)
+		go s.runWatchdog(ctx)
+	}
+
+	if s.state != nil {
+		log.Infof("Retaining state in %s every %s", s.cfg.StateFile, s.cfg.StateInterval)
+		s.wg.Add(1)
+		go s.runState(ctx)
+	}
+
+	// a transport failing to start stops the ones already serving
+	err = s.listen(ctx)
+	if err == nil {
+		<-s.quit
+	}
+	cancel()
+	s.wg.Wait()
+
+	if s.cfg.RTU != nil {
+		counters := s.mb.SerialCounters()
+		log.WithFields(log.Fields{
+			"messages": counters.BusMessages,
+			"errors": counters.BusErrors,
+			"exceptions": counters.Exceptions,
+			"served": counters.SlaveMessages,
+			"overruns": counters.Overruns,
+		}).Info("Serial bus counters")
+	}
+
+	s.mu.Lock()
+	for _, u := range s.units {
+		s.retainOutputs(u)
+		s.cancelCoilTimers(u)
+		s.applySafeStates(u)
+	}
+	s.mu.Unlock()
+	if s.state != nil {
+		if err := s.state.save(); err != nil {
+			log.Warnf("cannot save the state to %s: %s", s.cfg.StateFile, err)
+		}
+	}
+	return err
+}
+
+// listen starts the configured transports, the ones started before a failure
+// stop along with ctx.
+func (s *Server) listen(ctx context.Context) error {
+	if rtu := s.cfg.RTU; rtu != nil {
+		mode := strings.ToUpper(rtu.Mode)
+		if mode != "RTU" && mode != "ASCII" {
+			return fmt.Errorf("rtu: unknown mode %q, choices: rtu, ascii", rtu.Mode)
+		}
+		log.Infof("Listening to %s address %s", mode, rtu.Address)
+		port, err := s.openRTU(rtu)
+		if err != nil {
+			return err
+		}
+		s.serve(ctx, mode, func(ctx context.Context) error {
+			if mode == "ASCII" {
+				return s.mb.ServeASCII(ctx, port, rtu.EOL)
 			}
-		} else {
-			// Input is a DiscreteInput
-			log.WithFields(log.Fields{"addr": addr, "pin": input.Pin}).Debug("Registering i/o input discrete")
-			input.Pin.Mode(gpio.Input)
+			return s.mb.ServeRTU(ctx, port, rtu.BaudRate)
+		})
+	}
+
+	// an empty listen_on leaves only the tls listener
+	if s.cfg.ListenOn != "" {
+		log.Infof("Listening to TCP address %s", s.cfg.ListenOn)
+		listener, err := net.Listen("tcp", s.cfg.ListenOn)
+		if err != nil {
+			return err
 		}
+		s.serve(ctx, "TCP", func(ctx context.Context) error {
+			return s.mb.ServeTCP(ctx, listener)
+		})
 	}
 
-	// run the selected inputs pollers
-	for pollerName, pollerFunc := range s.pollers {
-		if pollerInputs, ok := pollersInputs[pollerName]; ok {
-			log.Debugf("Spawning the %s poller...", pollerName)
-			go pollerFunc(pollerInputs)
+	if s.cfg.TLS != nil {
+		tlsConfig, err := tlsConfig(s.cfg.TLS)
+		if err != nil {
+			return err
+		}
+		log.Infof("Listening to TLS address %s", s.cfg.TLS.ListenOn)
+		listener, err := net.Listen("tcp", s.cfg.TLS.ListenOn)
+		if err != nil {
+			return err
 		}
+		s.serve(ctx, "TLS", func(ctx context.Context) error {
+			return s.mb.ServeTLS(ctx, listener, tlsConfig)
+		})
 	}
 
-	if s.cfg.EnableRTU == true {
-		log.Infof("Listening to RTU address %s", s.cfg.RTUAddress)
-		err = s.mb.ListenRTU(&serial.Config{
-			Address: s.cfg.RTUAddress,
-			BaudRate: s.cfg.RTUBaudRate,
-			DataBits: s.cfg.RTUDataBits,
-			StopBits: s.cfg.RTUStopBits,
-			Parity: s.cfg.RTUParity,
-			Timeout: s.cfg.RTUTimeout,
+	if s.cfg.RTUOverTCPListenOn != "" {
+		log.Infof("Listening to RTU over TCP address %s", s.cfg.RTUOverTCPListenOn)
+		listener, err := net.Listen("tcp", s.cfg.RTUOverTCPListenOn)
+		if err != nil {
+			return err
+		}
+		s.serve(ctx, "RTU over TCP", func(ctx context.Context) error {
+			return s.mb.ServeRTUOverTCP(ctx, listener)
 		})
+	}
+
+	if s.cfg.UDPListenOn != "" {
+		log.Infof("Listening to UDP address %s", s.cfg.UDPListenOn)
+		conn, err := net.ListenPacket("udp", s.cfg.UDPListenOn)
 		if err != nil {
 			return err
 		}
+		s.serve(ctx, "UDP", func(ctx context.Context) error {
+			return s.mb.ServeUDP(ctx, conn)
+		})
 	}
+	return nil
+}
 
-	log.Infof("Listening to TCP address %s", s.cfg.ListenOn)
-	err = s.mb.ListenTCP(s.cfg.ListenOn)
-	if err != nil {
-		return err
+// initOutputs configures the outputs of the units as coils and holding
+// registers for PWM, starting from the value given by their retain policy.
+func (s *Server) initOutputs() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.units {
+		if err := s.initUnitOutputs(u); err != nil {
+			return u.wrap(err)
+		}
 	}
+	return nil
+}
 
-	for {
-		select {
-		case <- s.quit:
-			s.wg.Wait()
-			close(s.done)
-			return nil
+func (s *Server) initUnitOutputs(u *unit) error {
+	for addr, output := range u.outputs {
+		if err := s.setupRetain(addr, &output); err != nil {
+			return err
+		}
+		u.outputs[addr] = output
+		value := s.initialValue(u, addr, output)
 
-		default:
+		if output.Pwm != nil {
+			// Output is a HoldingRegister
+			if hasTimers(output) {
+				return fmt.Errorf("output %d: pulse, on_delay and off_delay only apply to coils", addr)
+			}
+			if err := setupPwm(addr, output.Pwm); err != nil {
+				return err
+			}
+			s.initPwm(u, addr, output, uint16(value))
+		} else {
+			// Output is a Coil
+			log.WithFields(log.Fields{"unit": u.id, "addr": addr, "pin": output.Pin, "value": value, "retain": output.Retain}).Debug("Registering i/o output coil")
+			s.gpio.PinMode(output.Pin, gpio.Output)
+			s.driveCoil(u, addr, output, false)
+			if value != 0 {
+				s.writeCoil(u, addr, output, true)
+			}
 		}
 	}
 	return nil
 }
 
+// serve runs a transport until the server stops, a failure is logged but
+// leaves the other transports running.
+func (s *Server) serve(ctx context.Context, name string, fn func(context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := fn(ctx); err != nil {
+			log.Errorf("%s listener failed: %s", name, err)
+		}
+	}()
+}
+
 func (s *Server) Stop() {
 	close(s.quit)
 	<-s.done
 }
 
-func (s *Server) ReadCoils(mb *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Server) ReadCoils(u *unit, req *modbus.Request) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(frame)
+	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(req)
 	if endRegister > 65535 {
-		return []byte{}, &mbserver.IllegalDataAddress
+		return nil, modbus.IllegalDataAddress
 	}
 	dataSize := numRegs / 8
 	if (numRegs % 8) != 0 {
@@ -173,21 +351,21 @@ func (s *Server) ReadCoils(mb *mbserver.Server, frame mbserver.Framer) ([]byte,
 	}
 	data := make([]byte, 1+dataSize)
 	data[0] = byte(dataSize)
-	for i, value := range mb.Coils[register:endRegister] {
+	for i, value := range u.coils[register:endRegister] {
 		if value != 0 {
 			shift := uint(i) % 8
 			data[1+i/8] |= byte(1 << shift)
 		}
 	}
-	return data, &mbserver.Success
+	return data, nil
 }
 
-func (s *Server) ReadDiscreteInputs(mb *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Server) ReadDiscreteInputs(u *unit, req *modbus.Request) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(frame)
+	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(req)
 	if endRegister > 65535 {
-		return []byte{}, &mbserver.IllegalDataAddress
+		return nil, modbus.IllegalDataAddress
 	}
 	dataSize := numRegs / 8
 	if (numRegs % 8) != 0 {
@@ -195,84 +373,94 @@ func (s *Server) ReadDiscreteInputs(mb *mbserver.Server, frame mbserver.Framer)
 	}
 	data := make([]byte, 1+dataSize)
 	data[0] = byte(dataSize)
-	for i, value := range mb.DiscreteInputs[register:endRegister] {
+	for i, value := range u.discreteInputs[register:endRegister] {
 		if value != 0 {
 			shift := uint(i) % 8
 			data[1+i/8] |= byte(1 << shift)
 		}
 	}
-	return data, &mbserver.Success
+	return data, nil
 }
 
-func (s *Server) ReadHoldingRegisters(mb *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Server) ReadHoldingRegisters(u *unit, req *modbus.Request) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(frame)
+	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(req)
 	if endRegister > 65536 {
-		return []byte{}, &mbserver.IllegalDataAddress
+		return nil, modbus.IllegalDataAddress
 	}
-	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(mb.HoldingRegisters[register:endRegister])...), &mbserver.Success
+	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(u.holdingRegisters[register:endRegister])...), nil
 }
 
-func (s *Server) ReadInputRegisters(mb *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Server) ReadInputRegisters(u *unit, req *modbus.Request) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(frame)
+	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(req)
 	if endRegister > 65536 {
-		return []byte{}, &mbserver.IllegalDataAddress
+		return nil, modbus.IllegalDataAddress
 	}
-	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(mb.InputRegisters[register:endRegister])...), &mbserver.Success
+	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(u.inputRegisters[register:endRegister])...), nil
 }
 
-func (s *Server) WriteSingleCoil(mb *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Server) WriteSingleCoil(u *unit, req *modbus.Request) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	register, value := modbus.RegisterAddressAndValue(frame)
+	register, value := modbus.RegisterAddressAndValue(req)
 	// TODO Should we use 0 for off and 65,280 (FF00 in hexadecimal) for on?
 	if value != 0 {
 		value = 1
 	}
-	if output, ok := s.cfg.Outputs[register]; ok {
+	if output, ok := u.outputs[register]; ok {
 		if output.Pwm != nil {
-			duty := uint32(0)
+			setpoint := uint16(0)
 			if value == 1 {
-				duty = *output.Pwm.Cycle
+				setpoint = pwmFullScale(output.Pwm)
 			}
-			output.Pin.DutyCycle(duty, *output.Pwm.Cycle)
+			s.writePwm(u, register, output, setpoint, false)
+			u.coils[register] = byte(value)
 		} else {
-			output.Pin.Write(gpio.State(value))
+			s.writeCoil(u, register, output, value == 1)
+		}
+		return req.Data[0:4], nil
+	}
+	if handled, err := s.writePollerCoil(u, register, value == 1); handled {
+		if err != nil {
+			log.WithFields(log.Fields{"addr": register}).Warnf("coil write rejected: %s", err)
+			return nil, modbus.IllegalDataValue
 		}
-		mb.Coils[register] = byte(value)
-		return frame.GetData()[0:4], &mbserver.Success
+		return req.Data[0:4], nil
 	}
-	return []byte{}, &mbserver.IllegalDataAddress
+	return nil, modbus.IllegalDataAddress
 }
 
-func (s *Server) WriteHoldingRegister(mb *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Server) WriteHoldingRegister(u *unit, req *modbus.Request) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	register, value := modbus.RegisterAddressAndValue(frame)
-	if output, ok := s.cfg.Outputs[register]; ok {
+	register, value := modbus.RegisterAddressAndValue(req)
+	if output, ok := u.outputs[register]; ok {
 		if output.Pwm != nil {
-			if uint32(value) > *output.Pwm.Cycle {
-				value = uint16(*output.Pwm.Cycle)
-			}
-			output.Pin.DutyCycle(uint32(value), *output.Pwm.Cycle)
-			mb.HoldingRegisters[register] = value
-			return frame.GetData()[0:4], &mbserver.Success
+			s.writePwm(u, register, output, value, false)
+			return req.Data[0:4], nil
+		}
+	}
+	if handled, err := s.writePollerHoldingRegister(u, register, value); handled {
+		if err != nil {
+			log.WithFields(log.Fields{"addr": register}).Warnf("holding register write rejected: %s", err)
+			return nil, modbus.IllegalDataValue
 		}
+		return req.Data[0:4], nil
 	}
-	return []byte{}, &mbserver.IllegalDataAddress
+	return nil, modbus.IllegalDataAddress
 }
 
-func (s *Server) WriteMultipleCoils(mb *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Server) WriteMultipleCoils(u *unit, req *modbus.Request) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(frame)
-	valueBytes := frame.GetData()[5:]
+	register, numRegs, endRegister := modbus.RegisterAddressAndNumber(req)
+	valueBytes := req.Data[5:]
 
 	if endRegister > 65536 {
-		return []byte{}, &mbserver.IllegalDataAddress
+		return nil, modbus.IllegalDataAddress
 	}
 
 	bitCount := 0
@@ -281,17 +469,20 @@ func (s *Server) WriteMultipleCoils(mb *mbserver.Server, frame mbserver.Framer)
 			addr := register+(i*8)+int(bitPos)
 			addrVal := bitAtPosition(value, bitPos)
 
-			if output, ok := s.cfg.Outputs[addr]; ok {
+			if output, ok := u.outputs[addr]; ok {
 				if output.Pwm != nil {
-					duty := uint32(0)
+					setpoint := uint16(0)
 					if addrVal == 1 {
-						duty = *output.Pwm.Cycle
+						setpoint = pwmFullScale(output.Pwm)
 					}
-					output.Pin.DutyCycle(duty, *output.Pwm.Cycle)
+					s.writePwm(u, addr, output, setpoint, false)
+					u.coils[addr] = addrVal
 				} else {
-					output.Pin.Write(gpio.State(uint16(addrVal)))
+					s.writeCoil(u, addr, output, addrVal == 1)
 				}
-				mb.Coils[addr] = addrVal
+			} else if _, err := s.writePollerCoil(u, addr, addrVal == 1); err != nil {
+				log.WithFields(log.Fields{"addr": addr}).Warnf("coil write rejected: %s", err)
+				return nil, modbus.IllegalDataValue
 			}
 			bitCount++
 			if bitCount >= numRegs {
@@ -303,41 +494,42 @@ func (s *Server) WriteMultipleCoils(mb *mbserver.Server, frame mbserver.Framer)
 		}
 	}
 
-	return frame.GetData()[0:4], &mbserver.Success
+	return req.Data[0:4], nil
 }
 
-func (s *Server) WriteHoldingRegisters(mb *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Server) WriteHoldingRegisters(u *unit, req *modbus.Request) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	register, numRegs, _ := modbus.RegisterAddressAndNumber(frame)
-	valueBytes := frame.GetData()[5:]
-	var exception *mbserver.Exception
-	var data []byte
+	register, _, endRegister := modbus.RegisterAddressAndNumber(req)
+	valueBytes := req.Data[5:]
 
-	if len(valueBytes)/2 != numRegs {
-		exception = &mbserver.IllegalDataAddress
+	if endRegister > 65536 {
+		return nil, modbus.IllegalDataAddress
 	}
 
-	// Copy data to memory
-	values := mbserver.BytesToUint16(valueBytes)
-	for i, value := range values {
-		if output, ok := s.cfg.Outputs[register+i]; ok {
-			if output.Pwm != nil {
-				output.Pin.DutyCycle(uint32(value), *output.Pwm.Cycle)
-				mb.HoldingRegisters[register+i] = value
-			} else {
-				exception = &mbserver.IllegalDataAddress
-				break
+	// every register is checked before applying any, the pollers only reject
+	// the registers they don't declare
+	values := modbus.BytesToUint16(valueBytes)
+	for i := range values {
+		if output, ok := u.outputs[register+i]; ok {
+			if output.Pwm == nil {
+				return nil, modbus.IllegalDataAddress
 			}
-		} else {
-			exception = &mbserver.IllegalDataAddress
-			break
+		} else if _, ok := u.writers[poller.Address{Kind: poller.HoldingRegister, Addr: register+i}]; !ok {
+			return nil, modbus.IllegalDataAddress
 		}
 	}
-	exception = &mbserver.Success
-	data = frame.GetData()[0:4]
 
-	return data, exception
+	// Copy data to memory
+	for i, value := range values {
+		if output, ok := u.outputs[register+i]; ok {
+			s.writePwm(u, register+i, output, value, false)
+		} else if _, err := s.writePollerHoldingRegister(u, register+i, value); err != nil {
+			log.WithFields(log.Fields{"addr": register+i}).Warnf("holding register write rejected: %s", err)
+			return nil, modbus.IllegalDataValue
+		}
+	}
+	return req.Data[0:4], nil
 }
 
 func Uint16ToBytes(values []uint16) []byte {
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"bytes"
+	"bufio"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"encoding/hex"
+	"path/filepath"
+	"github.com/ggueret/mbpio/gpio"
+	"github.com/ggueret/mbpio/modbus"
+	"github.com/ggueret/mbpio/poller"
+)
+
+// freeAddress returns a local TCP address nothing listens on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// loadServer builds a server from config written to a temporary file.
+func loadServer(t *testing.T, config string) (*Server, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mbpio.yml")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(path)
+}
+
+// configTest is a configuration and the error it fails with, err is a part
+// of the message and empty for a valid configuration.
+type configTest struct {
+	name	string
+	config	string
+	err		string
+}
+
+// checkConfigs runs load on the configuration of every test and checks the
+// error it returns.
+func checkConfigs(t *testing.T, tests []configTest, load func(config string) error) {
+	t.Helper()
+	for _, test := range tests {
+		err := load(test.config)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+// startServer runs mbpio on the sim driver with config, %s being replaced by
+// the listen address and then the control socket. The server is stopped with
+// the test.
+func startServer(t *testing.T, config string) (string, string) {
+	t.Helper()
+	address, control := freeAddress(t), filepath.Join(t.TempDir(), "sim.sock")
+	s, err := loadServer(t, fmt.Sprintf(config, address, control))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runServer(t, s, address)
+	return address, control
+}
+
+// runServer starts s and waits for it to listen on address. The returned
+// function stops the server, it is called again with the test cleanup.
+func runServer(t *testing.T, s *Server, address string) func() {
+	t.Helper()
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			s.Stop()
+			if err := <-started; err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	t.Cleanup(stop)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return stop
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// mbClient sends Modbus/TCP requests written as hex PDUs.
+type mbClient struct {
+	t			*testing.T
+	conn		net.Conn
+	transaction	uint16
+}
+
+func dialModbus(t *testing.T, address string) *mbClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &mbClient{t: t, conn: conn}
+}
+
+func (c *mbClient) request(unit byte, request string) string {
+	c.t.Helper()
+	pdu, err := hex.DecodeString(request)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.transaction++
+	frame := []byte{byte(c.transaction >> 8), byte(c.transaction), 0, 0, 0, byte(len(pdu) + 1), unit}
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Write(append(frame, pdu...)); err != nil {
+		c.t.Fatal(err)
+	}
+
+	header := make([]byte, 7)
+	if _, err := readFull(c.conn, header); err != nil {
+		c.t.Fatal(err)
+	}
+	if !bytes.Equal(header[:4], frame[:4]) || header[6] != unit {
+		c.t.Fatalf("response header % x to % x", header, frame[:7])
+	}
+	response := make([]byte, int(header[4]) << 8 | int(header[5]) - 1)
+	if _, err := readFull(c.conn, response); err != nil {
+		c.t.Fatal(err)
+	}
+	return hex.EncodeToString(response)
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		read, err := conn.Read(buf[n:])
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// simPin asks the control socket of the sim driver for the state of pin.
+func simPin(t *testing.T, control string, command string) string {
+	t.Helper()
+	conn, err := net.Dial("unix", control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprintln(conn, command)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(reply)
+}
+
+const simConfig = `
+listen_on: %s
+gpio: {driver: sim, control: %s}
+unit_id: 1
+inputs:
+  103: {pin: 24, pull: down}
+outputs:
+  1: {pin: 12, pwm: {freq: 1000, cycle: 100}}
+  3: {pin: 23}
+`
+
+func TestServerSim(t *testing.T) {
+	address, control := startServer(t, simConfig)
+	client := dialModbus(t, address)
+
+	// coil 3 drives pin 23
+	if got := client.request(1, "050003ff00"); got != "050003ff00" {
+		t.Errorf("write coil: %s", got)
+	}
+	if got := simPin(t, control, "get 23"); !strings.Contains(got, "mode=Output") || !strings.Contains(got, "level=High") {
+		t.Errorf("pin 23 after writing coil 3: %s", got)
+	}
+	if got := client.request(1, "0100030001"); got != "010101" {
+		t.Errorf("read coil: %s", got)
+	}
+	if got := client.request(1, "0f000300010100"); got != "0f00030001" {
+		t.Errorf("write coils: %s", got)
+	}
+	if got := simPin(t, control, "get 23"); !strings.Contains(got, "level=Low") {
+		t.Errorf("pin 23 after clearing coil 3: %s", got)
+	}
+
+	// holding register 1 is the duty of pin 12
+	if got := client.request(1, "060001002a"); got != "060001002a" {
+		t.Errorf("write holding register: %s", got)
+	}
+	if got := simPin(t, control, "get 12"); !strings.Contains(got, "mode=Pwm") || !strings.Contains(got, "freq=1000 duty=42/100") {
+		t.Errorf("pin 12 after writing holding register 1: %s", got)
+	}
+	if got := client.request(1, "0300010001"); got != "0302002a" {
+		t.Errorf("read holding register: %s", got)
+	}
+
+	// discrete input 103 follows pin 24
+	if got := simPin(t, control, "24 high"); got != "ok" {
+		t.Fatalf("drive pin 24: %s", got)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := client.request(1, "0200670001")
+		if got == "020101" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("discrete input 103 with pin 24 high: %s", got)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// another unit gets a gateway exception
+	if got := client.request(2, "0100030001"); got != "810b" {
+		t.Errorf("read coil of unit 2: %s", got)
+	}
+	if got := client.request(2, "0100030000"); got != "810b" {
+		t.Errorf("read no coil of unit 2: %s", got)
+	}
+	if got := client.request(1, "0100030000"); got != "8103" {
+		t.Errorf("read no coil: %s", got)
+	}
+}
+
+func TestServerStartFailure(t *testing.T) {
+	address := freeAddress(t)
+	// the tcp listener is up when the udp one fails
+	s, err := loadServer(t, fmt.Sprintf("listen_on: %s\nudp_listen_on: 256.0.0.1:502\ngpio: {driver: sim}\n", address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err == nil {
+		t.Fatal("started without the udp listener")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked after a failed Start")
+	}
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Error("tcp listener left open")
+	}
+}
+
+const safeConfig = `
+listen_on: %s
+gpio: {driver: sim, control: %s}
+outputs:
+  1: {pin: 12, pwm: {freq: 1000, cycle: 100}, safe_state: 10}
+  3: {pin: 23, safe_state: 1}
+  4: {pin: 24}
+`
+
+func TestServerSafeStates(t *testing.T) {
+	address, control := freeAddress(t), filepath.Join(t.TempDir(), "sim.sock")
+	s, err := loadServer(t, fmt.Sprintf(safeConfig, address, control))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := runServer(t, s, address)
+
+	// the outputs start in their safe state
+	if got := simPin(t, control, "get 23"); !strings.Contains(got, "level=High") {
+		t.Errorf("pin 23 at startup: %s", got)
+	}
+	if got := simPin(t, control, "get 12"); !strings.Contains(got, "duty=10/100") {
+		t.Errorf("pin 12 at startup: %s", got)
+	}
+	if got := simPin(t, control, "get 24"); !strings.Contains(got, "level=Low") {
+		t.Errorf("pin 24 at startup: %s", got)
+	}
+
+	client := dialModbus(t, address)
+	client.request(0, "0500030000")
+	client.request(0, "050004ff00")
+	client.request(0, "060001002a")
+	if got := simPin(t, control, "get 23"); !strings.Contains(got, "level=Low") {
+		t.Errorf("pin 23 after clearing coil 3: %s", got)
+	}
+
+	// and go back to it on shutdown, the others are left alone
+	stop()
+	u := s.units[0]
+	if s.gpio.ReadPin(23) != gpio.High || u.coils[3] != 1 {
+		t.Errorf("coil 3 is %d on shutdown, want its safe state", u.coils[3])
+	}
+	if u.holdingRegisters[1] != 10 {
+		t.Errorf("holding register 1 is %d on shutdown, want its safe state", u.holdingRegisters[1])
+	}
+	if s.gpio.ReadPin(24) != gpio.High || u.coils[4] != 1 {
+		t.Errorf("coil 4 is %d on shutdown, want it left set", u.coils[4])
+	}
+}
+
+const watchdogConfig = `
+listen_on: %s
+gpio: {driver: sim, control: %s}
+comm_timeout: 200ms
+comm_status: 500
+outputs:
+  1: {pin: 12, pwm: {freq: 1000, cycle: 100}, safe_state: 10}
+  3: {pin: 23, safe_state: 1}
+  4: {pin: 24}
+`
+
+func TestServerWatchdog(t *testing.T) {
+	address, control := startServer(t, watchdogConfig)
+	client := dialModbus(t, address)
+	if got := client.request(0, "0500030000"); got != "0500030000" {
+		t.Fatalf("write coil 3: %s", got)
+	}
+	client.request(0, "050004ff00")
+	client.request(0, "060001002a")
+	if got := client.request(0, "0201f40001"); got != "020100" {
+		t.Errorf("comm status while served: %s", got)
+	}
+
+	// no request for the comm timeout trips the watchdog
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(simPin(t, control, "get 23"), "level=High") {
+		if time.Now().After(deadline) {
+			t.Fatal("pin 23 not driven to its safe state")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := simPin(t, control, "get 12"); !strings.Contains(got, "duty=10/100") {
+		t.Errorf("pin 12 after the trip: %s", got)
+	}
+	if got := simPin(t, control, "get 24"); !strings.Contains(got, "level=High") {
+		t.Errorf("pin 24 without safe state after the trip: %s", got)
+	}
+
+	// the first request reads the status set, and restores it
+	if got := client.request(0, "0201f40001"); got != "020101" {
+		t.Errorf("comm status after the trip: %s", got)
+	}
+	if got := client.request(0, "0201f40001"); got != "020100" {
+		t.Errorf("comm status once restored: %s", got)
+	}
+	// the outputs keep their safe state until written
+	if got := client.request(0, "0100030001"); got != "010101" {
+		t.Errorf("coil 3 once restored: %s", got)
+	}
+	if got := client.request(0, "0300010001"); got != "0302000a" {
+		t.Errorf("holding register 1 once restored: %s", got)
+	}
+}
+
+// rejectWriter is a poller taking the coil writes clearing the coil and the
+// holding register writes under 100 only.
+type rejectWriter struct {
+	writes		[]string
+}
+
+func (w *rejectWriter) WriteCoil(addr int, value bool) (bool, error) {
+	if value {
+		return false, fmt.Errorf("coil %d can only be cleared", addr)
+	}
+	w.writes = append(w.writes, fmt.Sprintf("coil %d", addr))
+	return value, nil
+}
+
+func (w *rejectWriter) WriteHoldingRegister(addr int, value uint16) (uint16, error) {
+	if value >= 100 {
+		return 0, fmt.Errorf("holding register %d over 100", addr)
+	}
+	w.writes = append(w.writes, fmt.Sprintf("holding register %d=%d", addr, value))
+	return value, nil
+}
+
+func TestServerWriteRejected(t *testing.T) {
+	s, err := loadServer(t, "gpio: {driver: sim}\noutputs: {1: {pin: 12, pwm: {}}, 3: {pin: 23}}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.initOutputs(); err != nil {
+		t.Fatal(err)
+	}
+	writer := &rejectWriter{}
+	u := s.units[0]
+	u.writers = map[poller.Address]poller.Writer{
+		{Kind: poller.Coil, Addr: 20}: writer,
+		{Kind: poller.HoldingRegister, Addr: 10}: writer,
+		{Kind: poller.HoldingRegister, Addr: 11}: writer,
+	}
+
+	tests := []struct {
+		name		string
+		handler		unitHandler
+		request		string
+		err			error
+	}{
+		{"coil rejected", s.WriteSingleCoil, "0014ff00", modbus.IllegalDataValue},
+		{"coils rejected", s.WriteMultipleCoils, "001400010101", modbus.IllegalDataValue},
+		{"coils", s.WriteMultipleCoils, "001400010100", nil},
+		// nothing is applied when a register is rejected
+		{"unmapped register", s.WriteHoldingRegisters, "000100020400050006", modbus.IllegalDataAddress},
+		{"coil register", s.WriteHoldingRegisters, "000200020400050006", modbus.IllegalDataAddress},
+		{"register after a poller", s.WriteHoldingRegisters, "000a000306000500060007", modbus.IllegalDataAddress},
+		{"registers", s.WriteHoldingRegisters, "000a00020400050006", nil},
+		{"register rejected", s.WriteHoldingRegisters, "000b0001020064", modbus.IllegalDataValue},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.request)
+		if _, err := test.handler(u, &modbus.Request{Data: data}); err != test.err {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+	if want := "[coil 20 holding register 10=5 holding register 11=6]"; fmt.Sprint(writer.writes) != want {
+		t.Errorf("writes %s, want %s", writer.writes, want)
+	}
+	if u.holdingRegisters[1] != 0 {
+		t.Errorf("holding register 1 is %d after the rejected writes", u.holdingRegisters[1])
+	}
+}
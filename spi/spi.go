@@ -0,0 +1,16 @@
+package spi
+
+// Conn is a device on a SPI bus, Tx clocks w out while reading as many bytes
+// into r, both buffers must have the same length.
+type Conn interface {
+	Tx(w, r []byte) error
+	Close() error
+}
+
+// Config holds the clock mode (0 to 3), the clock speed in Hz and the word
+// size of a device, zero values keep the driver defaults.
+type Config struct {
+	Mode		uint8
+	Speed		uint32
+	Bits		uint8
+}
@@ -0,0 +1,7 @@
+package spi
+
+import "errors"
+
+func Open(bus, cs int, cfg Config) (Conn, error) {
+	return nil, errors.New("spi: not supported on this platform")
+}
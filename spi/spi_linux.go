@@ -0,0 +1,105 @@
+package spi
+
+import (
+	"os"
+	"fmt"
+	"unsafe"
+	"runtime"
+	"syscall"
+)
+
+// see include/uapi/linux/spi/spidev.h
+const (
+	spiIocWrMode = 0x40016b01
+	spiIocWrBitsPerWord = 0x40016b03
+	spiIocWrMaxSpeedHz = 0x40046b04
+	spiIocMessage1 = 0x40206b00
+)
+
+type spiIocTransfer struct {
+	txBuf		uint64
+	rxBuf		uint64
+	len			uint32
+	speedHz		uint32
+	delayUsecs	uint16
+	bitsPerWord	uint8
+	csChange	uint8
+	txNbits		uint8
+	rxNbits		uint8
+	wordDelay	uint8
+	pad			uint8
+}
+
+// devConn talks to a /dev/spidevB.C device with the SPI_IOC_MESSAGE ioctl.
+type devConn struct {
+	file		*os.File
+	cfg			Config
+}
+
+func Open(bus, cs int, cfg Config) (Conn, error) {
+	file, err := os.OpenFile(fmt.Sprintf("/dev/spidev%d.%d", bus, cs), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	c := &devConn{file: file, cfg: cfg}
+
+	mode, bits, speed := cfg.Mode, cfg.Bits, cfg.Speed
+	err = c.ioctl(spiIocWrMode, unsafe.Pointer(&mode))
+	if err == nil && bits > 0 {
+		err = c.ioctl(spiIocWrBitsPerWord, unsafe.Pointer(&bits))
+	}
+	if err == nil && speed > 0 {
+		err = c.ioctl(spiIocWrMaxSpeedHz, unsafe.Pointer(&speed))
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("spi: cannot configure %s: %s", file.Name(), err)
+	}
+	return c, nil
+}
+
+func (c *devConn) ioctl(req uintptr, arg unsafe.Pointer) error {
+	conn, err := c.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (c *devConn) Tx(w, r []byte) error {
+	if len(w) != len(r) {
+		return fmt.Errorf("spi: write and read buffers differ in length (%d, %d)", len(w), len(r))
+	}
+	if len(w) == 0 {
+		return nil
+	}
+	xfer := spiIocTransfer{
+		txBuf: uint64(uintptr(unsafe.Pointer(&w[0]))),
+		rxBuf: uint64(uintptr(unsafe.Pointer(&r[0]))),
+		len: uint32(len(w)),
+		speedHz: c.cfg.Speed,
+		bitsPerWord: c.cfg.Bits,
+	}
+	err := c.ioctl(spiIocMessage1, unsafe.Pointer(&xfer))
+	// the buffers are only referenced through integers by the transfer
+	runtime.KeepAlive(w)
+	runtime.KeepAlive(r)
+	if err != nil {
+		return fmt.Errorf("spi: transfer on %s failed: %s", c.file.Name(), err)
+	}
+	return nil
+}
+
+func (c *devConn) Close() error {
+	return c.file.Close()
+}
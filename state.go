@@ -0,0 +1,234 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"gopkg.in/yaml.v2"
+	"github.com/ggueret/mbpio/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// stateFile retains values across restarts in a YAML file, the poller values
+// and the last value of the outputs per unit. It is rewritten atomically when
+// something changed, at most once per interval.
+type stateFile struct {
+	path		string
+	mu			sync.Mutex
+	Values		map[string]int64	`yaml:"values"`
+	Units		map[int]*retainedUnit	`yaml:"units"`
+	dirty		bool
+}
+
+type retainedUnit struct {
+	Coils				map[int]bool	`yaml:"coils,omitempty"`
+	HoldingRegisters	map[int]uint16	`yaml:"holding_registers,omitempty"`
+}
+
+func loadState(path string) (*stateFile, error) {
+	state := &stateFile{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Values == nil {
+		state.Values = make(map[string]int64)
+	}
+	if state.Units == nil {
+		state.Units = make(map[int]*retainedUnit)
+	}
+	return state, nil
+}
+
+func (f *stateFile) Retained(key string) (int64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.Values[key]
+	return value, ok
+}
+
+func (f *stateFile) Retain(key string, value int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if current, ok := f.Values[key]; !ok || current != value {
+		f.Values[key] = value
+		f.dirty = true
+	}
+}
+
+func (f *stateFile) retainOutput(id, addr int, coil bool, value uint16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	retained, ok := f.Units[id]
+	if !ok {
+		retained = &retainedUnit{}
+		f.Units[id] = retained
+	}
+	if coil {
+		if retained.Coils == nil {
+			retained.Coils = make(map[int]bool)
+		}
+		if current, ok := retained.Coils[addr]; !ok || current != (value != 0) {
+			retained.Coils[addr] = value != 0
+			f.dirty = true
+		}
+		return
+	}
+	if retained.HoldingRegisters == nil {
+		retained.HoldingRegisters = make(map[int]uint16)
+	}
+	if current, ok := retained.HoldingRegisters[addr]; !ok || current != value {
+		retained.HoldingRegisters[addr] = value
+		f.dirty = true
+	}
+}
+
+func (f *stateFile) retainedOutput(id, addr int, coil bool) (uint32, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	retained, ok := f.Units[id]
+	if !ok {
+		return 0, false
+	}
+	if coil {
+		value, ok := retained.Coils[addr]
+		if value {
+			return 1, ok
+		}
+		return 0, ok
+	}
+	value, ok := retained.HoldingRegisters[addr]
+	return uint32(value), ok
+}
+
+// setupRetain checks the retain policy of an output, without one it starts
+// from its safe state when it has one.
+func (s *Server) setupRetain(addr int, output *config.Output) error {
+	switch output.Retain {
+	case "":
+		output.Retain = "false"
+		if output.SafeState != nil {
+			output.Retain = "safe"
+		}
+	case "false":
+	case "true":
+		if s.state == nil {
+			return fmt.Errorf("output %d: retain needs a state_file", addr)
+		}
+		if output.Pwm == nil && hasTimers(*output) {
+			return fmt.Errorf("output %d: a coil with a pulse, on_delay or off_delay cannot be retained", addr)
+		}
+	case "safe":
+		if output.SafeState == nil {
+			return fmt.Errorf("output %d: retain safe needs a safe_state", addr)
+		}
+	default:
+		return fmt.Errorf("output %d: unknown retain %q, choices: true, false, safe", addr, output.Retain)
+	}
+	return nil
+}
+
+// initialValue returns the startup value of an output: the retained one, its
+// safe state or the default.
+func (s *Server) initialValue(u *unit, addr int, output config.Output) uint32 {
+	switch output.Retain {
+	case "true":
+		if value, ok := s.state.retainedOutput(u.id, addr, output.Pwm == nil); ok {
+			return value
+		}
+	case "safe":
+		return *output.SafeState
+	}
+	return uint32(OUTPUT_DEFAULT_VALUE)
+}
+
+// retainOutputs records the outputs of a unit to retain, the register map
+// must be locked.
+func (s *Server) retainOutputs(u *unit) {
+	if s.state == nil {
+		return
+	}
+	for addr, output := range u.outputs {
+		if output.Retain != "true" {
+			continue
+		}
+		if output.Pwm != nil {
+			s.state.retainOutput(u.id, addr, false, u.holdingRegisters[addr])
+		} else {
+			s.state.retainOutput(u.id, addr, true, uint16(u.coils[addr]))
+		}
+	}
+}
+
+// save writes the state to a temporary file synced before replacing the
+// previous one, so a power loss leaves either of them intact.
+func (f *stateFile) save() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return nil
+	}
+
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path) + ".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if dir, err := os.Open(filepath.Dir(f.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	f.dirty = false
+	return nil
+}
+
+func (s *Server) runState(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.StateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			for _, u := range s.units {
+				s.retainOutputs(u)
+			}
+			s.mu.Unlock()
+			if err := s.state.save(); err != nil {
+				log.Warnf("cannot save the state to %s: %s", s.state.path, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/ggueret/mbpio/gpio"
+)
+
+// stateFiles returns the names of the files left in dir.
+func stateFiles(t *testing.T, dir string) string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return fmt.Sprint(names)
+}
+
+func TestStateSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.yml")
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Retain("counter/5", 42)
+	state.retainOutput(1, 3, true, 1)
+	state.retainOutput(1, 8, false, 512)
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	// the temporary file is renamed over the state
+	if got := stateFiles(t, dir); got != "[state.yml]" {
+		t.Errorf("files %s after saving, want the state only", got)
+	}
+
+	restored, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := restored.Retained("counter/5"); !ok || value != 42 {
+		t.Errorf("counter/5 restored as %d, %t", value, ok)
+	}
+	if value, ok := restored.retainedOutput(1, 3, true); !ok || value != 1 {
+		t.Errorf("coil 3 restored as %d, %t", value, ok)
+	}
+	if value, ok := restored.retainedOutput(1, 8, false); !ok || value != 512 {
+		t.Errorf("holding register 8 restored as %d, %t", value, ok)
+	}
+	if _, ok := restored.retainedOutput(2, 3, true); ok {
+		t.Error("coil 3 of unit 2 restored")
+	}
+
+	// nothing changed, nothing written
+	os.Remove(path)
+	restored.Retain("counter/5", 42)
+	restored.retainOutput(1, 3, true, 1)
+	if err := restored.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("unchanged state written: %v", err)
+	}
+
+	// a failed rename leaves the previous state and no temporary file
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	restored.Retain("counter/5", 43)
+	if err := restored.save(); err == nil {
+		t.Error("saved over a directory")
+	}
+	if got := stateFiles(t, dir); got != "[state.yml]" {
+		t.Errorf("files %s after a failed save, want the state only", got)
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("previous state replaced: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path + ".bad", []byte("values: [1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(path + ".bad"); err == nil {
+		t.Error("loaded an invalid state")
+	}
+}
+
+func TestRetainPolicy(t *testing.T) {
+	tests := []configTest{
+		{"retain", "state_file: %s\noutputs: {3: {pin: 23, retain: true}}\n", ""},
+		{"retain without state file", "outputs: {3: {pin: 23, retain: true}}\n", "output 3: retain needs a state_file"},
+		{"retain a pulse", "state_file: %s\noutputs: {3: {pin: 23, pulse: 1s, retain: true}}\n", "output 3: a coil with a pulse, on_delay or off_delay cannot be retained"},
+		{"retain an on delay", "state_file: %s\noutputs: {3: {pin: 23, on_delay: 1s, retain: true}}\n", "output 3: a coil with a pulse"},
+		{"retain an off delay", "state_file: %s\noutputs: {3: {pin: 23, off_delay: 1s, retain: true}}\n", "output 3: a coil with a pulse"},
+		{"not retained pulse", "state_file: %s\noutputs: {3: {pin: 23, pulse: 1s, retain: false}}\n", ""},
+		{"safe", "outputs: {3: {pin: 23, safe_state: 1, retain: safe}}\n", ""},
+		{"safe without safe state", "outputs: {3: {pin: 23, retain: safe}}\n", "output 3: retain safe needs a safe_state"},
+		{"unknown", "outputs: {3: {pin: 23, retain: maybe}}\n", "output 3: unknown retain \"maybe\""},
+	}
+	checkConfigs(t, tests, func(config string) error {
+		if strings.Contains(config, "%s") {
+			config = fmt.Sprintf(config, filepath.Join(t.TempDir(), "state.yml"))
+		}
+		s, err := loadServer(t, "gpio: {driver: sim}\n" + config)
+		if err == nil {
+			err = s.initOutputs()
+		}
+		return err
+	})
+}
+
+func TestRetainRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.yml")
+	state := "units:\n  0:\n    coils: {3: true, 4: true, 5: true}\n    holding_registers: {1: 42}\n"
+	if err := ioutil.WriteFile(path, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadServer(t, fmt.Sprintf(`
+gpio: {driver: sim}
+state_file: %s
+outputs:
+  1: {pin: 12, pwm: {}, retain: true}
+  2: {pin: 22, retain: true}
+  3: {pin: 23, retain: true}
+  4: {pin: 24, safe_state: 0}
+  5: {pin: 25, safe_state: 0, retain: false}
+  6: {pin: 26, safe_state: 1}
+`, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.initOutputs(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retained values, then the safe states or the default
+	u := s.units[0]
+	if u.holdingRegisters[1] != 42 {
+		t.Errorf("holding register 1 restored as %d, want 42", u.holdingRegisters[1])
+	}
+	for addr, want := range map[int]byte{2: 0, 3: 1, 4: 0, 5: 0, 6: 1} {
+		pin := u.outputs[addr].Pin
+		if u.coils[addr] != want || byte(s.gpio.ReadPin(pin)) != want {
+			t.Errorf("coil %d restored as %d with pin %d %s, want %d", addr, u.coils[addr], pin, gpio.StateStrings[s.gpio.ReadPin(pin)], want)
+		}
+	}
+
+	// only the outputs with retain: true are saved
+	u.coils[2], u.coils[3], u.coils[6] = 1, 0, 0
+	u.holdingRegisters[1] = 7
+	s.retainOutputs(u)
+	if err := s.state.save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]bool{2: true, 3: false, 4: true, 5: true}
+	if got := saved.Units[0].Coils; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("saved coils %v, want %v", got, want)
+	}
+	if got := saved.Units[0].HoldingRegisters[1]; got != 7 {
+		t.Errorf("saved holding register 1 is %d, want 7", got)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"github.com/ggueret/mbpio/config"
+	"github.com/ggueret/mbpio/modbus"
+	"github.com/ggueret/mbpio/poller"
+)
+
+// unit is a logical slave device answering on its unit id, with its own
+// inputs, outputs and register map. Without units in the configuration the
+// top level inputs and outputs make a single unit, which answers every unit
+// id when its id is 0 (TCP, TLS and UDP only).
+type unit struct {
+	id					int
+	inputs				map[int]config.Input
+	outputs				map[int]config.Output
+
+	mu					*sync.Mutex
+	discreteInputs		[]byte
+	coils				[]byte
+	holdingRegisters	[]uint16
+	inputRegisters		[]uint16
+
+	pollers				[]*pollerGroup
+	writers				map[poller.Address]poller.Writer
+	coilTimers			map[int]*coilTimer
+	ramps				map[int]*pwmRamp
+}
+
+// unitHandler is a function handler working on the unit addressed by the
+// request.
+type unitHandler func(*unit, *modbus.Request) ([]byte, error)
+
+func newUnit(id int, inputs map[int]config.Input, outputs map[int]config.Output, mu *sync.Mutex) *unit {
+	return &unit{
+		id: id,
+		inputs: inputs,
+		outputs: outputs,
+		mu: mu,
+		discreteInputs: make([]byte, 65536),
+		coils: make([]byte, 65536),
+		holdingRegisters: make([]uint16, 65536),
+		inputRegisters: make([]uint16, 65536),
+	}
+}
+
+// wrap prefixes an error with the unit it comes from.
+func (u *unit) wrap(err error) error {
+	if err == nil || u.id == 0 {
+		return err
+	}
+	return fmt.Errorf("unit %d: %s", u.id, err)
+}
+
+// loadUnits builds the units from the configuration, sorted by id.
+func (s *Server) loadUnits() error {
+	if status := s.cfg.CommStatus; status != nil && (*status < 0 || *status > 65535) {
+		return fmt.Errorf("comm_status %d out of range 0-65535", *status)
+	}
+
+	if len(s.cfg.Units) == 0 {
+		if s.cfg.UnitID < 0 || s.cfg.UnitID > 247 {
+			return fmt.Errorf("unit_id %d out of range 0-247", s.cfg.UnitID)
+		}
+		// on a shared bus a unit answering every id would talk over the
+		// other slaves
+		if s.cfg.UnitID == 0 && (s.cfg.RTU != nil || s.cfg.RTUOverTCPListenOn != "") {
+			return fmt.Errorf("unit_id is required along with rtu and rtu_over_tcp_listen_on")
+		}
+		s.units = []*unit{newUnit(s.cfg.UnitID, s.cfg.Inputs, s.cfg.Outputs, &s.mu)}
+		return nil
+	}
+
+	if len(s.cfg.Inputs) > 0 || len(s.cfg.Outputs) > 0 {
+		return fmt.Errorf("inputs and outputs must be declared in the units")
+	}
+	if s.cfg.UnitID != 0 {
+		return fmt.Errorf("unit_id does not apply along with units")
+	}
+	ids := make([]int, 0, len(s.cfg.Units))
+	for id := range s.cfg.Units {
+		if id < 1 || id > 247 {
+			return fmt.Errorf("unit %d out of range 1-247", id)
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		cfg := s.cfg.Units[id]
+		s.units = append(s.units, newUnit(id, cfg.Inputs, cfg.Outputs, &s.mu))
+	}
+	return nil
+}
+
+// unit returns the unit answering on id, nil when there is none.
+func (s *Server) unit(id uint8) *unit {
+	for _, u := range s.units {
+		if u.id == 0 || u.id == int(id) {
+			return u
+		}
+	}
+	return nil
+}
+
+// ServesUnit tells the modbus server whether a unit is served.
+func (s *Server) ServesUnit(id uint8) bool {
+	return s.unit(id) != nil
+}
+
+// ServeModbus answers a request on the unit it is addressed to, a broadcast
+// is applied to every unit. The role of a TLS client must be authorized.
+func (s *Server) ServeModbus(req *modbus.Request) ([]byte, error) {
+	units := s.units
+	if !req.Broadcast {
+		u := s.unit(req.Unit)
+		if u == nil {
+			return nil, modbus.ErrUnknownUnit
+		}
+		units = []*unit{u}
+	}
+	if err := s.authorize(req); err != nil {
+		return nil, err
+	}
+	handler := s.handlers[req.Function]
+	if handler == nil {
+		return nil, modbus.IllegalFunction
+	}
+	var data []byte
+	var err error
+	for _, u := range units {
+		data, err = handler(u, req)
+	}
+	return data, err
+}
+
+func (u *unit) SetInputRegister(addr int, value uint16) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.inputRegisters[addr] = value
+}
+
+func (u *unit) SetDiscreteInput(addr int, value bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if value {
+		u.discreteInputs[addr] = 1
+	} else {
+		u.discreteInputs[addr] = 0
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLoadUnits(t *testing.T) {
+	tests := []configTest{
+		{"unit id", "unit_id: 1\nrtu: {address: /dev/null}\n", ""},
+		{"any id over tcp", "unit_id: 0\n", ""},
+		{"no unit id over tcp", "udp_listen_on: 127.0.0.1:0\n", ""},
+		{"any id over rtu", "rtu: {address: /dev/null}\n", "unit_id is required"},
+		{"any id over ascii", "rtu: {mode: ascii, address: /dev/null}\n", "unit_id is required"},
+		{"any id over the deprecated rtu", "enablertu: true\n", "unit_id is required"},
+		{"any id over rtu over tcp", "rtu_over_tcp_listen_on: 127.0.0.1:0\n", "unit_id is required"},
+		{"units over rtu", "rtu: {address: /dev/null}\nunits: {1: {}, 2: {}}\n", ""},
+		{"unit id negative", "unit_id: -1\n", "unit_id -1 out of range 0-247"},
+		{"unit id over 247", "unit_id: 248\n", "unit_id 248 out of range 0-247"},
+		{"unit 0", "units: {0: {}}\n", "unit 0 out of range 1-247"},
+		{"unit id along with units", "unit_id: 1\nunits: {1: {}}\n", "unit_id does not apply"},
+	}
+	checkConfigs(t, tests, func(config string) error {
+		_, err := loadServer(t, "gpio: {driver: sim}\n" + config)
+		return err
+	})
+}
+
+func TestServerUnit(t *testing.T) {
+	s := &Server{units: []*unit{newUnit(0, nil, nil, nil)}}
+	for _, id := range []uint8{1, 17, 247} {
+		if s.unit(id) != s.units[0] {
+			t.Errorf("unit 0 doesn't answer %d", id)
+		}
+	}
+
+	s.units = []*unit{newUnit(1, nil, nil, nil), newUnit(5, nil, nil, nil)}
+	for id, want := range map[uint8]*unit{1: s.units[0], 5: s.units[1], 2: nil, 0: nil} {
+		if got := s.unit(id); got != want {
+			t.Errorf("unit %d: %v, want %v", id, got, want)
+		}
+	}
+}
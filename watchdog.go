@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+	"context"
+	"github.com/ggueret/mbpio/gpio"
+	"github.com/ggueret/mbpio/modbus"
+	log "github.com/sirupsen/logrus"
+)
+
+// applySafeStates drives the outputs of a unit having a safe state to it, the
+// register map must be locked.
+func (s *Server) applySafeStates(u *unit) {
+	for addr, output := range u.outputs {
+		if output.SafeState == nil {
+			continue
+		}
+		value := *output.SafeState
+		if t, ok := u.coilTimers[addr]; ok {
+			t.cancel()
+			t.pulsing = false
+		}
+		if output.Pwm != nil {
+			s.writePwm(u, addr, output, uint16(value), true)
+		} else {
+			state := gpio.Low
+			if value != 0 {
+				state = gpio.High
+			}
+			s.gpio.WritePin(output.Pin, state)
+			u.coils[addr] = byte(state)
+		}
+		log.WithFields(log.Fields{"unit": u.id, "addr": addr, "pin": output.Pin, "value": value}).Debug("Output set to its safe state")
+	}
+}
+
+// feedWatchdog wraps a function handler so every successful request resets
+// the communication watchdog.
+func (s *Server) feedWatchdog(handler unitHandler) unitHandler {
+	return func(u *unit, req *modbus.Request) ([]byte, error) {
+		data, err := handler(u, req)
+		if err == nil {
+			s.mu.Lock()
+			s.lastRequest = time.Now()
+			if s.tripped {
+				s.tripped = false
+				s.setCommStatus(false)
+				log.Info("communication restored")
+			}
+			s.mu.Unlock()
+		}
+		return data, err
+	}
+}
+
+// setCommStatus reports the watchdog state on the comm status discrete input
+// of every unit.
+func (s *Server) setCommStatus(tripped bool) {
+	if s.cfg.CommStatus == nil {
+		return
+	}
+	for _, u := range s.units {
+		u.discreteInputs[*s.cfg.CommStatus] = 0
+		if tripped {
+			u.discreteInputs[*s.cfg.CommStatus] = 1
+		}
+	}
+}
+
+// runWatchdog applies the safe states once no request came for the comm
+// timeout, the outputs keep them until the master writes again.
+func (s *Server) runWatchdog(ctx context.Context) {
+	defer s.wg.Done()
+
+	every := s.cfg.CommTimeout / 10
+	if every < 10 * time.Millisecond {
+		every = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if !s.tripped && time.Since(s.lastRequest) > s.cfg.CommTimeout {
+				s.tripped = true
+				log.Warnf("no request for %s, applying the safe states", s.cfg.CommTimeout)
+				for _, u := range s.units {
+					s.applySafeStates(u)
+				}
+				s.setCommStatus(true)
+			}
+			s.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}